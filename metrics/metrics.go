@@ -0,0 +1,21 @@
+package metrics
+
+// Labels are the dimensions attached to a single observation
+type Labels map[string]string
+
+// Metrics describes a sink for counters and histograms
+type Metrics interface {
+	IncCounter(name string, labels Labels)
+	ObserveHistogram(name string, value float64, labels Labels)
+}
+
+// Default is the registry used by the common clients when none is set
+// explicitly. Expose it with Default.Handler() to scrape it
+var Default = NewPrometheus(nil)
+
+// Noop discards every observation
+type Noop struct{}
+
+func (Noop) IncCounter(name string, labels Labels) {}
+
+func (Noop) ObserveHistogram(name string, value float64, labels Labels) {}
@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds, matching the ones used by
+// the official prometheus client
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Prometheus is an in-process registry that renders its metrics in the
+// prometheus text exposition format
+type Prometheus struct {
+	mu         sync.Mutex
+	buckets    []float64
+	counters   map[string]map[string]*counter
+	histograms map[string]map[string]*histogram
+}
+
+type counter struct {
+	labels Labels
+	value  float64
+}
+
+type histogram struct {
+	labels Labels
+	counts []uint64 // one per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheus returns an empty registry. Histograms use the given upper
+// bounds, or DefaultBuckets if buckets is empty
+func NewPrometheus(buckets []float64) *Prometheus {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	return &Prometheus{
+		buckets:    b,
+		counters:   map[string]map[string]*counter{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+func (p *Prometheus) IncCounter(name string, labels Labels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	series, ok := p.counters[name]
+	if !ok {
+		series = map[string]*counter{}
+		p.counters[name] = series
+	}
+	key := labelString(labels)
+	c, ok := series[key]
+	if !ok {
+		c = &counter{labels: copyLabels(labels)}
+		series[key] = c
+	}
+	c.value++
+}
+
+func (p *Prometheus) ObserveHistogram(name string, value float64, labels Labels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	series, ok := p.histograms[name]
+	if !ok {
+		series = map[string]*histogram{}
+		p.histograms[name] = series
+	}
+	key := labelString(labels)
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{labels: copyLabels(labels), counts: make([]uint64, len(p.buckets))}
+		series[key] = h
+	}
+	for i, upper := range p.buckets {
+		if value <= upper {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// WriteTo renders every metric in the text exposition format
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var sb strings.Builder
+	for _, name := range sortedKeys(p.counters) {
+		fmt.Fprintf(&sb, "# TYPE %s counter\n", name)
+		series := p.counters[name]
+		for _, key := range sortedKeys(series) {
+			fmt.Fprintf(&sb, "%s%s %s\n", name, key, formatFloat(series[key].value))
+		}
+	}
+	for _, name := range sortedKeys(p.histograms) {
+		fmt.Fprintf(&sb, "# TYPE %s histogram\n", name)
+		series := p.histograms[name]
+		for _, key := range sortedKeys(series) {
+			h := series[key]
+			var cumulative uint64
+			for i, upper := range p.buckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, labelString(withLabel(h.labels, "le", formatFloat(upper))), cumulative)
+			}
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, labelString(withLabel(h.labels, "le", "+Inf")), h.count)
+			fmt.Fprintf(&sb, "%s_sum%s %s\n", name, key, formatFloat(h.sum))
+			fmt.Fprintf(&sb, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// Handler serves the registry so that it can be scraped
+func (p *Prometheus) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = p.WriteTo(w)
+	})
+}
+
+// labelString renders labels as {a="1",b="2"} with keys sorted so that the
+// result can double as a series key
+func labelString(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := sortedKeys(labels)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, k, escapeLabelValue(labels[k])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func withLabel(labels Labels, key, value string) Labels {
+	l := copyLabels(labels)
+	l[key] = value
+	return l
+}
+
+func copyLabels(labels Labels) Labels {
+	l := make(Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	return l
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
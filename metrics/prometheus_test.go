@@ -0,0 +1,39 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kickback-app/common/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusExposition(t *testing.T) {
+	p := metrics.NewPrometheus([]float64{0.1, 1})
+	p.IncCounter("requests_total", metrics.Labels{"method": "GET", "host": "example.com"})
+	p.IncCounter("requests_total", metrics.Labels{"host": "example.com", "method": "GET"})
+	p.ObserveHistogram("latency_seconds", 0.05, metrics.Labels{"host": "example.com"})
+	p.ObserveHistogram("latency_seconds", 0.5, metrics.Labels{"host": "example.com"})
+
+	var sb strings.Builder
+	_, err := p.WriteTo(&sb)
+	require.Nil(t, err, "write err should be nil")
+	require.Equal(t, `# TYPE requests_total counter
+requests_total{host="example.com",method="GET"} 2
+# TYPE latency_seconds histogram
+latency_seconds_bucket{host="example.com",le="0.1"} 1
+latency_seconds_bucket{host="example.com",le="1"} 2
+latency_seconds_bucket{host="example.com",le="+Inf"} 2
+latency_seconds_sum{host="example.com"} 0.55
+latency_seconds_count{host="example.com"} 2
+`, sb.String())
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	p := metrics.NewPrometheus(nil)
+	p.IncCounter("c", metrics.Labels{"v": "a\"b\\c\nd"})
+
+	var sb strings.Builder
+	_, _ = p.WriteTo(&sb)
+	require.Contains(t, sb.String(), `c{v="a\"b\\c\nd"} 1`)
+}
@@ -1,6 +1,7 @@
 package mocks
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,6 +26,37 @@ func (md MockDecoder) Decode(v interface{}) error {
 	return json.Unmarshal(b, v)
 }
 
+// MockIterator walks the elements of a scripted slice response
+type MockIterator struct {
+	ctx   context.Context
+	items []json.RawMessage
+	curr  json.RawMessage
+	err   error
+}
+
+func (mi *MockIterator) Next() bool {
+	if mi.err != nil {
+		return false
+	}
+	if err := mi.ctx.Err(); err != nil {
+		mi.err = err
+		return false
+	}
+	if len(mi.items) == 0 {
+		return false
+	}
+	mi.curr, mi.items = mi.items[0], mi.items[1:]
+	return true
+}
+
+func (mi *MockIterator) Decode(v interface{}) error {
+	return json.Unmarshal(mi.curr, v)
+}
+
+func (mi *MockIterator) Err() error { return mi.err }
+
+func (mi *MockIterator) Close() error { return nil }
+
 type MockDBManager struct {
 	Responses    []interface{}
 	FilterChecks []interface{}
@@ -62,7 +94,7 @@ func (mm *MockDBManager) validateFilter(filterToCheck interface{}) error {
 	return nil
 }
 
-func (mm *MockDBManager) FindOne(l log.Logger, cc *storage.CallContext, params *storage.FindOneParams) (storage.Decoder, error) {
+func (mm *MockDBManager) FindOne(l log.Logger, cc context.Context, params *storage.FindOneParams) (storage.Decoder, error) {
 	err := mm.validateFilter(params.Filter)
 	if err != nil {
 		return MockDecoder{}, err
@@ -79,7 +111,7 @@ func (mm *MockDBManager) FindOne(l log.Logger, cc *storage.CallContext, params *
 	}, e
 }
 
-func (mm *MockDBManager) FindMany(l log.Logger, cc *storage.CallContext, params *storage.FindManyParams) (storage.Decoder, error) {
+func (mm *MockDBManager) FindMany(l log.Logger, cc context.Context, params *storage.FindManyParams) (storage.Decoder, error) {
 	err := mm.validateFilter(params.Filter)
 	if err != nil {
 		return MockDecoder{}, err
@@ -95,7 +127,47 @@ func (mm *MockDBManager) FindMany(l log.Logger, cc *storage.CallContext, params
 	}, mm.getErr()
 }
 
-func (mm *MockDBManager) InsertOne(l log.Logger, cc *storage.CallContext, document interface{}, params *storage.InsertOneParams) (interface{}, error) {
+// Iterate expects the scripted response to be a slice (or a json array
+// string) and iterates over its elements
+func (mm *MockDBManager) Iterate(l log.Logger, cc context.Context, params *storage.FindManyParams) (storage.Iterator, error) {
+	err := mm.validateFilter(params.Filter)
+	if err != nil {
+		return &MockIterator{ctx: cc}, err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return &MockIterator{ctx: cc}, err
+	}
+	e := mm.getErr()
+	mm.CallCount++
+	var items []json.RawMessage
+	if err := (MockDecoder{data: resp}).Decode(&items); err != nil {
+		return &MockIterator{ctx: cc}, fmt.Errorf("res %v is not a valid slice: %v", resp, err)
+	}
+	return &MockIterator{ctx: cc, items: items}, e
+}
+
+// Aggregate checks the pipeline against FilterChecks the same way the other
+// calls check their filter
+func (mm *MockDBManager) Aggregate(l log.Logger, cc context.Context, params *storage.AggregateParams) (storage.Decoder, error) {
+	err := mm.validateFilter(params.Pipeline)
+	if err != nil {
+		return MockDecoder{}, err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return MockDecoder{}, err
+	}
+	e := mm.getErr()
+	mm.CallCount++
+	return MockDecoder{
+		data: resp,
+	}, e
+}
+
+func (mm *MockDBManager) InsertOne(l log.Logger, cc context.Context, document interface{}, params *storage.InsertOneParams) (interface{}, error) {
 	resp, err := mm.getResp()
 	if err != nil {
 		mm.CallCount++
@@ -106,7 +178,7 @@ func (mm *MockDBManager) InsertOne(l log.Logger, cc *storage.CallContext, docume
 	return resp, e
 }
 
-func (mm *MockDBManager) InsertMany(l log.Logger, cc *storage.CallContext, data []interface{}, params *storage.InsertManyParams) (interface{}, error) {
+func (mm *MockDBManager) InsertMany(l log.Logger, cc context.Context, data []interface{}, params *storage.InsertManyParams) (interface{}, error) {
 	resp, err := mm.getResp()
 	if err != nil {
 		mm.CallCount++
@@ -117,11 +189,84 @@ func (mm *MockDBManager) InsertMany(l log.Logger, cc *storage.CallContext, data
 	return resp, e
 }
 
-func (mm *MockDBManager) Upsert(l log.Logger, cc *storage.CallContext, updates interface{}, params *storage.UpsertParams) (int64, error) {
+func (mm *MockDBManager) Upsert(l log.Logger, cc context.Context, updates interface{}, params *storage.UpsertParams) (int64, error) {
+	err := mm.validateFilter(params.Filter)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return 0, err
+	}
+	respAsType, ok := resp.(int64)
+	if !ok {
+		return 0, fmt.Errorf("res %v is not a valid int64", resp)
+	}
+	mm.CallCount++
+	return respAsType, mm.getErr()
+}
+
+// UpsertWithResult accepts a *storage.UpsertResult, a storage.UpsertResult
+// or, like Upsert, an int64 which is used as both matched and modified count
+func (mm *MockDBManager) UpsertWithResult(l log.Logger, cc context.Context, updates interface{}, params *storage.UpsertParams) (*storage.UpsertResult, error) {
+	err := mm.validateFilter(params.Filter)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return nil, err
+	}
+	var res *storage.UpsertResult
+	switch r := resp.(type) {
+	case *storage.UpsertResult:
+		res = r
+	case storage.UpsertResult:
+		res = &r
+	case int64:
+		res = &storage.UpsertResult{MatchedCount: r, ModifiedCount: r}
+	default:
+		return nil, fmt.Errorf("res %v is not a valid upsert result", resp)
+	}
+	mm.CallCount++
+	return res, mm.getErr()
+}
+
+func (mm *MockDBManager) Delete(l log.Logger, cc context.Context, params *storage.DeleteParams) (int64, error) {
+	err := mm.validateFilter(params.Filter)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return 0, err
+	}
+	respAsType, ok := resp.(int64)
+	if !ok {
+		return 0, fmt.Errorf("res %v is not a valid int64", resp)
+	}
+	mm.CallCount++
+	return respAsType, mm.getErr()
+}
+
+func (mm *MockDBManager) Restore(l log.Logger, cc context.Context, params *storage.RestoreParams) (int64, error) {
 	err := mm.validateFilter(params.Filter)
 	if err != nil {
 		return 0, err
 	}
+	return mm.count()
+}
+
+// PurgeDeleted has no filter, so FilterChecks do not apply
+func (mm *MockDBManager) PurgeDeleted(l log.Logger, cc context.Context, params *storage.PurgeParams) (int64, error) {
+	return mm.count()
+}
+
+// count returns the scripted int64 response
+func (mm *MockDBManager) count() (int64, error) {
 	resp, err := mm.getResp()
 	if err != nil {
 		mm.CallCount++
@@ -135,7 +280,53 @@ func (mm *MockDBManager) Upsert(l log.Logger, cc *storage.CallContext, updates i
 	return respAsType, mm.getErr()
 }
 
-func (mm *MockDBManager) Delete(l log.Logger, cc *storage.CallContext, params *storage.DeleteParams) (int64, error) {
+// BulkWrite expects the scripted response to be a *storage.BulkWriteResult
+func (mm *MockDBManager) BulkWrite(l log.Logger, cc context.Context, models []storage.WriteModel, params *storage.BulkWriteParams) (*storage.BulkWriteResult, error) {
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return nil, err
+	}
+	respAsType, ok := resp.(*storage.BulkWriteResult)
+	if !ok {
+		return nil, fmt.Errorf("res %v is not a valid *storage.BulkWriteResult", resp)
+	}
+	mm.CallCount++
+	return respAsType, mm.getErr()
+}
+
+func (mm *MockDBManager) FindOneAndUpdate(l log.Logger, cc context.Context, updates interface{}, params *storage.FindOneAndUpdateParams) (storage.Decoder, error) {
+	return mm.findOneAnd(params.Filter)
+}
+
+func (mm *MockDBManager) FindOneAndReplace(l log.Logger, cc context.Context, replacement interface{}, params *storage.FindOneAndReplaceParams) (storage.Decoder, error) {
+	return mm.findOneAnd(params.Filter)
+}
+
+func (mm *MockDBManager) FindOneAndDelete(l log.Logger, cc context.Context, params *storage.FindOneAndDeleteParams) (storage.Decoder, error) {
+	return mm.findOneAnd(params.Filter)
+}
+
+// findOneAnd behaves like FindOne: script a storage.NotFoundError in Errors
+// to simulate no document matching the filter
+func (mm *MockDBManager) findOneAnd(filter interface{}) (storage.Decoder, error) {
+	err := mm.validateFilter(filter)
+	if err != nil {
+		return MockDecoder{}, err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return MockDecoder{}, err
+	}
+	e := mm.getErr()
+	mm.CallCount++
+	return MockDecoder{
+		data: resp,
+	}, e
+}
+
+func (mm *MockDBManager) CountDocuments(l log.Logger, cc context.Context, params *storage.CountParams) (int64, error) {
 	err := mm.validateFilter(params.Filter)
 	if err != nil {
 		return 0, err
@@ -153,4 +344,79 @@ func (mm *MockDBManager) Delete(l log.Logger, cc *storage.CallContext, params *s
 	return respAsType, mm.getErr()
 }
 
+func (mm *MockDBManager) Distinct(l log.Logger, cc context.Context, params *storage.DistinctParams) ([]interface{}, error) {
+	err := mm.validateFilter(params.Filter)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return nil, err
+	}
+	var values []interface{}
+	if err := (MockDecoder{data: resp}).Decode(&values); err != nil {
+		return nil, fmt.Errorf("res %v is not a valid slice: %v", resp, err)
+	}
+	mm.CallCount++
+	return values, mm.getErr()
+}
+
+func (mm *MockDBManager) Exists(l log.Logger, cc context.Context, params *storage.ExistsParams) (bool, error) {
+	err := mm.validateFilter(params.Filter)
+	if err != nil {
+		return false, err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return false, err
+	}
+	respAsType, ok := resp.(bool)
+	if !ok {
+		return false, fmt.Errorf("res %v is not a valid bool", resp)
+	}
+	mm.CallCount++
+	return respAsType, mm.getErr()
+}
+
+// Watch hands every event of the scripted response, a []*storage.ChangeEvent
+// or []storage.ChangeEvent, to handler and then returns the scripted error
+func (mm *MockDBManager) Watch(l log.Logger, cc context.Context, params *storage.WatchParams, handler storage.ChangeHandler) error {
+	err := mm.validateFilter(params.Pipeline)
+	if err != nil {
+		return err
+	}
+	resp, err := mm.getResp()
+	if err != nil {
+		mm.CallCount++
+		return err
+	}
+	var events []*storage.ChangeEvent
+	switch r := resp.(type) {
+	case []*storage.ChangeEvent:
+		events = r
+	case []storage.ChangeEvent:
+		for i := range r {
+			events = append(events, &r[i])
+		}
+	default:
+		return fmt.Errorf("res %v is not a valid slice of change events", resp)
+	}
+	e := mm.getErr()
+	mm.CallCount++
+	for _, event := range events {
+		if err := handler(cc, event); err != nil {
+			return err
+		}
+	}
+	return e
+}
+
+// WithTransaction runs fn against the mock itself so that the calls made
+// inside the transaction consume the scripted responses in order
+func (mm *MockDBManager) WithTransaction(l log.Logger, cc context.Context, fn func(tx storage.Manager) error) error {
+	return fn(mm)
+}
+
 func (mm MockDBManager) Close(l log.Logger) {}
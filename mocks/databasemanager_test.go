@@ -0,0 +1,103 @@
+package mocks_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMockAggregate(t *testing.T) {
+	pipeline := []bson.M{{"$match": bson.M{"hostId": "USR_1"}}}
+	mm := &mocks.MockDBManager{
+		Responses:    []interface{}{`[{"_id": "outdoor", "count": 2}]`},
+		FilterChecks: []interface{}{pipeline},
+	}
+	decoder, err := mm.Aggregate(log.StdOutLogger{}, context.Background(), &storage.AggregateParams{Collection: "events", Pipeline: pipeline})
+	require.Nil(t, err)
+	var groups []map[string]interface{}
+	require.Nil(t, decoder.Decode(&groups))
+	require.Equal(t, []map[string]interface{}{{"_id": "outdoor", "count": float64(2)}}, groups)
+
+	mm = &mocks.MockDBManager{FilterChecks: []interface{}{pipeline}}
+	_, err = mm.Aggregate(log.StdOutLogger{}, context.Background(), &storage.AggregateParams{Collection: "events", Pipeline: []bson.M{}})
+	require.NotNil(t, err, "pipeline check should fail")
+}
+
+func TestMockCountDistinctExists(t *testing.T) {
+	filter := bson.M{"eventId": "EVT_1"}
+	mm := &mocks.MockDBManager{
+		Responses:    []interface{}{int64(3), []string{"going", "maybe"}, true},
+		FilterChecks: []interface{}{filter, filter, filter},
+	}
+	l, cc := log.StdOutLogger{}, context.Background()
+	n, err := mm.CountDocuments(l, cc, &storage.CountParams{Collection: "rsvps", Filter: filter})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	values, err := mm.Distinct(l, cc, &storage.DistinctParams{Collection: "rsvps", FieldName: "status", Filter: filter})
+	require.Nil(t, err)
+	require.Equal(t, []interface{}{"going", "maybe"}, values)
+
+	exists, err := mm.Exists(l, cc, &storage.ExistsParams{Collection: "rsvps", Filter: filter})
+	require.Nil(t, err)
+	require.True(t, exists)
+	require.Equal(t, 3, mm.CallCount)
+
+	mm = &mocks.MockDBManager{Responses: []interface{}{"three"}}
+	_, err = mm.CountDocuments(l, cc, &storage.CountParams{Collection: "rsvps", Filter: filter})
+	require.NotNil(t, err, "a non int64 response is rejected")
+}
+
+func TestMockFindOneAnd(t *testing.T) {
+	filter := bson.M{"claimed": false}
+	mm := &mocks.MockDBManager{
+		Responses:    []interface{}{map[string]interface{}{"_id": "JOB_1"}, nil},
+		Errors:       []interface{}{nil, storage.NotFoundError{}},
+		FilterChecks: []interface{}{filter, filter},
+	}
+	l, cc := log.StdOutLogger{}, context.Background()
+	decoder, err := mm.FindOneAndUpdate(l, cc, bson.M{"claimed": true}, &storage.FindOneAndUpdateParams{Collection: "jobs", Filter: filter, Generic: true})
+	require.Nil(t, err)
+	var job map[string]interface{}
+	require.Nil(t, decoder.Decode(&job))
+	require.Equal(t, "JOB_1", job["_id"])
+
+	_, err = mm.FindOneAndDelete(l, cc, &storage.FindOneAndDeleteParams{Collection: "jobs", Filter: filter})
+	require.True(t, storage.IsNotFoundErr(err), "scripted not found")
+
+	_, err = mm.FindOneAndReplace(l, cc, bson.M{}, &storage.FindOneAndReplaceParams{Collection: "jobs", Filter: bson.M{}})
+	require.NotNil(t, err, "nothing left to return")
+}
+
+func TestMockUpsertWithResult(t *testing.T) {
+	filter := bson.M{"_id": "EVT_1"}
+	mm := &mocks.MockDBManager{
+		Responses: []interface{}{
+			&storage.UpsertResult{UpsertedCount: 1, UpsertedID: "EVT_1"},
+			storage.UpsertResult{MatchedCount: 1},
+			int64(1),
+			"one",
+		},
+	}
+	l, cc := log.StdOutLogger{}, context.Background()
+	params := &storage.UpsertParams{Collection: "events", Filter: filter, Generic: true}
+	res, err := mm.UpsertWithResult(l, cc, bson.M{"name": "bbq"}, params)
+	require.Nil(t, err)
+	require.Equal(t, "EVT_1", res.UpsertedID)
+
+	res, err = mm.UpsertWithResult(l, cc, bson.M{"name": "bbq"}, params)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.MatchedCount)
+
+	res, err = mm.UpsertWithResult(l, cc, bson.M{"name": "bbq"}, params)
+	require.Nil(t, err)
+	require.Equal(t, &storage.UpsertResult{MatchedCount: 1, ModifiedCount: 1}, res, "an int64 is both matched and modified")
+
+	_, err = mm.UpsertWithResult(l, cc, bson.M{"name": "bbq"}, params)
+	require.NotNil(t, err, "other responses are rejected")
+}
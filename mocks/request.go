@@ -89,6 +89,10 @@ func (m *requestMock) Do(req *http.Request) (*http.Response, error) {
 		err = m.validators[currAttempt].validate(req)
 	}
 	m.callCount++
+	if resp != nil && resp.Request == nil {
+		// like net/http, point the response at the request it answers
+		resp.Request = req
+	}
 	return resp, err
 }
 
@@ -0,0 +1,149 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxResponseSize is the response size limit used by DefaultR
+const DefaultMaxResponseSize int64 = 10 << 20
+
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// SetMaxResponseSize caps how many (decompressed) bytes are read from a
+// response body. Larger responses fail with a ResponseTooLargeError. Zero
+// disables the limit
+func (r *request) SetMaxResponseSize(n int64) *request {
+	r.maxResponseSize = n
+	return r
+}
+
+// SetDecompression controls whether Accept-Encoding is negotiated and
+// gzip/deflate responses are transparently decompressed
+func (r *request) SetDecompression(enabled bool) *request {
+	r.decompress = enabled
+	return r
+}
+
+// SetBodyCompression compresses request bodies with the given encoding
+// (EncodingGzip or EncodingDeflate). Only use it against upstreams that are
+// known to accept compressed bodies
+func (r *request) SetBodyCompression(encoding string) *request {
+	r.bodyEncoding = encoding
+	return r
+}
+
+// prepareAttempt negotiates encodings for a single attempt. It has to run
+// every attempt since retries refill the request body
+func (r *request) prepareAttempt(req *http.Request) error {
+	if r.decompress && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", EncodingGzip+", "+EncodingDeflate)
+	}
+	if r.bodyEncoding == "" || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	body, err := drainBody(req)
+	if err != nil {
+		return err
+	}
+	compressed, err := compress(body, r.bodyEncoding)
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+	req.ContentLength = int64(len(compressed))
+	req.Header.Set("Content-Encoding", r.bodyEncoding)
+	return nil
+}
+
+func compress(body []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case EncodingGzip:
+		w = gzip.NewWriter(&buf)
+	case EncodingDeflate:
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported body encoding: %v", encoding)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readBody reads the whole response body, decompressing it if needed and
+// enforcing the max response size on the decompressed bytes so that a small
+// compressed payload can't blow up in memory
+func (r *request) readBody(resp *http.Response) ([]byte, error) {
+	var reader io.Reader = resp.Body
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	decoded := false
+	if r.decompress && (encoding == EncodingGzip || encoding == EncodingDeflate) {
+		dr, err := decompressor(resp.Body, encoding)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress response body: %v", err)
+		}
+		defer dr.Close()
+		reader = dr
+		decoded = true
+	}
+	if r.maxResponseSize > 0 {
+		reader = io.LimitReader(reader, r.maxResponseSize+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if r.maxResponseSize > 0 && int64(len(body)) > r.maxResponseSize {
+		return nil, ResponseTooLargeError{Limit: r.maxResponseSize}
+	}
+	if decoded {
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = int64(len(body))
+		resp.Uncompressed = true
+	}
+	return body, nil
+}
+
+func decompressor(body io.Reader, encoding string) (io.ReadCloser, error) {
+	if encoding == EncodingGzip {
+		return gzip.NewReader(body)
+	}
+	// "deflate" is supposed to be zlib wrapped but plenty of servers send a
+	// raw deflate stream, so sniff the zlib header first
+	br := bufio.NewReader(body)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+func (e ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response body exceeds the maximum size of %v bytes", e.Limit)
+}
+
+func (e ResponseTooLargeError) Code() int {
+	return http.StatusBadGateway
+}
@@ -0,0 +1,86 @@
+package request_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/request"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseTooLarge(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			jsonResponse(`{"hello": "`+strings.Repeat("x", 64)+`"}`, nil),
+		},
+	})
+	var res map[string]interface{}
+	_, err := request.DefaultR(httpClient).SetResult(&res).SetMaxResponseSize(32).Get("mockURL/v1/path")
+	require.Equal(t, request.ResponseTooLargeError{Limit: 32}, err, "err check")
+}
+
+func TestGzipResponseIsDecompressed(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"hello": "test"}`))
+	zw.Close()
+	httpClient := &captureClient{}
+	client := &fixedClient{capture: httpClient, resp: &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:       ioutil.NopCloser(&buf),
+	}}
+	var res map[string]interface{}
+	resp, err := request.DefaultR(client).SetResult(&res).Get("mockURL/v1/path")
+	require.Nil(t, err, "no error on get expected")
+	require.Equal(t, map[string]interface{}{"hello": "test"}, res, "expected output to be equal")
+	require.Equal(t, "", resp.Response().Header.Get("Content-Encoding"), "encoding header should be dropped once decoded")
+	require.Equal(t, "gzip, deflate", httpClient.reqs[0].Header.Get("Accept-Encoding"), "accept encoding should be negotiated")
+}
+
+func TestRawDeflateResponseIsDecompressed(t *testing.T) {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write([]byte(`{"hello": "deflate"}`))
+	fw.Close()
+	client := &fixedClient{capture: &captureClient{}, resp: &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Encoding": []string{"deflate"}},
+		Body:       ioutil.NopCloser(&buf),
+	}}
+	var res map[string]interface{}
+	_, err := request.DefaultR(client).SetResult(&res).Get("mockURL/v1/path")
+	require.Nil(t, err, "no error on get expected")
+	require.Equal(t, map[string]interface{}{"hello": "deflate"}, res, "expected output to be equal")
+}
+
+func TestBodyCompression(t *testing.T) {
+	capture := &captureClient{}
+	var res interface{}
+	_, err := request.DefaultR(capture).SetResult(&res).SetBody(map[string]string{"test": "body"}).SetBodyCompression(request.EncodingGzip).Post("mockURL/v1/path")
+	require.Nil(t, err, "no error on post expected")
+
+	req := capture.reqs[0]
+	require.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+	zr, err := gzip.NewReader(req.Body)
+	require.Nil(t, err, "body should be gzipped")
+	body, _ := ioutil.ReadAll(zr)
+	require.Equal(t, "{\"test\":\"body\"}\n", string(body))
+}
+
+// fixedClient returns resp while recording requests in capture
+type fixedClient struct {
+	capture *captureClient
+	resp    *http.Response
+}
+
+func (c *fixedClient) Do(req *http.Request) (*http.Response, error) {
+	c.capture.Do(req)
+	return c.resp, nil
+}
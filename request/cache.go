@@ -0,0 +1,180 @@
+package request
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kickback-app/common/utils/lru"
+)
+
+// CachedResponse is what a CacheStore keeps for every cached url
+type CachedResponse struct {
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	ETag         string
+	LastModified string
+	ExpiresAt    time.Time
+}
+
+// CacheStore is the pluggable backend of the caching client
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+}
+
+type memoryCacheStore struct {
+	cache *lru.Cache[string, *CachedResponse]
+}
+
+// NewMemoryCacheStore returns an in-memory LRU CacheStore holding at most
+// maxEntries responses
+func NewMemoryCacheStore(maxEntries int) CacheStore {
+	return &memoryCacheStore{cache: lru.New[string, *CachedResponse](maxEntries)}
+}
+
+func (s *memoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	return s.cache.Get(key)
+}
+
+func (s *memoryCacheStore) Set(key string, resp *CachedResponse) {
+	s.cache.Add(key, resp)
+}
+
+func (s *memoryCacheStore) Delete(key string) {
+	s.cache.Remove(key)
+}
+
+// CacheOpts configures the caching client. TTL is how long a response is
+// served without contacting the upstream; once it elapses the response is
+// revalidated using its ETag / Last-Modified headers when it has any
+type CacheOpts struct {
+	TTL   time.Duration
+	Store CacheStore
+}
+
+const defaultCacheEntries = 1000
+
+type cachingClient struct {
+	client HTTPClient
+	ttl    time.Duration
+	store  CacheStore
+	now    func() time.Time
+}
+
+// NewCachingClient wraps an HTTPClient so that successful GET responses are
+// cached. Only GET requests are ever served from the cache
+func NewCachingClient(client HTTPClient, opts *CacheOpts) (HTTPClient, error) {
+	if opts == nil || opts.TTL <= 0 {
+		return nil, errors.New("cache ttl must be greater than zero")
+	}
+	store := opts.Store
+	if store == nil {
+		store = NewMemoryCacheStore(defaultCacheEntries)
+	}
+	return &cachingClient{
+		client: client,
+		ttl:    opts.TTL,
+		store:  store,
+		now:    time.Now,
+	}, nil
+}
+
+func (c *cachingClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return c.client.Do(req)
+	}
+	key := cacheKey(req)
+	cached, ok := c.store.Get(key)
+	if ok && c.now().Before(cached.ExpiresAt) {
+		return cached.response(req), nil
+	}
+	revalidating := ok && (cached.ETag != "" || cached.LastModified != "")
+	if revalidating {
+		// the validators go on a copy, Do reuses the caller's request on
+		// retries and must not send them once the entry is gone
+		req = req.Clone(req.Context())
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	if revalidating && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		refreshed := *cached
+		refreshed.ExpiresAt = c.now().Add(c.ttl)
+		c.store.Set(key, &refreshed)
+		return refreshed.response(req), nil
+	}
+	if resp.StatusCode != http.StatusOK || !cacheable(resp) {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.store.Set(key, &CachedResponse{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ExpiresAt:    c.now().Add(c.ttl),
+	})
+	return resp, nil
+}
+
+func (cr *CachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		StatusCode:    cr.StatusCode,
+		Status:        http.StatusText(cr.StatusCode),
+		Header:        cr.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+		Request:       req,
+	}
+}
+
+// cacheable reports whether the upstream allows the response to be cached.
+// no-cache is treated like no-store since the client would otherwise serve
+// it for the whole TTL without revalidating
+func cacheable(resp *http.Response) bool {
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return false
+		}
+	}
+	return true
+}
+
+// cacheKey includes the Accept-Encoding header, since it decides how the
+// body is encoded, and a hash of the Authorization header so that responses
+// fetched with different credentials never leak into each other
+func cacheKey(req *http.Request) string {
+	key := req.Method + " " + req.URL.String()
+	if encoding := req.Header.Get("Accept-Encoding"); encoding != "" {
+		key += " " + encoding
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		key += " " + hex.EncodeToString(sum[:8])
+	}
+	return key
+}
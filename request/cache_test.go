@@ -0,0 +1,125 @@
+package request_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/request"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedGet(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"hello": "test"}`))),
+			},
+		},
+	})
+	client, err := request.NewCachingClient(httpClient, &request.CacheOpts{TTL: time.Minute})
+	require.Nil(t, err, "new caching client err should be nil")
+	for i := 0; i < 3; i++ {
+		var res map[string]interface{}
+		_, err := request.DefaultR(client).SetResult(&res).Get("mockURL/v1/path")
+		require.Nil(t, err, "no error on get expected")
+		require.Equal(t, map[string]interface{}{"hello": "test"}, res, "expected output to be equal")
+	}
+	require.Equal(t, 1, httpClient.CallCount(), "call count")
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{
+				StatusCode: 200,
+				Header:     http.Header{"Etag": []string{`"v1"`}},
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"hello": "test"}`))),
+			},
+			{
+				StatusCode: 304,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(``))),
+			},
+		},
+	})
+	client, _ := request.NewCachingClient(httpClient, &request.CacheOpts{TTL: time.Nanosecond})
+	_, err := request.DefaultR(client).SetResult(&map[string]interface{}{}).Get("mockURL/v1/path")
+	require.Nil(t, err, "no error on get expected")
+	time.Sleep(time.Millisecond)
+
+	var res map[string]interface{}
+	resp, err := request.DefaultR(client).SetResult(&res).Get("mockURL/v1/path")
+	require.Nil(t, err, "no error on get expected")
+	require.Equal(t, 200, resp.StatusCode(), "a 304 should be served as the cached 200")
+	require.Equal(t, 2, httpClient.CallCount(), "call count")
+	require.Equal(t, map[string]interface{}{"hello": "test"}, res, "expected output to be equal")
+}
+
+func TestCacheValidatorsStayOffCallerRequest(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{
+				StatusCode: 200,
+				Header:     http.Header{"Etag": []string{`"v1"`}},
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"hello": "test"}`))),
+			},
+			{
+				StatusCode: 304,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(``))),
+			},
+		},
+	})
+	client, _ := request.NewCachingClient(httpClient, &request.CacheOpts{TTL: time.Nanosecond})
+	req, _ := http.NewRequest(http.MethodGet, "http://mock/v1/path", nil)
+	_, err := client.Do(req)
+	require.Nil(t, err, "no error on get expected")
+	time.Sleep(time.Millisecond)
+	_, err = client.Do(req)
+	require.Nil(t, err, "no error on get expected")
+	require.Empty(t, req.Header.Get("If-None-Match"), "validators should not leak into the caller's request")
+}
+
+func TestCacheSkipsUncacheable(t *testing.T) {
+	for _, directive := range []string{"no-store", "no-cache", "private, max-age=60"} {
+		httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+			Responses: []*http.Response{
+				{
+					StatusCode: 200,
+					Header:     http.Header{"Cache-Control": []string{directive}},
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{}`))),
+				},
+				{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{}`))),
+				},
+			},
+		})
+		client, _ := request.NewCachingClient(httpClient, &request.CacheOpts{TTL: time.Minute})
+		for i := 0; i < 2; i++ {
+			_, err := request.DefaultR(client).SetResult(&map[string]interface{}{}).Get("mockURL/v1/path")
+			require.Nil(t, err, "no error on get expected")
+		}
+		require.Equal(t, 2, httpClient.CallCount(), directive+" should not be cached")
+	}
+}
+
+func TestCacheKeyedByAcceptEncoding(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{}`)))},
+			{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{}`)))},
+		},
+	})
+	client, _ := request.NewCachingClient(httpClient, &request.CacheOpts{TTL: time.Minute})
+	for _, encoding := range []string{"gzip", "identity"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://mock/v1/path", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		_, err := client.Do(req)
+		require.Nil(t, err, "no error on get expected")
+	}
+	require.Equal(t, 2, httpClient.CallCount(), "each encoding should be cached separately")
+}
@@ -0,0 +1,193 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/kickback-app/common/log"
+)
+
+const (
+	defaultDebugBodyLimit = 4096
+	redacted              = "<redacted>"
+)
+
+// sensitiveHeaders never make it into debug logs or curl commands
+var sensitiveHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"Set-Cookie":           true,
+	"X-Api-Key":            true,
+	DefaultSignatureHeader: true,
+}
+
+// SetDebug turns on debug mode: every attempt is dumped to l with sensitive
+// headers redacted, and failed calls additionally log a curl command that
+// reproduces them
+func (r *request) SetDebug(l log.Logger) *request {
+	r.debugLogger = l
+	if r.debugBodyLimit == 0 {
+		r.debugBodyLimit = defaultDebugBodyLimit
+	}
+	return r
+}
+
+// SetDebugBodyLimit sets how many bytes of each body are logged in debug mode
+func (r *request) SetDebugBodyLimit(n int) *request {
+	r.debugBodyLimit = n
+	return r
+}
+
+// debugRequestBody snapshots the outgoing body before the client consumes it
+func (r *request) debugRequestBody(req *http.Request) []byte {
+	if r.debugLogger == nil {
+		return nil
+	}
+	body, _ := drainBody(req)
+	return body
+}
+
+func (r *request) debugAttempt(req *http.Request, reqBody []byte, resp *http.Response, err error) {
+	l := r.debugLogger
+	if l == nil {
+		return
+	}
+	l.Debug("--> %s %s (attempt %d)\n%s\n%s", req.Method, req.URL, r.currAttempt+1, dumpHeaders(req.Header), truncate(reqBody, r.debugBodyLimit))
+	if err != nil || resp == nil {
+		l.Debug("<-- %s %s failed: %v", req.Method, req.URL, err)
+		l.Error("request failed, reproduce with: %s", r.debugCurl(req, reqBody))
+		return
+	}
+	respBody := ""
+	if resp.Body != nil {
+		respBody = r.debugResponseBody(resp)
+	}
+	l.Debug("<-- %d %s %s\n%s\n%s", resp.StatusCode, req.Method, req.URL, dumpHeaders(resp.Header), respBody)
+	if resp.StatusCode > 399 {
+		l.Error("request failed with status %d, reproduce with: %s", resp.StatusCode, r.debugCurl(req, reqBody))
+	}
+}
+
+// debugCurl is CurlCommand with the body cut down to the debug body limit,
+// like in the dump, since it is logged at error level
+func (r *request) debugCurl(req *http.Request, body []byte) string {
+	return CurlCommand(req, []byte(truncate(body, r.debugBodyLimit)))
+}
+
+// debugResponseBody renders the start of the response body, decompressed
+// the same way readBody will decompress it
+func (r *request) debugResponseBody(resp *http.Response) string {
+	raw := peekBody(resp, r.debugBodyLimit)
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if !r.decompress || (encoding != EncodingGzip && encoding != EncodingDeflate) {
+		return truncateBody(raw, r.debugBodyLimit, resp.ContentLength)
+	}
+	dr, err := decompressor(bytes.NewReader(raw), encoding)
+	if err != nil {
+		return fmt.Sprintf("<%s body that can't be decompressed: %v>", encoding, err)
+	}
+	defer dr.Close()
+	// raw may stop in the middle of the stream, so the unexpected EOF that
+	// comes with the last bytes is expected
+	decoded, _ := ioutil.ReadAll(limitReader(dr, r.debugBodyLimit))
+	if r.debugBodyLimit > 0 && len(raw) > r.debugBodyLimit && len(decoded) <= r.debugBodyLimit {
+		return fmt.Sprintf("%s... (remaining bytes truncated)", decoded)
+	}
+	return truncateBody(decoded, r.debugBodyLimit, -1)
+}
+
+// peekBody reads at most limit+1 bytes of the response body and puts them
+// back in front of the rest of it, so that debugging never buffers a body
+// past the size limits Do enforces
+func peekBody(resp *http.Response, limit int) []byte {
+	peeked, _ := ioutil.ReadAll(limitReader(resp.Body, limit))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), resp.Body), resp.Body}
+	return peeked
+}
+
+// limitReader reads one byte past limit so that truncation can be detected.
+// A limit of zero or less reads everything
+func limitReader(r io.Reader, limit int) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return io.LimitReader(r, int64(limit)+1)
+}
+
+// CurlCommand renders req as a copy-pasteable curl invocation. body is passed
+// separately since the request body has usually been consumed by the time
+// anyone wants the command. Sensitive headers are redacted
+func CurlCommand(req *http.Request, body []byte) string {
+	parts := []string{"curl", "-X", req.Method}
+	for _, k := range sortedHeaderKeys(req.Header) {
+		// body is the uncompressed payload so the encoding header would lie,
+		// and --compressed makes curl negotiate and decode on its own
+		if k == "Content-Encoding" || k == "Accept-Encoding" {
+			continue
+		}
+		for _, v := range req.Header[k] {
+			if sensitiveHeaders[k] {
+				v = redacted
+			}
+			parts = append(parts, "-H", shellQuote(k+": "+v))
+		}
+	}
+	if len(body) > 0 {
+		parts = append(parts, "--data-raw", shellQuote(string(body)))
+	}
+	if req.Header.Get("Accept-Encoding") != "" {
+		parts = append(parts, "--compressed")
+	}
+	parts = append(parts, shellQuote(req.URL.String()))
+	return strings.Join(parts, " ")
+}
+
+func dumpHeaders(h http.Header) string {
+	lines := []string{}
+	for _, k := range sortedHeaderKeys(h) {
+		v := strings.Join(h[k], ", ")
+		if sensitiveHeaders[k] {
+			v = redacted
+		}
+		lines = append(lines, k+": "+v)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortedHeaderKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, http.CanonicalHeaderKey(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func truncate(body []byte, limit int) string {
+	return truncateBody(body, limit, int64(len(body)))
+}
+
+// truncateBody cuts body down to limit bytes. total is the full size of the
+// body it was read from, or -1 when unknown
+func truncateBody(body []byte, limit int, total int64) string {
+	if limit <= 0 || len(body) <= limit {
+		return string(body)
+	}
+	if total > int64(limit) {
+		return fmt.Sprintf("%s... (%d bytes truncated)", body[:limit], total-int64(limit))
+	}
+	return fmt.Sprintf("%s... (remaining bytes truncated)", body[:limit])
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,105 @@
+package request_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/request"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingLogger struct {
+	debug []string
+	error []string
+}
+
+func (l *recordingLogger) Debug(s string, a ...interface{}) {
+	l.debug = append(l.debug, fmt.Sprintf(s, a...))
+}
+func (l *recordingLogger) Info(s string, a ...interface{}) {}
+func (l *recordingLogger) Warn(s string, a ...interface{}) {}
+func (l *recordingLogger) Error(s string, a ...interface{}) {
+	l.error = append(l.error, fmt.Sprintf(s, a...))
+}
+
+func TestDebugFailedPost(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{
+				StatusCode: 400,
+				Header:     http.Header{"Set-Cookie": []string{"session=secret"}},
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "` + strings.Repeat("x", 100) + `"}`))),
+			},
+		},
+	})
+	l := &recordingLogger{}
+	var res, reason map[string]interface{}
+	r := request.DefaultR(httpClient).SetResult(&res).SetReason(&reason).SetBody(map[string]string{"it's": "me"}).SetDebug(l).SetDebugBodyLimit(20)
+	r.SetHeader("Authorization", "Bearer token")
+	resp, err := r.Post("https://firebase.example.com/v1/links")
+	require.Nil(t, err, "should be no request err, only IsError")
+	require.True(t, resp.IsError(), "expected isError to be true")
+	require.Equal(t, map[string]interface{}{"error": strings.Repeat("x", 100)}, reason, "body should still be readable after the dump")
+
+	dump := strings.Join(l.debug, "\n")
+	require.NotContains(t, dump, "Bearer token")
+	require.NotContains(t, dump, "session=secret")
+	require.Contains(t, dump, "bytes truncated")
+
+	require.Equal(t, 1, len(l.error), "one failure should be logged")
+	require.Contains(t, l.error[0], `curl -X POST -H 'Authorization: <redacted>' -H 'Content-Type: application/json' --data-raw '{"it'\''s":"me"}`)
+	require.Contains(t, l.error[0], `'https://firebase.example.com/v1/links'`)
+}
+
+func TestDebugCurlTruncatesBody(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{StatusCode: 422, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{}`)))},
+		},
+	})
+	l := &recordingLogger{}
+	secret := strings.Repeat("s", 100)
+	var res map[string]interface{}
+	r := request.DefaultR(httpClient).SetResult(&res).SetBody(map[string]string{"card": secret}).SetDebug(l).SetDebugBodyLimit(20)
+	r.SetHeader("X-Api-Key", "key")
+	_, err := r.Post("https://api.example.com/v1/charges")
+	require.Nil(t, err, "should be no request err, only IsError")
+
+	require.Equal(t, 1, len(l.error), "one failure should be logged")
+	require.NotContains(t, l.error[0], secret)
+	require.NotContains(t, l.error[0], "X-Api-Key: key")
+	require.Contains(t, l.error[0], "bytes truncated")
+}
+
+func TestDebugDumpsDecompressedBody(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"hello": "` + strings.Repeat("compressed ", 50) + `"}`))
+	zw.Close()
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+				Body:       ioutil.NopCloser(&buf),
+			},
+		},
+	})
+	l := &recordingLogger{}
+	var res map[string]interface{}
+	_, err := request.DefaultR(httpClient).SetResult(&res).SetDebug(l).SetDebugBodyLimit(30).Get("https://api.example.com/v1/hello")
+	require.Nil(t, err, "no error on get expected")
+	require.Equal(t, strings.Repeat("compressed ", 50), res["hello"], "body should still decode after the dump")
+
+	dump := strings.Join(l.debug, "\n")
+	require.NotContains(t, dump, "\x1f\x8b", "gzip bytes should not be dumped")
+	require.Contains(t, dump, `{"hello": "compress`)
+	require.Equal(t, 0, len(l.error), "nothing failed")
+	require.Contains(t, dump, "(remaining bytes truncated)")
+}
@@ -0,0 +1,252 @@
+package request
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindowSize  = 128
+	minLatencySamples  = 20
+	defaultPercentile  = 0.95
+	defaultHedgeDelay  = 100 * time.Millisecond
+	defaultMinHedgeGap = 5 * time.Millisecond
+)
+
+// HedgeOpts configures hedged requests. A second attempt is started once the
+// first one has been running for longer than the given percentile of recent
+// latencies to the same host. Until enough latencies have been observed
+// DefaultDelay is used instead. MinDelay puts a floor under the computed
+// delay so that a very fast upstream doesn't get every call doubled
+type HedgeOpts struct {
+	Percentile   float64
+	DefaultDelay time.Duration
+	MinDelay     time.Duration
+}
+
+// SetHedging enables hedging for idempotent (GET and HEAD) requests. Other
+// methods are never hedged
+func (r *request) SetHedging(opts *HedgeOpts) *request {
+	o := HedgeOpts{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Percentile <= 0 || o.Percentile >= 1 {
+		o.Percentile = defaultPercentile
+	}
+	if o.DefaultDelay <= 0 {
+		o.DefaultDelay = defaultHedgeDelay
+	}
+	if o.MinDelay <= 0 {
+		o.MinDelay = defaultMinHedgeGap
+	}
+	r.hedge = &o
+	return r
+}
+
+// SetAttemptTimeout bounds every single attempt, including hedged ones
+func (r *request) SetAttemptTimeout(d time.Duration) *request {
+	r.attemptTimeout = d
+	return r
+}
+
+// SetTimeout bounds the whole call, retries and retry intervals included
+func (r *request) SetTimeout(d time.Duration) *request {
+	r.timeout = d
+	return r
+}
+
+// send performs a single (possibly hedged) attempt
+func (r *request) send(req *http.Request) (*http.Response, error) {
+	if r.hedge != nil && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		return r.sendHedged(req)
+	}
+	ctx, cancel := r.attemptContext(req.Context())
+	resp, err := r.client.Do(req.WithContext(ctx))
+	return releaseOnClose(resp, err, cancel)
+}
+
+func (r *request) attemptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if r.attemptTimeout > 0 {
+		return context.WithTimeout(parent, r.attemptTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+type attemptResult struct {
+	resp    *http.Response
+	err     error
+	latency time.Duration
+	cancel  context.CancelFunc
+	idx     int
+}
+
+func (ar attemptResult) good() bool {
+	return ar.err == nil && ar.resp != nil && ar.resp.StatusCode < 500
+}
+
+func (ar attemptResult) discard() {
+	if ar.resp != nil {
+		ar.resp.Body.Close()
+	}
+	ar.cancel()
+}
+
+func (r *request) sendHedged(req *http.Request) (*http.Response, error) {
+	body, err := drainBody(req)
+	if err != nil {
+		return nil, err
+	}
+	host := req.URL.Host
+	results := make(chan attemptResult, 2)
+	cancels := []context.CancelFunc{}
+	launch := func() {
+		ctx, cancel := r.attemptContext(req.Context())
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		clone := req.Clone(ctx)
+		clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+		go func() {
+			start := time.Now()
+			resp, err := r.client.Do(clone)
+			results <- attemptResult{resp: resp, err: err, latency: time.Since(start), cancel: cancel, idx: idx}
+		}()
+	}
+
+	launch()
+	launched, inflight := 1, 1
+	timer := time.NewTimer(hedgeLatencies.delay(host, r.hedge))
+	defer timer.Stop()
+	var last *attemptResult
+	for inflight > 0 {
+		select {
+		case <-timer.C:
+			if launched < 2 {
+				launch()
+				launched++
+				inflight++
+			}
+		case res := <-results:
+			inflight--
+			recordLatency(host, res)
+			if res.good() {
+				if last != nil {
+					last.discard()
+				}
+				// whatever is still in flight lost the race
+				for i, cancel := range cancels {
+					if i != res.idx {
+						cancel()
+					}
+				}
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						res := <-results
+						recordLatency(host, res)
+						res.discard()
+					}
+				}(inflight)
+				return releaseOnClose(res.resp, res.err, res.cancel)
+			}
+			if last != nil {
+				last.discard()
+			}
+			last = &res
+		}
+	}
+	return releaseOnClose(last.resp, last.err, last.cancel)
+}
+
+// recordLatency feeds every attempt that got a response, won or not, into
+// the hedge delay: only keeping the winners would bias it low. Attempts
+// cancelled after losing the race never completed so they are left out
+func recordLatency(host string, res attemptResult) {
+	if res.err == nil && res.resp != nil {
+		hedgeLatencies.record(host, res.latency)
+	}
+}
+
+// releaseOnClose ties the attempt's context to the lifetime of the response
+// body so that the body can still be read after send returns
+func releaseOnClose(resp *http.Response, err error, cancel context.CancelFunc) (*http.Response, error) {
+	if err != nil || resp == nil || resp.Body == nil {
+		cancel()
+		return resp, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// latencyTracker keeps a sliding window of recent latencies per host. It is
+// shared by every request since the builders themselves are short lived
+type latencyTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*latencyWindow
+}
+
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+var hedgeLatencies = &latencyTracker{hosts: map[string]*latencyWindow{}}
+
+func (t *latencyTracker) record(host string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.hosts[host]
+	if !ok {
+		w = &latencyWindow{}
+		t.hosts[host] = w
+	}
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+func (t *latencyTracker) delay(host string, opts *HedgeOpts) time.Duration {
+	t.mu.Lock()
+	w, ok := t.hosts[host]
+	if !ok || len(w.samples) < minLatencySamples {
+		t.mu.Unlock()
+		return opts.DefaultDelay
+	}
+	sorted := append([]time.Duration{}, w.samples...)
+	t.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	d := sorted[int(float64(len(sorted)-1)*opts.Percentile)]
+	if d < opts.MinDelay {
+		return opts.MinDelay
+	}
+	return d
+}
@@ -0,0 +1,108 @@
+package request_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/request"
+	"github.com/stretchr/testify/require"
+)
+
+// slowClient delays each call by the matching entry in delays, giving up
+// early if the request context is cancelled
+type slowClient struct {
+	mu        sync.Mutex
+	delays    []time.Duration
+	calls     int
+	cancelled int
+}
+
+func (c *slowClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	delay := c.delays[c.calls]
+	c.calls++
+	c.mu.Unlock()
+	select {
+	case <-time.After(delay):
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"delay": "` + delay.String() + `"}`))),
+		}, nil
+	case <-req.Context().Done():
+		c.mu.Lock()
+		c.cancelled++
+		c.mu.Unlock()
+		return nil, req.Context().Err()
+	}
+}
+
+func (c *slowClient) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls, c.cancelled
+}
+
+func TestHedgedGet(t *testing.T) {
+	client := &slowClient{delays: []time.Duration{time.Second, 10 * time.Millisecond}}
+	var res map[string]interface{}
+	start := time.Now()
+	_, err := request.DefaultR(client).SetResult(&res).SetHedging(&request.HedgeOpts{DefaultDelay: 20 * time.Millisecond}).Get("https://hedge.example.com/v1/path")
+	require.Nil(t, err, "no error on get expected")
+	require.Less(t, time.Since(start), 500*time.Millisecond, "the hedged attempt should have won")
+	require.Equal(t, map[string]interface{}{"delay": "10ms"}, res, "expected output to be equal")
+
+	require.Eventually(t, func() bool {
+		calls, cancelled := client.counts()
+		return calls == 2 && cancelled == 1
+	}, time.Second, 5*time.Millisecond, "the slow attempt should be cancelled")
+}
+
+func TestPostIsNeverHedged(t *testing.T) {
+	client := &slowClient{delays: []time.Duration{50 * time.Millisecond, 0}}
+	var res map[string]interface{}
+	_, err := request.DefaultR(client).SetResult(&res).SetHedging(&request.HedgeOpts{DefaultDelay: time.Millisecond}).Post("https://hedge.example.com/v1/path")
+	require.Nil(t, err, "no error on post expected")
+	calls, _ := client.counts()
+	require.Equal(t, 1, calls, "call count")
+}
+
+func TestAttemptTimeoutRetries(t *testing.T) {
+	client := &slowClient{delays: []time.Duration{time.Second, 0}}
+	var res map[string]interface{}
+	_, err := request.DefaultR(client).SetResult(&res).SetAttemptTimeout(20 * time.Millisecond).Get("https://timeout.example.com/v1/path")
+	require.Nil(t, err, "timed out attempt should be retried")
+	calls, cancelled := client.counts()
+	require.Equal(t, 2, calls, "call count")
+	require.Equal(t, 1, cancelled, "first attempt should time out")
+}
+
+func TestOverallTimeout(t *testing.T) {
+	client := &slowClient{delays: []time.Duration{time.Second, time.Second, time.Second}}
+	var res map[string]interface{}
+	start := time.Now()
+	_, err := request.DefaultR(client).SetResult(&res).SetAttemptTimeout(20 * time.Millisecond).SetTimeout(100 * time.Millisecond).Get("https://timeout.example.com/v1/path")
+	require.NotNil(t, err, "expected err")
+	require.Less(t, time.Since(start), time.Second, "overall deadline should cut the retry interval short")
+}
+
+func TestPostTimeoutIsNotRetried(t *testing.T) {
+	client := &slowClient{delays: []time.Duration{time.Second, 0}}
+	var res map[string]interface{}
+	_, err := request.DefaultR(client).SetResult(&res).SetAttemptTimeout(20 * time.Millisecond).Post("https://timeout.example.com/v1/path")
+	require.NotNil(t, err, "timed out post should fail")
+	calls, _ := client.counts()
+	require.Equal(t, 1, calls, "a post that may have gone through must not be repeated")
+}
+
+func TestIdempotentPostTimeoutRetries(t *testing.T) {
+	client := &slowClient{delays: []time.Duration{time.Second, 0}}
+	var res map[string]interface{}
+	_, err := request.DefaultR(client).SetResult(&res).SetAttemptTimeout(20 * time.Millisecond).SetIdempotent(true).Post("https://timeout.example.com/v1/path")
+	require.Nil(t, err, "timed out idempotent post should be retried")
+	calls, _ := client.counts()
+	require.Equal(t, 2, calls, "call count")
+}
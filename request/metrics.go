@@ -0,0 +1,39 @@
+package request
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kickback-app/common/metrics"
+)
+
+const (
+	RequestsTotalMetric   = "http_client_requests_total"
+	RequestDurationMetric = "http_client_request_duration_seconds"
+)
+
+// observe records a single attempt made by Do. Transport failures are
+// reported with a status class of "error"
+func (r *request) observe(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	sink := r.metrics
+	if sink == nil {
+		sink = metrics.Default
+	}
+	labels := metrics.Labels{
+		"host":         req.URL.Host,
+		"method":       req.Method,
+		"status_class": statusClass(resp, err),
+		"attempt":      strconv.Itoa(r.currAttempt + 1),
+	}
+	sink.IncCounter(RequestsTotalMetric, labels)
+	sink.ObserveHistogram(RequestDurationMetric, elapsed.Seconds(), labels)
+}
+
+func statusClass(resp *http.Response, err error) string {
+	if err != nil || resp == nil {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", resp.StatusCode/100)
+}
@@ -0,0 +1,40 @@
+package request_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kickback-app/common/metrics"
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/request"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsPerAttempt(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{
+				StatusCode: 503,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{}`))),
+			},
+			{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{}`))),
+			},
+		},
+	})
+	sink := metrics.NewPrometheus(nil)
+	var res interface{}
+	_, err := request.DefaultR(httpClient).SetResult(&res).SetMetrics(sink).Get("https://api.example.com/v1/path")
+	require.Nil(t, err, "no error on get expected")
+
+	var sb strings.Builder
+	_, _ = sink.WriteTo(&sb)
+	out := sb.String()
+	require.Contains(t, out, `http_client_requests_total{attempt="1",host="api.example.com",method="GET",status_class="5xx"} 1`)
+	require.Contains(t, out, `http_client_requests_total{attempt="2",host="api.example.com",method="GET",status_class="2xx"} 1`)
+	require.Contains(t, out, `http_client_request_duration_seconds_count{attempt="2",host="api.example.com",method="GET",status_class="2xx"} 1`)
+}
@@ -0,0 +1,162 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// PageOpts describes how to walk a paged endpoint. P is the typed body of a
+// single page and I the type of the items it contains.
+//
+// Pages are fetched with Client through DefaultR, so they get its retries and
+// response limits. NewRequest builds the request for the url of a page, e.g.
+// to add auth headers; it defaults to a plain GET. Next returns the url of
+// the following page, or "" once the last page has been fetched, and Items
+// pulls the items out of a page. A MaxItems of zero means no limit
+type PageOpts[P any, I any] struct {
+	Client     HTTPClient
+	NewRequest func(url string) (*http.Request, error)
+	URL        string
+	Next       func(page *P, resp *http.Response) (string, error)
+	Items      func(page *P) []I
+	MaxItems   int
+}
+
+// PageIterator lazily fetches pages as its items are consumed
+type PageIterator[P any, I any] struct {
+	ctx     context.Context
+	opts    *PageOpts[P, I]
+	nextURL string
+	buf     []I
+	item    I
+	seen    int
+	err     error
+}
+
+// Paginate returns an iterator over every item of a paged endpoint. Nothing
+// is fetched until Next is called
+//
+//	it := request.Paginate(ctx, &request.PageOpts[eventsPage, Event]{...})
+//	for it.Next() {
+//		e := it.Item()
+//	}
+//	if err := it.Err(); err != nil {...}
+func Paginate[P any, I any](ctx context.Context, opts *PageOpts[P, I]) *PageIterator[P, I] {
+	return &PageIterator[P, I]{
+		ctx:     ctx,
+		opts:    opts,
+		nextURL: opts.URL,
+	}
+}
+
+// Next advances to the next item, fetching a new page when the current one
+// is exhausted. It returns false when there are no more items, the max item
+// limit was reached, the context was cancelled or an error occurred
+func (it *PageIterator[P, I]) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.opts.MaxItems > 0 && it.seen >= it.opts.MaxItems {
+		return false
+	}
+	for len(it.buf) == 0 {
+		if it.nextURL == "" {
+			return false
+		}
+		if err := it.fetch(); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	it.item = it.buf[0]
+	it.buf = it.buf[1:]
+	it.seen++
+	return true
+}
+
+// Item returns the item the iterator currently points at
+func (it *PageIterator[P, I]) Item() I {
+	return it.item
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *PageIterator[P, I]) Err() error {
+	return it.err
+}
+
+func (it *PageIterator[P, I]) fetch() error {
+	if err := it.ctx.Err(); err != nil {
+		return err
+	}
+	newRequest := it.opts.NewRequest
+	if newRequest == nil {
+		newRequest = func(url string) (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, url, nil)
+		}
+	}
+	req, err := newRequest(it.nextURL)
+	if err != nil {
+		return err
+	}
+	var page P
+	resp, err := DefaultR(it.opts.Client).SetResult(&page).Do(req.WithContext(it.ctx))
+	if resp != nil && resp.StatusCode > 399 {
+		return BadStatusError{code: resp.StatusCode}
+	}
+	if err != nil {
+		return err
+	}
+	next, err := it.opts.Next(&page, resp)
+	if err != nil {
+		return err
+	}
+	if next == it.nextURL {
+		return errors.New("pagination did not advance: next page url is the current one")
+	}
+	it.nextURL = next
+	it.buf = it.opts.Items(&page)
+	return nil
+}
+
+var linkNextRegex = regexp.MustCompile(`<([^>]*)>\s*;[^,]*rel="?next"?`)
+
+// NextLink returns the rel="next" url of an RFC 8288 Link header, or ""
+// if there is none. Relative targets are resolved against the url of the
+// request that produced resp
+func NextLink(resp *http.Response) string {
+	for _, link := range resp.Header.Values("Link") {
+		m := linkNextRegex.FindStringSubmatch(link)
+		if m == nil {
+			continue
+		}
+		if resp.Request == nil || resp.Request.URL == nil {
+			return m[1]
+		}
+		next, err := resp.Request.URL.Parse(m[1])
+		if err != nil {
+			return m[1]
+		}
+		return next.String()
+	}
+	return ""
+}
+
+// WithQueryParam returns rawURL with key set to value; handy for building
+// the next page url out of a cursor token. An empty value yields ""
+// so that Next can pass a missing token straight through
+func WithQueryParam(rawURL, key, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
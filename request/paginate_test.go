@@ -0,0 +1,161 @@
+package request_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/request"
+	"github.com/stretchr/testify/require"
+)
+
+type guestsPage struct {
+	Guests []string `json:"guests"`
+	Cursor string   `json:"cursor"`
+}
+
+func jsonResponse(body string, header http.Header) *http.Response {
+	return &http.Response{
+		StatusCode: 200,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+	}
+}
+
+func TestPaginateWithCursor(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			jsonResponse(`{"guests": ["a", "b"], "cursor": "c1"}`, nil),
+			jsonResponse(`{"guests": ["c", "d"], "cursor": "c2"}`, nil),
+			jsonResponse(`{"guests": ["e"], "cursor": ""}`, nil),
+		},
+	})
+	it := request.Paginate(context.Background(), &request.PageOpts[guestsPage, string]{
+		Client: httpClient,
+		URL:    "https://api.example.com/guests",
+		Next: func(page *guestsPage, resp *http.Response) (string, error) {
+			return request.WithQueryParam("https://api.example.com/guests", "cursor", page.Cursor)
+		},
+		Items:    func(page *guestsPage) []string { return page.Guests },
+		MaxItems: 3,
+	})
+	guests := []string{}
+	for it.Next() {
+		guests = append(guests, it.Item())
+	}
+	require.Nil(t, it.Err(), "no iteration error expected")
+	require.Equal(t, []string{"a", "b", "c"}, guests)
+	require.Equal(t, 2, httpClient.CallCount(), "pages should be fetched lazily")
+}
+
+func TestPaginateWithLinkHeader(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			jsonResponse(`{"guests": ["a"]}`, http.Header{"Link": []string{`<https://api.example.com/guests?page=2>; rel="next", <https://api.example.com/guests?page=9>; rel="last"`}}),
+			jsonResponse(`{"guests": ["b"]}`, http.Header{}),
+		},
+		Validators: []mocks.RequestValidator{
+			{ExpectedURLPath: "/guests"},
+			{ExpectedURLPath: "/guests"},
+		},
+	})
+	it := request.Paginate(context.Background(), &request.PageOpts[guestsPage, string]{
+		Client: httpClient,
+		URL:    "https://api.example.com/guests",
+		Next: func(page *guestsPage, resp *http.Response) (string, error) {
+			return request.NextLink(resp), nil
+		},
+		Items: func(page *guestsPage) []string { return page.Guests },
+	})
+	guests := []string{}
+	for it.Next() {
+		guests = append(guests, it.Item())
+	}
+	require.Nil(t, it.Err(), "no iteration error expected")
+	require.Equal(t, []string{"a", "b"}, guests)
+}
+
+func TestPaginateWithRelativeLink(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			jsonResponse(`{"guests": ["a"]}`, http.Header{"Link": []string{`</v2/guests?page=2>; rel="next"`}}),
+			jsonResponse(`{"guests": ["b"]}`, http.Header{}),
+		},
+		Validators: []mocks.RequestValidator{
+			{ExpectedURLPath: "/v2/guests"},
+			{ExpectedURLPath: "/v2/guests"},
+		},
+	})
+	urls := []string{}
+	it := request.Paginate(context.Background(), &request.PageOpts[guestsPage, string]{
+		Client: httpClient,
+		URL:    "https://api.example.com/v2/guests",
+		Next: func(page *guestsPage, resp *http.Response) (string, error) {
+			next := request.NextLink(resp)
+			urls = append(urls, next)
+			return next, nil
+		},
+		Items: func(page *guestsPage) []string { return page.Guests },
+	})
+	guests := []string{}
+	for it.Next() {
+		guests = append(guests, it.Item())
+	}
+	require.Nil(t, it.Err(), "no iteration error expected")
+	require.Equal(t, []string{"a", "b"}, guests)
+	require.Equal(t, "https://api.example.com/v2/guests?page=2", urls[0], "relative links should resolve against the request url")
+}
+
+func TestPaginateWithCustomRequest(t *testing.T) {
+	capture := &captureClient{}
+	it := request.Paginate(context.Background(), &request.PageOpts[guestsPage, string]{
+		Client: capture,
+		NewRequest: func(url string) (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer token")
+			return req, nil
+		},
+		URL: "https://api.example.com/guests",
+		Next: func(page *guestsPage, resp *http.Response) (string, error) {
+			return "", nil
+		},
+		Items: func(page *guestsPage) []string { return page.Guests },
+	})
+	require.False(t, it.Next(), "empty page should end the iteration")
+	require.Nil(t, it.Err(), "no iteration error expected")
+	require.Equal(t, 1, len(capture.reqs), "call count")
+	require.Equal(t, "Bearer token", capture.reqs[0].Header.Get("Authorization"))
+}
+
+func TestPaginateFailsOnBadStatus(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{
+		Responses: []*http.Response{
+			{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{}`)))},
+		},
+	})
+	it := request.Paginate(context.Background(), &request.PageOpts[guestsPage, string]{
+		Client: httpClient,
+		URL:    "https://api.example.com/guests",
+	})
+	require.False(t, it.Next(), "failed page should stop the iteration")
+	require.Equal(t, 401, it.Err().(request.BadStatusError).Code(), "err check")
+}
+
+func TestPaginateStopsOnCancel(t *testing.T) {
+	httpClient := mocks.NewRequestMock(&mocks.NewRequestMockOpts{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it := request.Paginate(ctx, &request.PageOpts[guestsPage, string]{
+		Client: httpClient,
+		URL:    "https://api.example.com/guests",
+	})
+	require.False(t, it.Next(), "cancelled iterator should not advance")
+	require.Equal(t, context.Canceled, it.Err(), "err check")
+	require.Equal(t, 0, httpClient.CallCount(), "call count")
+}
@@ -2,14 +2,17 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/metrics"
 )
 
 // HTTPClient describes an http client
@@ -22,11 +25,22 @@ type request struct {
 	headers         map[string]string
 	numRetries      int
 	retryInterval   time.Duration
-	retryPolicy     func(*http.Response, error) bool
+	retryPolicy     func(*http.Request, *http.Response, error) bool
+	idempotent      bool
 	currAttempt     int
 	resultContainer interface{}
 	reasonContainer interface{}
 	body            interface{}
+	metrics         metrics.Metrics
+	debugLogger     log.Logger
+	debugBodyLimit  int
+	timeout         time.Duration
+	attemptTimeout  time.Duration
+	hedge           *HedgeOpts
+	ctx             context.Context
+	maxResponseSize int64
+	decompress      bool
+	bodyEncoding    string
 }
 
 type response struct {
@@ -65,7 +79,7 @@ func (r *response) StatusCode() int {
 }
 
 func (r *request) Get(url string) (*response, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(r.context(), http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -97,7 +111,7 @@ func (r *request) Post(url string) (*response, error) {
 	}
 	b := new(bytes.Buffer)
 	json.NewEncoder(b).Encode(r.body)
-	req, err := http.NewRequest(http.MethodPost, url, b)
+	req, err := http.NewRequestWithContext(r.context(), http.MethodPost, url, b)
 	if err != nil {
 		return nil, err
 	}
@@ -128,17 +142,41 @@ func R() *request {
 }
 
 func DefaultR(client HTTPClient) *request {
-	return &request{
+	r := &request{
 		client: client,
 		headers: map[string]string{
 			"Content-Type": "application/json",
 		},
-		numRetries:    2,
-		retryInterval: 2 * time.Second,
-		retryPolicy: func(resp *http.Response, err error) bool {
-			return resp.StatusCode >= 500
-		},
+		numRetries:      2,
+		retryInterval:   2 * time.Second,
+		maxResponseSize: DefaultMaxResponseSize,
+		decompress:      true,
 	}
+	r.retryPolicy = func(req *http.Request, resp *http.Response, err error) bool {
+		if err != nil {
+			// a timed out call may still have gone through, only repeat it
+			// when doing so twice is harmless
+			return isTimeout(err) && r.isIdempotent(req)
+		}
+		return resp.StatusCode >= 500
+	}
+	return r
+}
+
+// SetIdempotent marks the request as safe to repeat even though its method
+// isn't, e.g. a POST carrying an idempotency key, so that it is retried on
+// timeouts like GET and PUT are
+func (r *request) SetIdempotent(idempotent bool) *request {
+	r.idempotent = idempotent
+	return r
+}
+
+func (r *request) isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return r.idempotent
 }
 
 func (r *request) SetResult(container interface{}) *request {
@@ -156,14 +194,54 @@ func (r *request) SetBody(body interface{}) *request {
 	return r
 }
 
+// SetContext attaches ctx to the requests made by Get and Post so that the
+// caller's cancellation reaches the upstream call
+func (r *request) SetContext(ctx context.Context) *request {
+	r.ctx = ctx
+	return r
+}
+
+func (r *request) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetMetrics overrides where outbound call metrics are recorded; by default
+// they go to metrics.Default
+func (r *request) SetMetrics(m metrics.Metrics) *request {
+	r.metrics = m
+	return r
+}
+
 func (r *request) Do(req *http.Request) (*http.Response, error) {
+	if r.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), r.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
 	r.currAttempt = 0
 	for r.currAttempt < (r.numRetries + 1) {
-		resp, err := r.client.Do(req)
-		shouldRetry := r.retryPolicy(resp, err)
+		reqBody := r.debugRequestBody(req)
+		if err := r.prepareAttempt(req); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := r.send(req)
+		r.observe(req, resp, err, time.Since(start))
+		r.debugAttempt(req, reqBody, resp, err)
+		shouldRetry := r.retryPolicy(req, resp, err)
 		if shouldRetry {
+			if resp != nil {
+				resp.Body.Close()
+			}
 			r.currAttempt++
-			time.Sleep(r.retryInterval)
+			select {
+			case <-time.After(r.retryInterval):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
 			// refill request body
 			b := new(bytes.Buffer)
 			json.NewEncoder(b).Encode(r.body)
@@ -173,10 +251,15 @@ func (r *request) Do(req *http.Request) (*http.Response, error) {
 		if err != nil {
 			return nil, err
 		}
-		body, err := ioutil.ReadAll(resp.Body)
+		body, err := r.readBody(resp)
+		resp.Body.Close()
+		if _, ok := err.(ResponseTooLargeError); ok {
+			return nil, err
+		}
 		if err != nil {
 			return nil, fmt.Errorf("unable to read response body: %v", err)
 		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
 		err = json.Unmarshal(body, r.resultContainer)
 		return resp, err
 	}
@@ -0,0 +1,325 @@
+package request
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSignatureHeader = "X-Kickback-Signature"
+	DefaultTimestampHeader = "X-Kickback-Timestamp"
+	DefaultNonceHeader     = "X-Kickback-Nonce"
+
+	// DefaultMaxVerifiedBodySize is the largest body Verify reads unless
+	// VerifierOpts.MaxBodySize says otherwise
+	DefaultMaxVerifiedBodySize int64 = 1 << 20
+
+	signatureVersion = "v1"
+	defaultTolerance = 5 * time.Minute
+)
+
+// SignerOpts configures how outgoing requests are signed. Only Secret is
+// required, the header names fall back to the X-Kickback-* defaults
+type SignerOpts struct {
+	Secret          []byte
+	SignatureHeader string
+	TimestampHeader string
+	NonceHeader     string
+}
+
+type signer struct {
+	client HTTPClient
+	opts   SignerOpts
+	now    func() time.Time
+}
+
+// NewSigner wraps an HTTPClient so that every request it sends carries a
+// timestamp, a nonce and an HMAC-SHA256 signature over the three of them
+// plus the request body. Because the signature is computed per call, retries
+// from request.Do are re-signed with a fresh timestamp.
+func NewSigner(client HTTPClient, opts *SignerOpts) (HTTPClient, error) {
+	if opts == nil || len(opts.Secret) == 0 {
+		return nil, errors.New("signing secret cannot be empty")
+	}
+	o := *opts
+	o.SignatureHeader = orDefault(o.SignatureHeader, DefaultSignatureHeader)
+	o.TimestampHeader = orDefault(o.TimestampHeader, DefaultTimestampHeader)
+	o.NonceHeader = orDefault(o.NonceHeader, DefaultNonceHeader)
+	return &signer{
+		client: client,
+		opts:   o,
+		now:    time.Now,
+	}, nil
+}
+
+func (s *signer) Do(req *http.Request) (*http.Response, error) {
+	body, err := drainBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read request body for signing: %v", err)
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	req.Header.Set(s.opts.TimestampHeader, timestamp)
+	req.Header.Set(s.opts.NonceHeader, nonce)
+	req.Header.Set(s.opts.SignatureHeader, signatureVersion+"="+Sign(s.opts.Secret, timestamp, nonce, body))
+	return s.client.Do(req)
+}
+
+// Sign computes the hex encoded HMAC-SHA256 of "timestamp.nonce.body"
+func Sign(secret []byte, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReplayCache remembers nonces that have already been accepted. Add returns
+// false if the nonce was seen before and has not yet expired
+type ReplayCache interface {
+	Add(nonce string, expiresAt time.Time) bool
+}
+
+type memoryReplayCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	expiry nonceHeap
+}
+
+type expiringNonce struct {
+	nonce     string
+	expiresAt time.Time
+}
+
+// nonceHeap orders nonces by expiry so that expired ones can be dropped off
+// its top instead of scanning every nonce on each Add
+type nonceHeap []expiringNonce
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(expiringNonce)) }
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// NewMemoryReplayCache returns a process local ReplayCache. Services running
+// more than one replica should provide a shared implementation instead
+func NewMemoryReplayCache() ReplayCache {
+	return &memoryReplayCache{nonces: map[string]time.Time{}}
+}
+
+func (c *memoryReplayCache) Add(nonce string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for c.expiry.Len() > 0 && now.After(c.expiry[0].expiresAt) {
+		delete(c.nonces, heap.Pop(&c.expiry).(expiringNonce).nonce)
+	}
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = expiresAt
+	heap.Push(&c.expiry, expiringNonce{nonce: nonce, expiresAt: expiresAt})
+	return true
+}
+
+// VerifierOpts configures verification of incoming signed requests.
+// Secrets holds every currently valid secret so that keys can be rotated
+// without downtime. Tolerance is the maximum allowed clock skew between
+// sender and receiver (defaults to 5 minutes). Bodies larger than
+// MaxBodySize (defaults to DefaultMaxVerifiedBodySize) are rejected without
+// being read in full
+type VerifierOpts struct {
+	Secrets         [][]byte
+	Tolerance       time.Duration
+	MaxBodySize     int64
+	ReplayCache     ReplayCache
+	SignatureHeader string
+	TimestampHeader string
+	NonceHeader     string
+}
+
+type Verifier struct {
+	opts VerifierOpts
+	now  func() time.Time
+}
+
+func NewVerifier(opts *VerifierOpts) (*Verifier, error) {
+	if opts == nil || len(opts.Secrets) == 0 {
+		return nil, errors.New("at least one verification secret is required")
+	}
+	o := *opts
+	if o.Tolerance <= 0 {
+		o.Tolerance = defaultTolerance
+	}
+	if o.ReplayCache == nil {
+		o.ReplayCache = NewMemoryReplayCache()
+	}
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = DefaultMaxVerifiedBodySize
+	}
+	o.SignatureHeader = orDefault(o.SignatureHeader, DefaultSignatureHeader)
+	o.TimestampHeader = orDefault(o.TimestampHeader, DefaultTimestampHeader)
+	o.NonceHeader = orDefault(o.NonceHeader, DefaultNonceHeader)
+	return &Verifier{opts: o, now: time.Now}, nil
+}
+
+// Verify checks the signature headers of r against its body. The body is
+// restored so that downstream handlers can still read it
+func (v *Verifier) Verify(r *http.Request) error {
+	timestamp := r.Header.Get(v.opts.TimestampHeader)
+	nonce := r.Header.Get(v.opts.NonceHeader)
+	signature := r.Header.Get(v.opts.SignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return InvalidSignatureError{Reason: "missing signature headers"}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return InvalidSignatureError{Reason: "malformed timestamp"}
+	}
+	sentAt := time.Unix(unix, 0)
+	skew := v.now().Sub(sentAt)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > v.opts.Tolerance {
+		return InvalidSignatureError{Reason: "timestamp outside of tolerance"}
+	}
+	if !strings.HasPrefix(signature, signatureVersion+"=") {
+		return InvalidSignatureError{Reason: "unsupported signature version"}
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, signatureVersion+"="))
+	if err != nil {
+		return InvalidSignatureError{Reason: "malformed signature"}
+	}
+	body, err := drainBodyLimit(r, v.opts.MaxBodySize)
+	if err != nil {
+		return err
+	}
+	matched := false
+	for _, secret := range v.opts.Secrets {
+		want, _ := hex.DecodeString(Sign(secret, timestamp, nonce, body))
+		if hmac.Equal(got, want) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return InvalidSignatureError{Reason: "signature mismatch"}
+	}
+	// only remember nonces of authentic requests so that garbage can't fill the cache
+	if !v.opts.ReplayCache.Add(nonce, sentAt.Add(v.opts.Tolerance)) {
+		return InvalidSignatureError{Reason: "request already processed"}
+	}
+	return nil
+}
+
+// Middleware rejects any request that fails Verify, with a 413 when the
+// body is too large and a 401 otherwise
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			code := http.StatusUnauthorized
+			if tooLarge, ok := err.(RequestTooLargeError); ok {
+				code = tooLarge.Code()
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// drainBody reads the full request body and replaces it with an identical
+// reader so that the request can still be sent or handled afterwards
+func drainBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// drainBodyLimit is drainBody for bodies we don't control: it reads at most
+// limit bytes and fails with a RequestTooLargeError past that
+func drainBodyLimit(req *http.Request, limit int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read request body: %v", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, RequestTooLargeError{Limit: limit}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func orDefault(val, def string) string {
+	if val == "" {
+		return def
+	}
+	return val
+}
+
+type InvalidSignatureError struct {
+	Reason string
+}
+
+func (e InvalidSignatureError) Error() string {
+	return "invalid request signature: " + e.Reason
+}
+
+func (e InvalidSignatureError) Code() int {
+	return http.StatusUnauthorized
+}
+
+type RequestTooLargeError struct {
+	Limit int64
+}
+
+func (e RequestTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds the maximum size of %v bytes", e.Limit)
+}
+
+func (e RequestTooLargeError) Code() int {
+	return http.StatusRequestEntityTooLarge
+}
@@ -0,0 +1,119 @@
+package request_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/request"
+	"github.com/stretchr/testify/require"
+)
+
+type captureClient struct {
+	reqs []*http.Request
+}
+
+func (c *captureClient) Do(req *http.Request) (*http.Response, error) {
+	c.reqs = append(c.reqs, req)
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{}`))),
+	}, nil
+}
+
+func signedRequest(t *testing.T, secret []byte, body string) *http.Request {
+	capture := &captureClient{}
+	signer, err := request.NewSigner(capture, &request.SignerOpts{Secret: secret})
+	require.Nil(t, err, "new signer err should be nil")
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader([]byte(body)))
+	_, err = signer.Do(req)
+	require.Nil(t, err, "signer do err should be nil")
+	require.Equal(t, 1, len(capture.reqs), "call count")
+	return capture.reqs[0]
+}
+
+func TestSignerRequiresSecret(t *testing.T) {
+	_, err := request.NewSigner(&captureClient{}, &request.SignerOpts{})
+	require.NotNil(t, err, "there should be an err if no secret")
+}
+
+func TestSignAndVerify(t *testing.T) {
+	secret := []byte("shh")
+	req := signedRequest(t, secret, `{"hello": "world"}`)
+	body, _ := ioutil.ReadAll(req.Body)
+	require.Equal(t, `{"hello": "world"}`, string(body), "body should be left intact after signing")
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	verifier, err := request.NewVerifier(&request.VerifierOpts{Secrets: [][]byte{[]byte("old"), secret}})
+	require.Nil(t, err, "new verifier err should be nil")
+	require.Nil(t, verifier.Verify(req), "signature should verify")
+}
+
+func TestVerifyRejectsTamperedBody(t *testing.T) {
+	secret := []byte("shh")
+	req := signedRequest(t, secret, `{"amount": 1}`)
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"amount": 1000}`)))
+
+	verifier, _ := request.NewVerifier(&request.VerifierOpts{Secrets: [][]byte{secret}})
+	err := verifier.Verify(req)
+	require.IsType(t, request.InvalidSignatureError{}, err, "expected error type")
+}
+
+func TestVerifyRejectsStaleTimestamp(t *testing.T) {
+	secret := []byte("shh")
+	timestamp := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader([]byte(`{}`)))
+	req.Header.Set(request.DefaultTimestampHeader, timestamp)
+	req.Header.Set(request.DefaultNonceHeader, "nonce")
+	req.Header.Set(request.DefaultSignatureHeader, "v1="+request.Sign(secret, timestamp, "nonce", []byte(`{}`)))
+
+	verifier, _ := request.NewVerifier(&request.VerifierOpts{Secrets: [][]byte{secret}})
+	err := verifier.Verify(req)
+	require.Equal(t, request.InvalidSignatureError{Reason: "timestamp outside of tolerance"}, err, "err check")
+}
+
+func TestMiddlewareRejectsReplay(t *testing.T) {
+	secret := []byte("shh")
+	req := signedRequest(t, secret, `{}`)
+	body, _ := ioutil.ReadAll(req.Body)
+
+	verifier, _ := request.NewVerifier(&request.VerifierOpts{Secrets: [][]byte{secret}})
+	handled := 0
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	}))
+
+	for i := 0; i < 2; i++ {
+		replay := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		replay.Header = req.Header.Clone()
+		handler.ServeHTTP(httptest.NewRecorder(), replay)
+	}
+	require.Equal(t, 1, handled, "replayed request should not reach the handler")
+}
+
+func TestVerifyRejectsOversizedBody(t *testing.T) {
+	secret := []byte("shh")
+	req := signedRequest(t, secret, `{"padding": "0123456789"}`)
+
+	verifier, _ := request.NewVerifier(&request.VerifierOpts{Secrets: [][]byte{secret}, MaxBodySize: 8})
+	rec := httptest.NewRecorder()
+	verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("oversized request should not reach the handler")
+	})).ServeHTTP(rec, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "status code")
+}
+
+func TestMemoryReplayCacheExpiry(t *testing.T) {
+	cache := request.NewMemoryReplayCache()
+	now := time.Now()
+	require.True(t, cache.Add("a", now.Add(time.Hour)))
+	require.True(t, cache.Add("b", now.Add(-time.Second)))
+	require.True(t, cache.Add("c", now.Add(time.Minute)))
+	require.False(t, cache.Add("a", now.Add(time.Hour)), "a live nonce should be rejected")
+	require.True(t, cache.Add("b", now.Add(time.Hour)), "an expired nonce should be dropped")
+	require.False(t, cache.Add("b", now.Add(time.Hour)), "a nonce added again should be remembered")
+}
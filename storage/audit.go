@@ -0,0 +1,675 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const DefaultAuditCollection = "audit_log"
+
+const (
+	AuditInsert  = "insert"
+	AuditUpdate  = "update"
+	AuditReplace = "replace"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditBulk    = "bulk"
+)
+
+type actorKey struct{}
+
+// WithActor attaches the id of whoever is making the calls (a user, a
+// service...) to ctx so that audited writes can be attributed to them
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set with WithActor, if any
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// AuditParams configures an audited Manager. Collection is where entries
+// are written (defaults to "audit_log"). Only writes to Collections are
+// audited; leave it empty to audit every collection
+type AuditParams struct {
+	Collection  string
+	Collections []string
+}
+
+// FieldChange holds the value of a top level field before and after a write
+type FieldChange struct {
+	Before interface{} `bson:"before,omitempty"`
+	After  interface{} `bson:"after,omitempty"`
+}
+
+// AuditEntry describes what a single write did to a single document. Bulk
+// and Multiple writes are recorded per document without Changes
+type AuditEntry struct {
+	ID         string                 `bson:"_id"`
+	Actor      string                 `bson:"actor"`
+	Operation  string                 `bson:"operation"`
+	Collection string                 `bson:"collection"`
+	DocumentID interface{}            `bson:"documentId,omitempty"`
+	Filter     string                 `bson:"filter,omitempty"`
+	Changes    map[string]FieldChange `bson:"changes,omitempty"`
+	At         time.Time              `bson:"at"`
+}
+
+type auditedManager struct {
+	Manager
+	collection  string
+	collections map[string]bool
+	inTx        bool
+}
+
+// NewAuditedManager wraps m so that every write records who changed what in
+// the audit collection. Before images are read right before the write, and
+// single document writes are narrowed down to the _id read, so they are only
+// guaranteed to be exact inside WithTransaction. Multiple writes only read
+// the _ids they are about to touch, not whole documents.
+//
+// Inside WithTransaction the audit entries are written as part of the
+// transaction and any failure to audit, be it reading the before image or
+// recording the entries, aborts it. Outside of a transaction such failures
+// are logged and never fail the write: it goes ahead unaudited and its
+// result is returned as is. PurgeDeleted is not audited
+func NewAuditedManager(m Manager, params *AuditParams) Manager {
+	a := &auditedManager{Manager: m, collection: DefaultAuditCollection}
+	if params == nil {
+		return a
+	}
+	if params.Collection != "" {
+		a.collection = params.Collection
+	}
+	if len(params.Collections) > 0 {
+		a.collections = map[string]bool{}
+		for _, c := range params.Collections {
+			a.collections[c] = true
+		}
+	}
+	return a
+}
+
+func (a *auditedManager) audited(collection string) bool {
+	return collection != a.collection && (a.collections == nil || a.collections[collection])
+}
+
+func (a *auditedManager) WithTransaction(l log.Logger, cc context.Context, fn func(tx Manager) error) error {
+	if a.inTx {
+		return fn(a)
+	}
+	return a.Manager.WithTransaction(l, cc, func(tx Manager) error {
+		return fn(&auditedManager{Manager: tx, collection: a.collection, collections: a.collections, inTx: true})
+	})
+}
+
+func (a *auditedManager) InsertOne(l log.Logger, cc context.Context, document interface{}, params *InsertOneParams) (interface{}, error) {
+	id, err := a.Manager.InsertOne(l, cc, document, params)
+	if err != nil || !a.audited(params.Collection) {
+		return id, err
+	}
+	after, err := toDoc(document)
+	if err != nil {
+		return id, a.failed(l, err)
+	}
+	after["_id"] = id
+	return id, a.record(l, cc, AuditInsert, params.Collection, nil, nil, []bson.M{after})
+}
+
+func (a *auditedManager) InsertMany(l log.Logger, cc context.Context, data []interface{}, params *InsertManyParams) (interface{}, error) {
+	res, err := a.Manager.InsertMany(l, cc, data, params)
+	if err != nil || !a.audited(params.Collection) {
+		return res, err
+	}
+	ids, _ := res.([]interface{})
+	after := make([]bson.M, 0, len(data))
+	for i, document := range data {
+		doc, err := toDoc(document)
+		if err != nil {
+			return res, a.failed(l, err)
+		}
+		if i < len(ids) {
+			doc["_id"] = ids[i]
+		}
+		after = append(after, doc)
+	}
+	return res, a.record(l, cc, AuditInsert, params.Collection, nil, nil, after)
+}
+
+func (a *auditedManager) Upsert(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (int64, error) {
+	res, err := a.UpsertWithResult(l, cc, updates, params)
+	if res == nil {
+		return 0, err
+	}
+	return res.ModifiedCount, err
+}
+
+func (a *auditedManager) UpsertWithResult(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (*UpsertResult, error) {
+	if !a.audited(params.Collection) {
+		return a.Manager.UpsertWithResult(l, cc, updates, params)
+	}
+	before, filter, err := a.target(l, cc, params.Collection, params.Filter, params.Multiple, params.IncludeDeleted)
+	if err != nil {
+		if err := a.failed(l, err); err != nil {
+			return nil, err
+		}
+		return a.Manager.UpsertWithResult(l, cc, updates, params)
+	}
+	p := *params
+	p.Filter = filter
+	res, err := a.Manager.UpsertWithResult(l, cc, updates, &p)
+	if err != nil {
+		return res, err
+	}
+	ids := docIDs(before)
+	if res.UpsertedID != nil {
+		ids = append(ids, res.UpsertedID)
+	}
+	if params.Multiple {
+		if res.ModifiedCount+res.UpsertedCount == 0 {
+			return res, nil
+		}
+		return res, a.recordMany(l, cc, AuditUpdate, params.Collection, params.Filter, ids)
+	}
+	after, err := a.byIDs(l, cc, params.Collection, ids)
+	if err != nil {
+		return res, a.failed(l, err)
+	}
+	return res, a.record(l, cc, AuditUpdate, params.Collection, params.Filter, before, after)
+}
+
+func (a *auditedManager) Delete(l log.Logger, cc context.Context, params *DeleteParams) (int64, error) {
+	if !a.audited(params.Collection) {
+		return a.Manager.Delete(l, cc, params)
+	}
+	if params.DeletedBy == "" {
+		p := *params
+		p.DeletedBy = ActorFromContext(cc)
+		params = &p
+	}
+	// a soft delete leaves deleted documents alone, a hard one doesn't
+	before, filter, err := a.target(l, cc, params.Collection, params.Filter, params.Multiple, params.Hard)
+	if err != nil {
+		if err := a.failed(l, err); err != nil {
+			return 0, err
+		}
+		return a.Manager.Delete(l, cc, params)
+	}
+	p := *params
+	p.Filter = filter
+	n, err := a.Manager.Delete(l, cc, &p)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	if params.Multiple {
+		return n, a.recordMany(l, cc, AuditDelete, params.Collection, params.Filter, docIDs(before))
+	}
+	// soft deleted documents are still around and show up with deletedAt set
+	after, err := a.byIDs(l, cc, params.Collection, docIDs(before))
+	if err != nil {
+		return n, a.failed(l, err)
+	}
+	return n, a.record(l, cc, AuditDelete, params.Collection, params.Filter, before, after)
+}
+
+func (a *auditedManager) Restore(l log.Logger, cc context.Context, params *RestoreParams) (int64, error) {
+	if !a.audited(params.Collection) {
+		return a.Manager.Restore(l, cc, params)
+	}
+	deleted := bson.D{{Key: "$and", Value: bson.A{
+		params.Filter,
+		bson.D{{Key: DeletedAtField, Value: bson.D{{Key: "$exists", Value: true}}}},
+	}}}
+	before, filter, err := a.target(l, cc, params.Collection, deleted, params.Multiple, true)
+	if err != nil {
+		if err := a.failed(l, err); err != nil {
+			return 0, err
+		}
+		return a.Manager.Restore(l, cc, params)
+	}
+	p := *params
+	p.Filter = filter
+	n, err := a.Manager.Restore(l, cc, &p)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	if params.Multiple {
+		return n, a.recordMany(l, cc, AuditRestore, params.Collection, params.Filter, docIDs(before))
+	}
+	after, err := a.byIDs(l, cc, params.Collection, docIDs(before))
+	if err != nil {
+		return n, a.failed(l, err)
+	}
+	return n, a.record(l, cc, AuditRestore, params.Collection, params.Filter, before, after)
+}
+
+func (a *auditedManager) FindOneAndUpdate(l log.Logger, cc context.Context, updates interface{}, params *FindOneAndUpdateParams) (Decoder, error) {
+	return a.findOneAnd(l, cc, AuditUpdate, params.Collection, params.Filter, params.IncludeDeleted, params.ReturnDocument == ReturnAfter, func() (Decoder, error) {
+		return a.Manager.FindOneAndUpdate(l, cc, updates, params)
+	})
+}
+
+func (a *auditedManager) FindOneAndReplace(l log.Logger, cc context.Context, replacement interface{}, params *FindOneAndReplaceParams) (Decoder, error) {
+	return a.findOneAnd(l, cc, AuditReplace, params.Collection, params.Filter, params.IncludeDeleted, params.ReturnDocument == ReturnAfter, func() (Decoder, error) {
+		return a.Manager.FindOneAndReplace(l, cc, replacement, params)
+	})
+}
+
+func (a *auditedManager) FindOneAndDelete(l log.Logger, cc context.Context, params *FindOneAndDeleteParams) (Decoder, error) {
+	if params.DeletedBy == "" && a.audited(params.Collection) {
+		p := *params
+		p.DeletedBy = ActorFromContext(cc)
+		params = &p
+	}
+	return a.findOneAnd(l, cc, AuditDelete, params.Collection, params.Filter, params.IncludeDeleted, false, func() (Decoder, error) {
+		return a.Manager.FindOneAndDelete(l, cc, params)
+	})
+}
+
+// findOneAnd uses the document handed back by the call as the before (or
+// after) image and reads the other one. The before image read ahead of a
+// call returning the after image is dropped when the call picked another
+// document
+func (a *auditedManager) findOneAnd(l log.Logger, cc context.Context, op, collection string, filter interface{}, includeDeleted, returnsAfter bool, call func() (Decoder, error)) (Decoder, error) {
+	if !a.audited(collection) {
+		return call()
+	}
+	var pre []bson.M
+	if returnsAfter {
+		var err error
+		if pre, err = a.snapshot(l, cc, &FindManyParams{Collection: collection, Filter: filter, IncludeDeleted: includeDeleted, AdditionalOpts: []*options.FindOptions{options.Find().SetLimit(1)}}); err != nil {
+			if err := a.failed(l, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+	decoder, err := call()
+	if err != nil {
+		return decoder, err
+	}
+	var doc bson.M
+	if err := decoder.Decode(&doc); err != nil {
+		return decoder, a.failed(l, err)
+	}
+	var before, after []bson.M
+	switch {
+	case returnsAfter:
+		after = []bson.M{doc}
+		if len(pre) > 0 && fmt.Sprint(pre[0]["_id"]) == fmt.Sprint(doc["_id"]) {
+			before = pre
+		}
+	default:
+		// soft deleted documents are still around and show up with deletedAt set
+		before = []bson.M{doc}
+		if after, err = a.byIDs(l, cc, collection, []interface{}{doc["_id"]}); err != nil {
+			return decoder, a.failed(l, err)
+		}
+	}
+	return decoder, a.record(l, cc, op, collection, filter, before, after)
+}
+
+func (a *auditedManager) BulkWrite(l log.Logger, cc context.Context, models []WriteModel, params *BulkWriteParams) (*BulkWriteResult, error) {
+	if !a.audited(params.Collection) {
+		return a.Manager.BulkWrite(l, cc, models, params)
+	}
+	if params.DeletedBy == "" {
+		p := *params
+		p.DeletedBy = ActorFromContext(cc)
+		params = &p
+	}
+	pinned, ids, err := a.bulkTargets(l, cc, models, params)
+	if err != nil {
+		if err := a.failed(l, err); err != nil {
+			return nil, err
+		}
+		pinned, ids = models, make([][]interface{}, len(models))
+	}
+	res, err := a.Manager.BulkWrite(l, cc, pinned, params)
+	if res == nil {
+		return res, err
+	}
+	actor, now := ActorFromContext(cc), time.Now().UTC()
+	entries := []interface{}{}
+	for _, op := range res.Operations {
+		if op.Status != BulkOpSucceeded || op.Index >= len(models) {
+			continue
+		}
+		entry := AuditEntry{
+			Actor:      actor,
+			Operation:  AuditBulk,
+			Collection: params.Collection,
+			At:         now,
+		}
+		switch m := models[op.Index].(type) {
+		case InsertModel:
+			entry.Operation = AuditInsert
+		case UpdateModel:
+			entry.Operation, entry.Filter = AuditUpdate, filterString(m.Filter)
+		case ReplaceModel:
+			entry.Operation, entry.Filter = AuditReplace, filterString(m.Filter)
+		case DeleteModel:
+			entry.Operation, entry.Filter = AuditDelete, filterString(m.Filter)
+		}
+		docIDs := ids[op.Index]
+		if op.UpsertedID != nil {
+			docIDs = []interface{}{op.UpsertedID}
+		}
+		if len(docIDs) == 0 {
+			docIDs = []interface{}{nil}
+		}
+		for _, id := range docIDs {
+			e := entry
+			e.ID, e.DocumentID = GenerateID("AUD_", 20), id
+			entries = append(entries, e)
+		}
+	}
+	if auditErr := a.insert(l, cc, entries); auditErr != nil && err == nil {
+		err = auditErr
+	}
+	return res, err
+}
+
+// bulkTargets resolves the _ids every model is about to touch so that bulk
+// writes show up in the history of the documents. InsertModels without an
+// _id get one generated, _id equality filters are taken as they are and
+// other filters are read (and pinned) the way target does for single writes
+func (a *auditedManager) bulkTargets(l log.Logger, cc context.Context, models []WriteModel, params *BulkWriteParams) ([]WriteModel, [][]interface{}, error) {
+	pinned := append([]WriteModel{}, models...)
+	ids := make([][]interface{}, len(models))
+	for i, model := range models {
+		var filter interface{}
+		multiple, includeDeleted := false, params.IncludeDeleted
+		switch m := model.(type) {
+		case InsertModel:
+			doc, err := toDoc(m.Document)
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, ok := doc["_id"]; !ok {
+				doc["_id"] = primitive.NewObjectID()
+				pinned[i] = InsertModel{Document: doc}
+			}
+			ids[i] = []interface{}{doc["_id"]}
+			continue
+		case UpdateModel:
+			filter, multiple = m.Filter, m.Multiple
+		case ReplaceModel:
+			filter = m.Filter
+		case DeleteModel:
+			// a soft delete leaves deleted documents alone, a hard one doesn't
+			filter, multiple, includeDeleted = m.Filter, m.Multiple, m.Hard
+		default:
+			continue
+		}
+		if id, ok := idFilter(filter); ok {
+			ids[i] = []interface{}{id}
+			continue
+		}
+		docs, narrowed, err := a.target(l, cc, params.Collection, filter, multiple, includeDeleted)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids[i] = docIDs(docs)
+		pinned[i] = withFilter(model, narrowed)
+	}
+	return pinned, ids, nil
+}
+
+// idFilter returns the _id a filter matches on when it is a plain _id
+// equality
+func idFilter(filter interface{}) (interface{}, bool) {
+	f, err := toDoc(filter)
+	if err != nil || len(f) != 1 {
+		return nil, false
+	}
+	id, ok := f["_id"]
+	if !ok {
+		return nil, false
+	}
+	switch id.(type) {
+	case bson.M, bson.D:
+		return nil, false
+	}
+	return id, true
+}
+
+func withFilter(model WriteModel, filter interface{}) WriteModel {
+	switch m := model.(type) {
+	case UpdateModel:
+		m.Filter = filter
+		return m
+	case ReplaceModel:
+		m.Filter = filter
+		return m
+	case DeleteModel:
+		m.Filter = filter
+		return m
+	}
+	return model
+}
+
+// target reads what a write matching filter is about to touch. A single
+// document write gets the before image of the document and a filter pinned
+// to its _id, so that the write can't pick another one. A Multiple write
+// only gets the _ids and its filter back as is
+func (a *auditedManager) target(l log.Logger, cc context.Context, collection string, filter interface{}, multiple, includeDeleted bool) ([]bson.M, interface{}, error) {
+	params := &FindManyParams{Collection: collection, Filter: filter, IncludeDeleted: includeDeleted}
+	if multiple {
+		params.AdditionalOpts = []*options.FindOptions{options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}})}
+	} else {
+		params.AdditionalOpts = []*options.FindOptions{options.Find().SetLimit(1)}
+	}
+	docs, err := a.snapshot(l, cc, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	if multiple || len(docs) == 0 {
+		return docs, filter, nil
+	}
+	return docs, bson.D{{Key: "$and", Value: bson.A{filter, Eq("_id", docs[0]["_id"])}}}, nil
+}
+
+func (a *auditedManager) snapshot(l log.Logger, cc context.Context, params *FindManyParams) ([]bson.M, error) {
+	decoder, err := a.Manager.FindMany(l, cc, params)
+	if err != nil {
+		l.Error("unable to read before image from %v: %v", params.Collection, err)
+		return nil, err
+	}
+	var docs []bson.M
+	if err := decoder.Decode(&docs); err != nil {
+		l.Error("unable to decode before image from %v: %v", params.Collection, err)
+		return nil, err
+	}
+	return docs, nil
+}
+
+// byIDs reads the after images, soft deleted documents included
+func (a *auditedManager) byIDs(l log.Logger, cc context.Context, collection string, ids []interface{}) ([]bson.M, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return a.snapshot(l, cc, &FindManyParams{
+		Collection:     collection,
+		Filter:         bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}},
+		IncludeDeleted: true,
+	})
+}
+
+// record writes one entry per document that actually changed
+func (a *auditedManager) record(l log.Logger, cc context.Context, op, collection string, filter interface{}, before, after []bson.M) error {
+	actor, now := ActorFromContext(cc), time.Now().UTC()
+	beforeByID := map[string]bson.M{}
+	for _, doc := range before {
+		beforeByID[fmt.Sprint(doc["_id"])] = doc
+	}
+	afterByID := map[string]bson.M{}
+	for _, doc := range after {
+		afterByID[fmt.Sprint(doc["_id"])] = doc
+	}
+	entries := []interface{}{}
+	seen := map[string]bool{}
+	for _, doc := range append(append([]bson.M{}, before...), after...) {
+		key := fmt.Sprint(doc["_id"])
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		changes := diffDocs(beforeByID[key], afterByID[key])
+		if len(changes) == 0 {
+			continue
+		}
+		entries = append(entries, AuditEntry{
+			ID:         GenerateID("AUD_", 20),
+			Actor:      actor,
+			Operation:  op,
+			Collection: collection,
+			DocumentID: doc["_id"],
+			Filter:     filterString(filter),
+			Changes:    changes,
+			At:         now,
+		})
+	}
+	return a.insert(l, cc, entries)
+}
+
+// recordMany writes one entry without Changes per document a Multiple write
+// touched
+func (a *auditedManager) recordMany(l log.Logger, cc context.Context, op, collection string, filter interface{}, ids []interface{}) error {
+	actor, now := ActorFromContext(cc), time.Now().UTC()
+	entries := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, AuditEntry{
+			ID:         GenerateID("AUD_", 20),
+			Actor:      actor,
+			Operation:  op,
+			Collection: collection,
+			DocumentID: id,
+			Filter:     filterString(filter),
+			At:         now,
+		})
+	}
+	return a.insert(l, cc, entries)
+}
+
+func (a *auditedManager) insert(l log.Logger, cc context.Context, entries []interface{}) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	_, err := a.Manager.InsertMany(l, cc, entries, &InsertManyParams{Collection: a.collection})
+	if err != nil {
+		return a.failed(l, err)
+	}
+	return nil
+}
+
+// failed decides whether a failure to audit fails the write: only inside a
+// transaction, where it rolls the write back. Every audit failure goes
+// through here
+func (a *auditedManager) failed(l log.Logger, err error) error {
+	l.Error("unable to record audit entry: %v", err)
+	if a.inTx {
+		return err
+	}
+	return nil
+}
+
+func diffDocs(before, after bson.M) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	for k, v := range before {
+		if k == "_id" {
+			continue
+		}
+		if av, ok := after[k]; !ok || !reflect.DeepEqual(v, av) {
+			changes[k] = FieldChange{Before: v, After: after[k]}
+		}
+	}
+	for k, v := range after {
+		if _, ok := before[k]; !ok && k != "_id" {
+			changes[k] = FieldChange{After: v}
+		}
+	}
+	return changes
+}
+
+func docIDs(docs []bson.M) []interface{} {
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc["_id"])
+	}
+	return ids
+}
+
+func toDoc(v interface{}) (bson.M, error) {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	err = bson.Unmarshal(raw, &doc)
+	return doc, err
+}
+
+// filters are kept as extended json: stored as is their $ operators would
+// end up as field names
+func filterString(filter interface{}) string {
+	if filter == nil {
+		return ""
+	}
+	b, err := bson.MarshalExtJSON(filter, false, false)
+	if err != nil {
+		return fmt.Sprint(filter)
+	}
+	return string(b)
+}
+
+// AuditHistoryParams selects the audit entries of one document, most recent
+// first. AuditCollection defaults to "audit_log"
+type AuditHistoryParams struct {
+	AuditCollection string
+	Collection      string
+	DocumentID      interface{}
+	Limit           int64
+}
+
+func (ahp *AuditHistoryParams) valid() bool {
+	return ahp.Collection != "" && ahp.DocumentID != nil
+}
+
+// AuditHistory returns the changes recorded for a document
+func AuditHistory(l log.Logger, m Manager, cc context.Context, params *AuditHistoryParams) ([]AuditEntry, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collection := params.AuditCollection
+	if collection == "" {
+		collection = DefaultAuditCollection
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}})
+	if params.Limit > 0 {
+		opts.SetLimit(params.Limit)
+	}
+	decoder, err := m.FindMany(l, cc, &FindManyParams{
+		Collection:     collection,
+		Filter:         bson.D{{Key: "collection", Value: params.Collection}, {Key: "documentId", Value: params.DocumentID}},
+		AdditionalOpts: []*options.FindOptions{opts},
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	if err := decoder.Decode(&entries); err != nil {
+		l.Error("unable to decode audit entries: %v", err)
+		return nil, err
+	}
+	return entries, nil
+}
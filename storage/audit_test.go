@@ -0,0 +1,195 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// auditCapture keeps the entries written to the audit collection
+type auditCapture struct {
+	*mocks.MockDBManager
+	entries []storage.AuditEntry
+}
+
+func (ac *auditCapture) InsertMany(l log.Logger, cc context.Context, data []interface{}, params *storage.InsertManyParams) (interface{}, error) {
+	if params.Collection == storage.DefaultAuditCollection {
+		for _, d := range data {
+			ac.entries = append(ac.entries, d.(storage.AuditEntry))
+		}
+	}
+	return ac.MockDBManager.InsertMany(l, cc, data, params)
+}
+
+func TestAuditedUpsert(t *testing.T) {
+	ac := &auditCapture{MockDBManager: &mocks.MockDBManager{
+		Responses: []interface{}{
+			`[{"_id": "EVT_1", "name": "bbq", "capacity": 10}]`,
+			int64(1),
+			`[{"_id": "EVT_1", "name": "bbq", "capacity": 25}]`,
+			[]interface{}{"AUD_1"},
+		},
+		FilterChecks: []interface{}{
+			bson.M{"_id": "EVT_1"},
+			bson.D{{Key: "$and", Value: bson.A{bson.M{"_id": "EVT_1"}, storage.Eq("_id", "EVT_1")}}},
+		},
+	}}
+	m := storage.NewAuditedManager(ac, nil)
+	cc := storage.WithActor(context.Background(), "USR_42")
+	n, err := m.Upsert(log.StdOutLogger{}, cc, bson.M{"capacity": 25}, &storage.UpsertParams{
+		Collection: "events",
+		Filter:     bson.M{"_id": "EVT_1"},
+		Generic:    true,
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	require.Len(t, ac.entries, 1)
+	entry := ac.entries[0]
+	require.Equal(t, "USR_42", entry.Actor)
+	require.Equal(t, storage.AuditUpdate, entry.Operation)
+	require.Equal(t, "events", entry.Collection)
+	require.Equal(t, "EVT_1", entry.DocumentID)
+	require.Equal(t, `{"_id":"EVT_1"}`, entry.Filter)
+	require.Equal(t, map[string]storage.FieldChange{"capacity": {Before: float64(10), After: float64(25)}}, entry.Changes)
+}
+
+func TestAuditedDelete(t *testing.T) {
+	ac := &auditCapture{MockDBManager: &mocks.MockDBManager{
+		Responses: []interface{}{
+			`[{"_id": "EVT_1", "name": "bbq"}]`,
+			int64(1),
+			`[]`,
+			[]interface{}{"AUD_1"},
+		},
+	}}
+	m := storage.NewAuditedManager(ac, &storage.AuditParams{Collections: []string{"events"}})
+	_, err := m.Delete(log.StdOutLogger{}, storage.WithActor(context.Background(), "USR_42"), &storage.DeleteParams{
+		Collection: "events",
+		Filter:     bson.M{"_id": "EVT_1"},
+	})
+	require.Nil(t, err)
+	require.Len(t, ac.entries, 1)
+	require.Equal(t, storage.AuditDelete, ac.entries[0].Operation)
+	require.Equal(t, map[string]storage.FieldChange{"name": {Before: "bbq"}}, ac.entries[0].Changes)
+}
+
+func TestAuditedMultipleUpsert(t *testing.T) {
+	l := log.StdOutLogger{}
+	mm := storage.NewMemoryManager()
+	seedParties(t, mm)
+	m := storage.NewAuditedManager(mm, nil)
+	res, err := m.UpsertWithResult(l, storage.WithActor(context.Background(), "USR_42"), bson.M{"capacity": 50}, &storage.UpsertParams{
+		Collection: "events",
+		Filter:     bson.M{"tags": "outdoor"},
+		Multiple:   true,
+		Generic:    true,
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), res.ModifiedCount)
+
+	decoder, err := mm.FindMany(l, context.Background(), &storage.FindManyParams{Collection: storage.DefaultAuditCollection, Filter: bson.M{}})
+	require.Nil(t, err)
+	var entries []storage.AuditEntry
+	require.Nil(t, decoder.Decode(&entries))
+	require.Len(t, entries, 2)
+	for i, id := range []string{"EVT_1", "EVT_2"} {
+		require.Equal(t, id, entries[i].DocumentID)
+		require.Equal(t, "USR_42", entries[i].Actor)
+		require.Empty(t, entries[i].Changes, "multiple writes only read the ids")
+	}
+}
+
+func TestAuditedBulkWrite(t *testing.T) {
+	l := log.StdOutLogger{}
+	mm := storage.NewMemoryManager()
+	seedParties(t, mm)
+	m := storage.NewAuditedManager(mm, nil)
+	cc := storage.WithActor(context.Background(), "USR_42")
+	_, err := m.BulkWrite(l, cc, []storage.WriteModel{
+		storage.InsertModel{Document: bson.M{"name": "rave"}},
+		storage.UpdateModel{Filter: bson.M{"name": "bbq"}, Update: bson.M{"$set": bson.M{"capacity": 12}}},
+		storage.UpdateModel{Filter: bson.M{"tags": "outdoor"}, Update: bson.M{"$inc": bson.M{"capacity": 1}}, Multiple: true},
+		storage.DeleteModel{Filter: bson.M{"_id": "EVT_3"}},
+	}, &storage.BulkWriteParams{Collection: "events"})
+	require.Nil(t, err)
+
+	decoder, err := mm.FindMany(l, context.Background(), &storage.FindManyParams{Collection: storage.DefaultAuditCollection, Filter: bson.M{}})
+	require.Nil(t, err)
+	var entries []storage.AuditEntry
+	require.Nil(t, decoder.Decode(&entries))
+	require.Len(t, entries, 5)
+	require.Equal(t, storage.AuditInsert, entries[0].Operation)
+	id, ok := entries[0].DocumentID.(primitive.ObjectID)
+	require.True(t, ok, "inserts without an _id get one before the write")
+	require.Equal(t, []string{id.Hex()}, findIDs(t, mm, bson.M{"name": "rave"}))
+	for i, id := range []string{"EVT_1", "EVT_1", "EVT_2", "EVT_3"} {
+		require.Equal(t, id, entries[i+1].DocumentID)
+		require.Equal(t, "USR_42", entries[i+1].Actor)
+	}
+
+	history, err := storage.AuditHistory(l, mm, context.Background(), &storage.AuditHistoryParams{Collection: "events", DocumentID: "EVT_1"})
+	require.Nil(t, err)
+	require.Len(t, history, 2)
+}
+
+func TestAuditSnapshotFailure(t *testing.T) {
+	// the before image can't be decoded
+	params := &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true}
+	ac := &auditCapture{MockDBManager: &mocks.MockDBManager{
+		Responses: []interface{}{`not json`, int64(1)},
+	}}
+	n, err := storage.NewAuditedManager(ac, nil).Upsert(log.StdOutLogger{}, context.Background(), bson.M{"capacity": 25}, params)
+	require.Nil(t, err, "outside of a transaction the write goes ahead")
+	require.Equal(t, int64(1), n)
+	require.Empty(t, ac.entries)
+
+	ac = &auditCapture{MockDBManager: &mocks.MockDBManager{
+		Responses: []interface{}{`not json`, int64(1)},
+	}}
+	err = storage.NewAuditedManager(ac, nil).WithTransaction(log.StdOutLogger{}, context.Background(), func(tx storage.Manager) error {
+		_, err := tx.Upsert(log.StdOutLogger{}, context.Background(), bson.M{"capacity": 25}, params)
+		return err
+	})
+	require.NotNil(t, err)
+	require.Equal(t, 1, ac.CallCount, "the write isn't attempted")
+}
+
+func TestAuditSkipsOtherCollections(t *testing.T) {
+	ac := &auditCapture{MockDBManager: &mocks.MockDBManager{Responses: []interface{}{int64(1)}}}
+	m := storage.NewAuditedManager(ac, &storage.AuditParams{Collections: []string{"events"}})
+	_, err := m.Delete(log.StdOutLogger{}, context.Background(), &storage.DeleteParams{Collection: "guests", Filter: bson.M{}})
+	require.Nil(t, err)
+	require.Equal(t, 1, ac.CallCount)
+	require.Empty(t, ac.entries)
+}
+
+func TestAuditFailureAbortsTransaction(t *testing.T) {
+	ac := &auditCapture{MockDBManager: &mocks.MockDBManager{
+		Responses: []interface{}{"EVT_1", []interface{}{"AUD_1"}},
+		Errors:    []interface{}{nil, errors.New("audit down")},
+	}}
+	m := storage.NewAuditedManager(ac, nil)
+	err := m.WithTransaction(log.StdOutLogger{}, context.Background(), func(tx storage.Manager) error {
+		_, err := tx.InsertOne(log.StdOutLogger{}, context.Background(), bson.M{"_id": "EVT_1", "name": "bbq"}, &storage.InsertOneParams{Collection: "events"})
+		return err
+	})
+	require.EqualError(t, err, "audit down")
+}
+
+func TestAuditHistory(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		Responses:    []interface{}{`[{"ID": "AUD_2", "Operation": "update"}, {"ID": "AUD_1", "Operation": "insert"}]`},
+		FilterChecks: []interface{}{bson.D{{Key: "collection", Value: "events"}, {Key: "documentId", Value: "EVT_1"}}},
+	}
+	entries, err := storage.AuditHistory(log.StdOutLogger{}, mm, context.Background(), &storage.AuditHistoryParams{Collection: "events", DocumentID: "EVT_1"})
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "AUD_2", entries[0].ID)
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WriteModel is a single operation of a BulkWrite: an InsertModel,
+// UpdateModel, ReplaceModel or DeleteModel
+type WriteModel interface {
+	mongoModel() mongo.WriteModel
+}
+
+type InsertModel struct {
+	Document interface{}
+}
+
+func (m InsertModel) mongoModel() mongo.WriteModel {
+	return mongo.NewInsertOneModel().SetDocument(m.Document)
+}
+
+// UpdateModel mirrors UpsertParams: Generic wraps Update in a $set
+type UpdateModel struct {
+	Filter   interface{}
+	Update   interface{}
+	Multiple bool
+	Generic  bool
+	Upsert   bool
+}
+
+func (m UpdateModel) mongoModel() mongo.WriteModel {
+	update := m.Update
+	if m.Generic {
+		update = bson.D{{Key: "$set", Value: m.Update}}
+	}
+	if m.Multiple {
+		return mongo.NewUpdateManyModel().SetFilter(m.Filter).SetUpdate(update).SetUpsert(m.Upsert)
+	}
+	return mongo.NewUpdateOneModel().SetFilter(m.Filter).SetUpdate(update).SetUpsert(m.Upsert)
+}
+
+type ReplaceModel struct {
+	Filter      interface{}
+	Replacement interface{}
+	Upsert      bool
+}
+
+func (m ReplaceModel) mongoModel() mongo.WriteModel {
+	return mongo.NewReplaceOneModel().SetFilter(m.Filter).SetReplacement(m.Replacement).SetUpsert(m.Upsert)
+}
+
+// DeleteModel mirrors DeleteParams: on collections with soft delete
+// enabled the documents are only marked as deleted unless Hard is set
+type DeleteModel struct {
+	Filter   interface{}
+	Multiple bool
+	Hard     bool
+}
+
+func (m DeleteModel) mongoModel() mongo.WriteModel {
+	if m.Multiple {
+		return mongo.NewDeleteManyModel().SetFilter(m.Filter)
+	}
+	return mongo.NewDeleteOneModel().SetFilter(m.Filter)
+}
+
+// BulkWriteParams describes a bulk write. Operations run in order and stop
+// at the first failure unless Unordered is set, in which case the server
+// may run them in any order and carries on past failures. On collections
+// with soft delete enabled update and replace models leave soft deleted
+// documents alone unless IncludeDeleted is set, and delete models soft
+// delete (by DeletedBy) unless they are Hard
+type BulkWriteParams struct {
+	Collection     string
+	Unordered      bool
+	IncludeDeleted bool
+	DeletedBy      string
+	AdditionalOpts []*options.BulkWriteOptions
+}
+
+func (bwp *BulkWriteParams) valid() bool {
+	return bwp.Collection != ""
+}
+
+type BulkOpStatus int
+
+const (
+	BulkOpSucceeded BulkOpStatus = iota
+	BulkOpFailed
+	// BulkOpSkipped is only possible in ordered mode, for the operations
+	// following a failed one
+	BulkOpSkipped
+)
+
+// BulkOpResult is the outcome of the operation at Index in the models
+// passed to BulkWrite. Err is a CollisionError when the operation violated
+// a unique index
+type BulkOpResult struct {
+	Index      int
+	Status     BulkOpStatus
+	Err        error
+	UpsertedID interface{}
+}
+
+// BulkWriteResult sums up a bulk write. Soft deletes are updates as far as
+// the server is concerned: they count in MatchedCount and ModifiedCount,
+// not in DeletedCount
+type BulkWriteResult struct {
+	InsertedCount int64
+	MatchedCount  int64
+	ModifiedCount int64
+	DeletedCount  int64
+	UpsertedCount int64
+	Operations    []BulkOpResult
+}
+
+// Collisions returns the indexes of the operations that hit a CollisionError
+func (r *BulkWriteResult) Collisions() []int {
+	indexes := []int{}
+	for _, op := range r.Operations {
+		if _, ok := op.Err.(CollisionError); ok {
+			indexes = append(indexes, op.Index)
+		}
+	}
+	return indexes
+}
+
+// Failed returns the results of the operations that did not succeed
+func (r *BulkWriteResult) Failed() []BulkOpResult {
+	failed := []BulkOpResult{}
+	for _, op := range r.Operations {
+		if op.Status == BulkOpFailed {
+			failed = append(failed, op)
+		}
+	}
+	return failed
+}
+
+// BulkWrite sends every model to the server in a single round trip (the
+// driver splits very large batches as needed). When some operations fail
+// both the result and a BulkWriteError are returned, so callers can inspect
+// the per operation outcome
+func (mc *mongoClient) BulkWrite(l log.Logger, cc context.Context, models []WriteModel, params *BulkWriteParams) (*BulkWriteResult, error) {
+	if ok := params.valid(); !ok || len(models) == 0 {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	writes := make([]mongo.WriteModel, len(models))
+	for i, m := range models {
+		writes[i] = mc.liveModel(m, params).mongoModel()
+	}
+	opts := options.BulkWrite().SetOrdered(!params.Unordered)
+	res, err := collection.BulkWrite(mc.context(cc), writes, append([]*options.BulkWriteOptions{opts}, params.AdditionalOpts...)...)
+	var bwe mongo.BulkWriteException
+	if err != nil && !errors.As(err, &bwe) {
+		l.Error("unable to bulk write into %v: %v", params.Collection, err)
+		return nil, err
+	}
+	result := newBulkWriteResult(len(models), res)
+	if err == nil {
+		return result, nil
+	}
+	return bulkWriteFailure(l, params, result, bwe)
+}
+
+// liveModel narrows the filter of m down to documents that are not soft
+// deleted and turns a DeleteModel into a soft delete
+func (mc *mongoClient) liveModel(m WriteModel, params *BulkWriteParams) WriteModel {
+	if !mc.softDelete[params.Collection] {
+		return m
+	}
+	switch mdl := m.(type) {
+	case UpdateModel:
+		mdl.Filter = mc.liveFilter(params.Collection, mdl.Filter, params.IncludeDeleted)
+		return mdl
+	case ReplaceModel:
+		mdl.Filter = mc.liveFilter(params.Collection, mdl.Filter, params.IncludeDeleted)
+		return mdl
+	case DeleteModel:
+		if mdl.Hard {
+			return mdl
+		}
+		return UpdateModel{
+			Filter:   bson.D{{Key: "$and", Value: bson.A{mdl.Filter, notDeleted()}}},
+			Update:   softDeleteUpdate(params.DeletedBy),
+			Multiple: mdl.Multiple,
+		}
+	}
+	return m
+}
+
+// bulkWriteFailure fills the per operation outcome of result out of bwe
+func bulkWriteFailure(l log.Logger, params *BulkWriteParams, result *BulkWriteResult, bwe mongo.BulkWriteException) (*BulkWriteResult, error) {
+	n := len(result.Operations)
+	firstFailure := n
+	for _, we := range bwe.WriteErrors {
+		op := &result.Operations[we.Index]
+		op.Status = BulkOpFailed
+		op.Err = fmt.Errorf("write error %d: %s", we.Code, we.Message)
+		if we.Code == 11000 {
+			op.Err = CollisionError{CollectionName: params.Collection}
+		}
+		if we.Index < firstFailure {
+			firstFailure = we.Index
+		}
+	}
+	if !params.Unordered {
+		for i := firstFailure + 1; i < n; i++ {
+			if result.Operations[i].Status == BulkOpSucceeded {
+				result.Operations[i].Status = BulkOpSkipped
+			}
+		}
+	}
+	failed := len(result.Failed())
+	bulkErr := BulkWriteError{CollectionName: params.Collection, Failed: failed, Collisions: len(result.Collisions())}
+	if bwe.WriteConcernError != nil {
+		l.Error("write concern error bulk writing into %v: %v", params.Collection, bwe.WriteConcernError)
+		bulkErr.WriteConcern = bwe.WriteConcernError
+	}
+	if failed > 0 {
+		l.Error("%d of %d operations failed bulk writing into %v", failed, n, params.Collection)
+	}
+	return result, bulkErr
+}
+
+func newBulkWriteResult(n int, res *mongo.BulkWriteResult) *BulkWriteResult {
+	result := &BulkWriteResult{Operations: make([]BulkOpResult, n)}
+	for i := range result.Operations {
+		result.Operations[i].Index = i
+	}
+	if res == nil {
+		return result
+	}
+	result.InsertedCount = res.InsertedCount
+	result.MatchedCount = res.MatchedCount
+	result.ModifiedCount = res.ModifiedCount
+	result.DeletedCount = res.DeletedCount
+	result.UpsertedCount = res.UpsertedCount
+	for i, id := range res.UpsertedIDs {
+		if int(i) < n {
+			result.Operations[i].UpsertedID = id
+		}
+	}
+	return result
+}
@@ -0,0 +1,106 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestBulkWriteRequiresModels(t *testing.T) {
+	_, err := unconnected.BulkWrite(log.StdOutLogger{}, context.Background(), nil, &storage.BulkWriteParams{Collection: "events"})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+	_, err = unconnected.BulkWrite(log.StdOutLogger{}, context.Background(), []storage.WriteModel{storage.InsertModel{Document: bson.M{}}}, &storage.BulkWriteParams{})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+}
+
+func TestNewBulkWriteResult(t *testing.T) {
+	result := storage.NewBulkWriteResult(3, &mongo.BulkWriteResult{
+		InsertedCount: 1,
+		MatchedCount:  1,
+		ModifiedCount: 1,
+		UpsertedCount: 1,
+		UpsertedIDs:   map[int64]interface{}{2: "EVT_3"},
+	})
+	require.Equal(t, int64(1), result.InsertedCount)
+	require.Equal(t, int64(1), result.UpsertedCount)
+	require.Equal(t, 3, len(result.Operations))
+	require.Equal(t, "EVT_3", result.Operations[2].UpsertedID)
+	require.Equal(t, 1, result.Operations[1].Index)
+	require.Empty(t, result.Failed())
+}
+
+func bulkFailure(indexes ...int) mongo.BulkWriteException {
+	bwe := mongo.BulkWriteException{}
+	for _, i := range indexes {
+		code := 121
+		if i == 1 {
+			code = 11000
+		}
+		bwe.WriteErrors = append(bwe.WriteErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{Index: i, Code: code, Message: "failed"}})
+	}
+	return bwe
+}
+
+func TestOrderedBulkWriteFailure(t *testing.T) {
+	params := &storage.BulkWriteParams{Collection: "events"}
+	result, err := storage.BulkWriteFailure(log.StdOutLogger{}, params, storage.NewBulkWriteResult(4, nil), bulkFailure(1))
+	require.Equal(t, storage.BulkWriteError{CollectionName: "events", Failed: 1, Collisions: 1}, err)
+	require.Equal(t, storage.BulkOpSucceeded, result.Operations[0].Status)
+	require.Equal(t, storage.BulkOpFailed, result.Operations[1].Status)
+	require.Equal(t, storage.CollisionError{CollectionName: "events"}, result.Operations[1].Err)
+	require.Equal(t, storage.BulkOpSkipped, result.Operations[2].Status, "ordered writes stop at the first failure")
+	require.Equal(t, storage.BulkOpSkipped, result.Operations[3].Status)
+	require.Equal(t, []int{1}, result.Collisions())
+}
+
+func TestUnorderedBulkWriteFailure(t *testing.T) {
+	params := &storage.BulkWriteParams{Collection: "events", Unordered: true}
+	result, err := storage.BulkWriteFailure(log.StdOutLogger{}, params, storage.NewBulkWriteResult(4, nil), bulkFailure(1, 3))
+	require.Equal(t, storage.BulkWriteError{CollectionName: "events", Failed: 2, Collisions: 1}, err)
+	require.Equal(t, storage.BulkOpSucceeded, result.Operations[2].Status, "unordered writes carry on")
+	require.Equal(t, storage.BulkOpFailed, result.Operations[3].Status)
+	require.NotNil(t, result.Operations[3].Err)
+	_, isCollision := result.Operations[3].Err.(storage.CollisionError)
+	require.False(t, isCollision, "only duplicate keys are collisions")
+}
+
+func TestBulkWriteConcernFailure(t *testing.T) {
+	wce := &mongo.WriteConcernError{Code: 64, Message: "waiting for replication timed out"}
+	params := &storage.BulkWriteParams{Collection: "events"}
+	result, err := storage.BulkWriteFailure(log.StdOutLogger{}, params, storage.NewBulkWriteResult(2, nil), mongo.BulkWriteException{WriteConcernError: wce})
+	require.Equal(t, storage.BulkWriteError{CollectionName: "events", WriteConcern: wce}, err)
+	require.Contains(t, err.Error(), "waiting for replication timed out")
+	require.Empty(t, result.Failed())
+}
+
+func TestBulkWriteSoftDelete(t *testing.T) {
+	mc := storage.NewMongoClient(nil, nil).EnableSoftDelete("events")
+	params := &storage.BulkWriteParams{Collection: "events", DeletedBy: "USR_1"}
+	filter := bson.M{"_id": "EVT_1"}
+	live := bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "deletedAt", Value: bson.D{{Key: "$exists", Value: false}}}}}}}
+
+	update := mc.LiveModel(storage.UpdateModel{Filter: filter, Update: bson.M{"name": "bbq"}, Generic: true}, params).(storage.UpdateModel)
+	require.Equal(t, live, update.Filter)
+	replace := mc.LiveModel(storage.ReplaceModel{Filter: filter, Replacement: bson.M{"name": "bbq"}}, params).(storage.ReplaceModel)
+	require.Equal(t, live, replace.Filter)
+
+	soft, ok := mc.LiveModel(storage.DeleteModel{Filter: filter, Multiple: true}, params).(storage.UpdateModel)
+	require.True(t, ok, "deletes become updates")
+	require.Equal(t, live, soft.Filter)
+	require.True(t, soft.Multiple)
+	set := soft.Update.(bson.D)[0].Value.(bson.D)
+	require.Equal(t, "deletedAt", set[0].Key)
+	require.Equal(t, bson.E{Key: "deletedBy", Value: "USR_1"}, set[1])
+
+	hard := storage.DeleteModel{Filter: filter, Hard: true}
+	require.Equal(t, hard, mc.LiveModel(hard, params))
+	params.IncludeDeleted = true
+	require.Equal(t, filter, mc.LiveModel(storage.UpdateModel{Filter: filter}, params).(storage.UpdateModel).Filter)
+	other := storage.DeleteModel{Filter: filter}
+	require.Equal(t, other, mc.LiveModel(other, &storage.BulkWriteParams{Collection: "guests"}))
+}
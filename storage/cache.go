@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/utils/lru"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	defaultCacheTTL        = time.Minute
+	defaultCacheMaxEntries = 10000
+)
+
+// CacheBackend stores cached documents as bson. Entries must expire after
+// ttl. Implementations must be safe for concurrent use
+type CacheBackend interface {
+	Get(cc context.Context, key string) ([]byte, bool)
+	Set(cc context.Context, key string, value []byte, ttl time.Duration)
+}
+
+type memoryCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryCacheBackend struct {
+	cache *lru.Cache[string, memoryCacheEntry]
+}
+
+// NewMemoryCacheBackend keeps up to maxEntries documents in a process local
+// LRU cache
+func NewMemoryCacheBackend(maxEntries int) CacheBackend {
+	return &memoryCacheBackend{cache: lru.New[string, memoryCacheEntry](maxEntries)}
+}
+
+func (b *memoryCacheBackend) Get(cc context.Context, key string) ([]byte, bool) {
+	e, ok := b.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		b.cache.Remove(key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (b *memoryCacheBackend) Set(cc context.Context, key string, value []byte, ttl time.Duration) {
+	b.cache.Add(key, memoryCacheEntry{value: value, expires: time.Now().Add(ttl)})
+}
+
+// CacheParams configures a caching Manager. Backend defaults to an in
+// memory LRU of MaxEntries (defaults to 10000) documents and TTL defaults
+// to a minute. Only FindOne calls on Collections are cached; leave it empty
+// to cache every collection
+type CacheParams struct {
+	Backend     CacheBackend
+	TTL         time.Duration
+	MaxEntries  int
+	Collections []string
+}
+
+type cachingManager struct {
+	Manager
+	backend     CacheBackend
+	ttl         time.Duration
+	collections map[string]bool
+
+	mu          sync.Mutex
+	generations map[string]uint64
+	loads       map[string]*cacheLoad
+}
+
+type cacheLoad struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// NewCachingManager wraps m so that FindOne results are cached. Writes made
+// through the returned Manager invalidate every cached entry of the
+// collection they touch, and concurrent misses for the same lookup share a
+// single call to m. Invalidation is local to the process: with a backend
+// shared between instances, writes made by other instances only show up
+// once the entries expire. FindOne calls with AdditionalOpts and calls made
+// inside a transaction are never cached. Missing documents are not cached
+func NewCachingManager(m Manager, params *CacheParams) Manager {
+	p := CacheParams{}
+	if params != nil {
+		p = *params
+	}
+	if p.TTL <= 0 {
+		p.TTL = defaultCacheTTL
+	}
+	if p.MaxEntries <= 0 {
+		p.MaxEntries = defaultCacheMaxEntries
+	}
+	if p.Backend == nil {
+		p.Backend = NewMemoryCacheBackend(p.MaxEntries)
+	}
+	cm := &cachingManager{
+		Manager:     m,
+		backend:     p.Backend,
+		ttl:         p.TTL,
+		generations: map[string]uint64{},
+		loads:       map[string]*cacheLoad{},
+	}
+	if len(p.Collections) > 0 {
+		cm.collections = map[string]bool{}
+		for _, c := range p.Collections {
+			cm.collections[c] = true
+		}
+	}
+	return cm
+}
+
+func (cm *cachingManager) cached(collection string) bool {
+	return cm.collections == nil || cm.collections[collection]
+}
+
+func (cm *cachingManager) invalidate(collection string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.generations[collection]++
+}
+
+func (cm *cachingManager) generation(collection string) uint64 {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.generations[collection]
+}
+
+// key includes the generation of the collection, so bumping it on writes
+// orphans every entry cached before. The generation is returned as well
+func (cm *cachingManager) key(params *FindOneParams) (string, uint64, error) {
+	filter, err := bson.MarshalExtJSON(bson.D{{Key: "f", Value: canonical(params.Filter)}}, true, false)
+	if err != nil {
+		return "", 0, err
+	}
+	gen := cm.generation(params.Collection)
+	return fmt.Sprintf("%s|%d|%t|%s", params.Collection, gen, params.IncludeDeleted, filter), gen, nil
+}
+
+// canonical rewrites the maps of a filter as bson.D sorted by key, so that
+// equal filters make the same key whatever the map iteration order
+func canonical(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return v
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		d := make(bson.D, 0, len(keys))
+		for _, k := range keys {
+			d = append(d, bson.E{Key: k.String(), Value: canonical(rv.MapIndex(k).Interface())})
+		}
+		return d
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() || rv.Type().Elem().Kind() == reflect.Uint8 {
+			return v
+		}
+		if rv.Type().Elem() == reflect.TypeOf(bson.E{}) {
+			d := make(bson.D, rv.Len())
+			for i := range d {
+				e := rv.Index(i).Interface().(bson.E)
+				d[i] = bson.E{Key: e.Key, Value: canonical(e.Value)}
+			}
+			return d
+		}
+		a := make(bson.A, rv.Len())
+		for i := range a {
+			a[i] = canonical(rv.Index(i).Interface())
+		}
+		return a
+	}
+	return v
+}
+
+type cachedDecoder []byte
+
+func (cd cachedDecoder) Decode(v interface{}) error {
+	return bson.Unmarshal(cd, v)
+}
+
+func (cm *cachingManager) FindOne(l log.Logger, cc context.Context, params *FindOneParams) (Decoder, error) {
+	if !cm.cached(params.Collection) || len(params.AdditionalOpts) > 0 || params.Filter == nil {
+		return cm.Manager.FindOne(l, cc, params)
+	}
+	key, gen, err := cm.key(params)
+	if err != nil {
+		l.Warn("unable to build cache key, skipping the cache: %v", err)
+		return cm.Manager.FindOne(l, cc, params)
+	}
+	if value, ok := cm.backend.Get(cc, key); ok {
+		return cachedDecoder(value), nil
+	}
+	value, err := cm.load(cc, key, func(ctx context.Context) ([]byte, error) {
+		decoder, err := cm.Manager.FindOne(l, ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		var doc bson.M
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+		value, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		// the document may predate a write made while it was loading. The
+		// entry would be orphaned here but not in other instances sharing
+		// the backend, which are at their own generation
+		if cm.generation(params.Collection) == gen {
+			cm.backend.Set(ctx, key, value, cm.ttl)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cachedDecoder(value), nil
+}
+
+// load runs fn once for all the concurrent callers asking for key. fn gets
+// a context none of them can cancel, bounded by DefaultTimeout, while each
+// caller stops waiting as soon as its own cc is done
+func (cm *cachingManager) load(cc context.Context, key string, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	cm.mu.Lock()
+	call, ok := cm.loads[key]
+	if !ok {
+		call = &cacheLoad{done: make(chan struct{})}
+		cm.loads[key] = call
+		go func() {
+			ctx, cancel := context.WithTimeout(detachedContext{parent: cc}, DefaultTimeout)
+			defer cancel()
+			call.value, call.err = fn(ctx)
+			cm.mu.Lock()
+			delete(cm.loads, key)
+			cm.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	cm.mu.Unlock()
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-cc.Done():
+		return nil, cc.Err()
+	}
+}
+
+// detachedContext keeps the values of parent but not its deadline or
+// cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (dc detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (dc detachedContext) Done() <-chan struct{}             { return nil }
+func (dc detachedContext) Err() error                        { return nil }
+func (dc detachedContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
+
+func (cm *cachingManager) InsertOne(l log.Logger, cc context.Context, document interface{}, params *InsertOneParams) (interface{}, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.InsertOne(l, cc, document, params)
+}
+
+func (cm *cachingManager) InsertMany(l log.Logger, cc context.Context, data []interface{}, params *InsertManyParams) (interface{}, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.InsertMany(l, cc, data, params)
+}
+
+func (cm *cachingManager) Upsert(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (int64, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.Upsert(l, cc, updates, params)
+}
+
+func (cm *cachingManager) UpsertWithResult(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (*UpsertResult, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.UpsertWithResult(l, cc, updates, params)
+}
+
+func (cm *cachingManager) Delete(l log.Logger, cc context.Context, params *DeleteParams) (int64, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.Delete(l, cc, params)
+}
+
+func (cm *cachingManager) Restore(l log.Logger, cc context.Context, params *RestoreParams) (int64, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.Restore(l, cc, params)
+}
+
+func (cm *cachingManager) PurgeDeleted(l log.Logger, cc context.Context, params *PurgeParams) (int64, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.PurgeDeleted(l, cc, params)
+}
+
+func (cm *cachingManager) BulkWrite(l log.Logger, cc context.Context, models []WriteModel, params *BulkWriteParams) (*BulkWriteResult, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.BulkWrite(l, cc, models, params)
+}
+
+func (cm *cachingManager) FindOneAndUpdate(l log.Logger, cc context.Context, updates interface{}, params *FindOneAndUpdateParams) (Decoder, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.FindOneAndUpdate(l, cc, updates, params)
+}
+
+func (cm *cachingManager) FindOneAndReplace(l log.Logger, cc context.Context, replacement interface{}, params *FindOneAndReplaceParams) (Decoder, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.FindOneAndReplace(l, cc, replacement, params)
+}
+
+func (cm *cachingManager) FindOneAndDelete(l log.Logger, cc context.Context, params *FindOneAndDeleteParams) (Decoder, error) {
+	defer cm.invalidate(params.Collection)
+	return cm.Manager.FindOneAndDelete(l, cc, params)
+}
+
+// WithTransaction hands fn a Manager that reads around the cache and
+// remembers which collections were written to, so that they can be
+// invalidated once more after the commit: entries cached while the
+// transaction was running still hold the old documents
+func (cm *cachingManager) WithTransaction(l log.Logger, cc context.Context, fn func(tx Manager) error) error {
+	touched := &txWrites{collections: map[string]bool{}}
+	defer func() {
+		for c := range touched.collections {
+			cm.invalidate(c)
+		}
+	}()
+	return cm.Manager.WithTransaction(l, cc, func(tx Manager) error {
+		return fn(&cachingTx{Manager: tx, cm: cm, touched: touched})
+	})
+}
+
+type txWrites struct {
+	mu          sync.Mutex
+	collections map[string]bool
+}
+
+// cachingTx passes every call through to the transaction, invalidating the
+// collections it writes to
+type cachingTx struct {
+	Manager
+	cm      *cachingManager
+	touched *txWrites
+}
+
+func (tx *cachingTx) wrote(collection string) {
+	tx.touched.mu.Lock()
+	tx.touched.collections[collection] = true
+	tx.touched.mu.Unlock()
+	tx.cm.invalidate(collection)
+}
+
+func (tx *cachingTx) WithTransaction(l log.Logger, cc context.Context, fn func(tx Manager) error) error {
+	return fn(tx)
+}
+
+func (tx *cachingTx) InsertOne(l log.Logger, cc context.Context, document interface{}, params *InsertOneParams) (interface{}, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.InsertOne(l, cc, document, params)
+}
+
+func (tx *cachingTx) InsertMany(l log.Logger, cc context.Context, data []interface{}, params *InsertManyParams) (interface{}, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.InsertMany(l, cc, data, params)
+}
+
+func (tx *cachingTx) Upsert(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (int64, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.Upsert(l, cc, updates, params)
+}
+
+func (tx *cachingTx) UpsertWithResult(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (*UpsertResult, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.UpsertWithResult(l, cc, updates, params)
+}
+
+func (tx *cachingTx) Delete(l log.Logger, cc context.Context, params *DeleteParams) (int64, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.Delete(l, cc, params)
+}
+
+func (tx *cachingTx) Restore(l log.Logger, cc context.Context, params *RestoreParams) (int64, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.Restore(l, cc, params)
+}
+
+func (tx *cachingTx) PurgeDeleted(l log.Logger, cc context.Context, params *PurgeParams) (int64, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.PurgeDeleted(l, cc, params)
+}
+
+func (tx *cachingTx) BulkWrite(l log.Logger, cc context.Context, models []WriteModel, params *BulkWriteParams) (*BulkWriteResult, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.BulkWrite(l, cc, models, params)
+}
+
+func (tx *cachingTx) FindOneAndUpdate(l log.Logger, cc context.Context, updates interface{}, params *FindOneAndUpdateParams) (Decoder, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.FindOneAndUpdate(l, cc, updates, params)
+}
+
+func (tx *cachingTx) FindOneAndReplace(l log.Logger, cc context.Context, replacement interface{}, params *FindOneAndReplaceParams) (Decoder, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.FindOneAndReplace(l, cc, replacement, params)
+}
+
+func (tx *cachingTx) FindOneAndDelete(l log.Logger, cc context.Context, params *FindOneAndDeleteParams) (Decoder, error) {
+	defer tx.wrote(params.Collection)
+	return tx.Manager.FindOneAndDelete(l, cc, params)
+}
@@ -0,0 +1,169 @@
+package storage_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// countingManager counts the FindOne calls that reach the store
+type countingManager struct {
+	storage.Manager
+	finds int32
+	delay time.Duration
+}
+
+func (cm *countingManager) FindOne(l log.Logger, cc context.Context, params *storage.FindOneParams) (storage.Decoder, error) {
+	atomic.AddInt32(&cm.finds, 1)
+	select {
+	case <-time.After(cm.delay):
+	case <-cc.Done():
+		return nil, cc.Err()
+	}
+	return cm.Manager.FindOne(l, cc, params)
+}
+
+// gatedManager reads the document and then holds on to it until released
+type gatedManager struct {
+	storage.Manager
+	loaded  chan struct{}
+	release chan struct{}
+}
+
+func (gm *gatedManager) FindOne(l log.Logger, cc context.Context, params *storage.FindOneParams) (storage.Decoder, error) {
+	decoder, err := gm.Manager.FindOne(l, cc, params)
+	close(gm.loaded)
+	<-gm.release
+	return decoder, err
+}
+
+func findParty(t *testing.T, m storage.Manager, id string) party {
+	decoder, err := m.FindOne(log.StdOutLogger{}, context.Background(), &storage.FindOneParams{Collection: "events", Filter: bson.M{"_id": id}})
+	require.Nil(t, err)
+	var p party
+	require.Nil(t, decoder.Decode(&p))
+	return p
+}
+
+func TestCachingManagerHitsAndInvalidation(t *testing.T) {
+	backing := &countingManager{Manager: storage.NewMemoryManager()}
+	seedParties(t, backing)
+	m := storage.NewCachingManager(backing, nil)
+
+	require.Equal(t, "bbq", findParty(t, m, "EVT_1").Name)
+	require.Equal(t, "bbq", findParty(t, m, "EVT_1").Name)
+	require.Equal(t, int32(1), backing.finds, "second lookup is served from the cache")
+
+	_, err := m.Upsert(log.StdOutLogger{}, context.Background(), bson.M{"name": "big bbq"}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true})
+	require.Nil(t, err)
+	require.Equal(t, "big bbq", findParty(t, m, "EVT_1").Name)
+	require.Equal(t, int32(2), backing.finds, "writes invalidate the collection")
+
+	err = m.WithTransaction(log.StdOutLogger{}, context.Background(), func(tx storage.Manager) error {
+		_, err := tx.Upsert(log.StdOutLogger{}, context.Background(), bson.M{"name": "huge bbq"}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true})
+		return err
+	})
+	require.Nil(t, err)
+	require.Equal(t, "huge bbq", findParty(t, m, "EVT_1").Name)
+}
+
+func TestCachingManagerTTL(t *testing.T) {
+	backing := &countingManager{Manager: storage.NewMemoryManager()}
+	seedParties(t, backing)
+	m := storage.NewCachingManager(backing, &storage.CacheParams{TTL: 10 * time.Millisecond})
+	findParty(t, m, "EVT_1")
+	time.Sleep(20 * time.Millisecond)
+	findParty(t, m, "EVT_1")
+	require.Equal(t, int32(2), backing.finds)
+}
+
+func TestCachingManagerCollapsesMisses(t *testing.T) {
+	backing := &countingManager{Manager: storage.NewMemoryManager(), delay: 50 * time.Millisecond}
+	seedParties(t, backing)
+	m := storage.NewCachingManager(backing, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Equal(t, "gala", findParty(t, m, "EVT_3").Name)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), backing.finds)
+}
+
+func TestCachingManagerSkipsUncachedCollections(t *testing.T) {
+	backing := &countingManager{Manager: storage.NewMemoryManager()}
+	seedParties(t, backing)
+	m := storage.NewCachingManager(backing, &storage.CacheParams{Collections: []string{"users"}})
+	findParty(t, m, "EVT_1")
+	findParty(t, m, "EVT_1")
+	require.Equal(t, int32(2), backing.finds)
+
+	_, err := m.FindOne(log.StdOutLogger{}, context.Background(), &storage.FindOneParams{Collection: "users", Filter: bson.M{"_id": "USR_1"}})
+	require.True(t, storage.IsNotFoundErr(err))
+}
+
+func TestCachingManagerCallersCancelOnTheirOwn(t *testing.T) {
+	backing := &countingManager{Manager: storage.NewMemoryManager(), delay: 50 * time.Millisecond}
+	seedParties(t, backing)
+	m := storage.NewCachingManager(backing, nil)
+	params := &storage.FindOneParams{Collection: "events", Filter: bson.M{"_id": "EVT_3"}}
+
+	first, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var firstErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, firstErr = m.FindOne(log.StdOutLogger{}, first, params)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, "gala", findParty(t, m, "EVT_3").Name, "the first caller timing out doesn't fail the shared load")
+	wg.Wait()
+	require.Equal(t, context.DeadlineExceeded, firstErr, "but the first caller stops waiting")
+	require.Equal(t, int32(1), backing.finds)
+}
+
+func TestCachingManagerKeyIgnoresMapOrder(t *testing.T) {
+	backing := &countingManager{Manager: storage.NewMemoryManager()}
+	seedParties(t, backing)
+	m := storage.NewCachingManager(backing, nil)
+	for i := 0; i < 20; i++ {
+		_, err := m.FindOne(log.StdOutLogger{}, context.Background(), &storage.FindOneParams{
+			Collection: "events",
+			Filter:     bson.M{"_id": "EVT_1", "name": "bbq", "capacity": bson.M{"$gte": 5, "$lte": 50}},
+		})
+		require.Nil(t, err)
+	}
+	require.Equal(t, int32(1), backing.finds)
+}
+
+func TestCachingManagerWriteDuringLoad(t *testing.T) {
+	store := storage.NewMemoryManager()
+	seedParties(t, store)
+	backend := storage.NewMemoryCacheBackend(100)
+	gated := &gatedManager{Manager: store, loaded: make(chan struct{}), release: make(chan struct{})}
+	m := storage.NewCachingManager(gated, &storage.CacheParams{Backend: backend})
+	// another instance sharing the backend
+	other := storage.NewCachingManager(store, &storage.CacheParams{Backend: backend})
+
+	done := make(chan party)
+	go func() { done <- findParty(t, m, "EVT_1") }()
+	<-gated.loaded
+	_, err := m.Upsert(log.StdOutLogger{}, context.Background(), bson.M{"name": "big bbq"}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true})
+	require.Nil(t, err)
+	close(gated.release)
+	require.Equal(t, "bbq", (<-done).Name, "read before the write")
+
+	require.Equal(t, "big bbq", findParty(t, other, "EVT_1").Name, "the document read before the write wasn't cached")
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTimeout is the timeout NewCallContext applies to every call
+const DefaultTimeout = 10 * time.Second
+
+// CallContext bounds a call to the data store. It implements context.Context
+// so it can be handed to any Manager method, as can a plain context.Context
+type CallContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewCallContext is used when a client wants to make a call to the data store and provide a
+// context object. Callers should defer Cancel to release the timer
+func NewCallContext() *CallContext {
+	return NewCallContextWithTimeout(context.Background(), DefaultTimeout)
+}
+
+// NewCallContextWithParent derives a CallContext from an inbound context,
+// e.g. the one of an http request, so that its cancellation reaches mongo
+func NewCallContextWithParent(parent context.Context) *CallContext {
+	return NewCallContextWithTimeout(parent, DefaultTimeout)
+}
+
+// NewCallContextWithTimeout derives a CallContext from parent with a custom
+// timeout. A timeout of zero or less only inherits the parent's deadline
+func NewCallContextWithTimeout(parent context.Context, timeout time.Duration) *CallContext {
+	if parent == nil {
+		parent = context.Background()
+	}
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(parent)
+		return &CallContext{ctx: ctx, cancel: cancel}
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	return &CallContext{ctx: ctx, cancel: cancel}
+}
+
+// Cancel releases the resources of the call context. It is safe to call
+// more than once
+func (cc *CallContext) Cancel() {
+	cc.cancel()
+}
+
+// Context returns the underlying context
+func (cc *CallContext) Context() context.Context {
+	return cc.ctx
+}
+
+func (cc *CallContext) Deadline() (time.Time, bool) {
+	return cc.ctx.Deadline()
+}
+
+func (cc *CallContext) Done() <-chan struct{} {
+	return cc.ctx.Done()
+}
+
+func (cc *CallContext) Err() error {
+	return cc.ctx.Err()
+}
+
+func (cc *CallContext) Value(key interface{}) interface{} {
+	return cc.ctx.Value(key)
+}
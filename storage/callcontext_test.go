@@ -0,0 +1,40 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallContextInheritsParentCancellation(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	cc := storage.NewCallContextWithParent(parent)
+	defer cc.Cancel()
+	cancel()
+	select {
+	case <-cc.Done():
+	case <-time.After(time.Second):
+		t.Fatal("call context should be done once its parent is cancelled")
+	}
+	require.Equal(t, context.Canceled, cc.Err())
+}
+
+func TestCallContextTimeout(t *testing.T) {
+	cc := storage.NewCallContextWithTimeout(context.Background(), 10*time.Millisecond)
+	defer cc.Cancel()
+	deadline, ok := cc.Deadline()
+	require.True(t, ok, "call context should have a deadline")
+	require.WithinDuration(t, time.Now().Add(10*time.Millisecond), deadline, 10*time.Millisecond)
+	<-cc.Done()
+	require.Equal(t, context.DeadlineExceeded, cc.Err())
+}
+
+func TestCallContextCancel(t *testing.T) {
+	cc := storage.NewCallContext()
+	cc.Cancel()
+	cc.Cancel()
+	require.Equal(t, context.Canceled, cc.Err())
+}
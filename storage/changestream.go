@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultWatchMinBackoff = 500 * time.Millisecond
+	defaultWatchMaxBackoff = 30 * time.Second
+
+	// the resume token fell off the oplog (or can't be used for another
+	// reason), resuming from it will never work
+	changeStreamHistoryLostCode = 286
+	changeStreamFatalErrorCode  = 280
+)
+
+// ChangeEvent is a single change stream event. FullDocument is only set for
+// inserts and replaces, or for updates when WatchParams.FullDocument is set
+type ChangeEvent struct {
+	ResumeToken       bson.Raw            `bson:"_id"`
+	OperationType     string              `bson:"operationType"`
+	Namespace         Namespace           `bson:"ns"`
+	DocumentKey       bson.Raw            `bson:"documentKey"`
+	FullDocument      bson.Raw            `bson:"fullDocument,omitempty"`
+	UpdateDescription *UpdateDescription  `bson:"updateDescription,omitempty"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime"`
+}
+
+type Namespace struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"coll"`
+}
+
+type UpdateDescription struct {
+	UpdatedFields bson.Raw `bson:"updatedFields"`
+	RemovedFields []string `bson:"removedFields"`
+}
+
+// DecodeFullDocument unmarshalls the changed document into v
+func (ce *ChangeEvent) DecodeFullDocument(v interface{}) error {
+	if len(ce.FullDocument) == 0 {
+		return NotFoundError{}
+	}
+	return bson.Unmarshal(ce.FullDocument, v)
+}
+
+// DecodeDocumentKey unmarshalls the _id (and shard key) of the changed
+// document into v
+func (ce *ChangeEvent) DecodeDocumentKey(v interface{}) error {
+	return bson.Unmarshal(ce.DocumentKey, v)
+}
+
+// ChangeHandler processes a single event. Returning an error stops Watch
+type ChangeHandler func(cc context.Context, event *ChangeEvent) error
+
+// CheckpointStore persists the resume token of a subscription so that a
+// restarted service picks up where it left off. Load returns nil when no
+// token has been saved under key yet
+type CheckpointStore interface {
+	Load(cc context.Context, key string) (bson.Raw, error)
+	Save(cc context.Context, key string, token bson.Raw) error
+}
+
+type memoryCheckpointStore struct {
+	mu     sync.Mutex
+	tokens map[string]bson.Raw
+}
+
+// NewMemoryCheckpointStore keeps resume tokens in memory. It survives
+// reconnects but not restarts
+func NewMemoryCheckpointStore() CheckpointStore {
+	return &memoryCheckpointStore{tokens: map[string]bson.Raw{}}
+}
+
+func (s *memoryCheckpointStore) Load(cc context.Context, key string) (bson.Raw, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[key], nil
+}
+
+func (s *memoryCheckpointStore) Save(cc context.Context, key string, token bson.Raw) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[key] = token
+	return nil
+}
+
+type managerCheckpointStore struct {
+	l          log.Logger
+	m          Manager
+	collection string
+}
+
+type checkpoint struct {
+	Key       string    `bson:"_id"`
+	Token     bson.Raw  `bson:"token"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+// NewManagerCheckpointStore keeps one document per subscription key in the
+// given collection
+func NewManagerCheckpointStore(l log.Logger, m Manager, collection string) CheckpointStore {
+	return &managerCheckpointStore{l: l, m: m, collection: collection}
+}
+
+func (s *managerCheckpointStore) Load(cc context.Context, key string) (bson.Raw, error) {
+	decoder, err := s.m.FindOne(s.l, cc, &FindOneParams{
+		Collection: s.collection,
+		Filter:     bson.M{"_id": key},
+	})
+	if IsNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := decoder.Decode(&cp); err != nil {
+		return nil, err
+	}
+	return cp.Token, nil
+}
+
+func (s *managerCheckpointStore) Save(cc context.Context, key string, token bson.Raw) error {
+	_, err := s.m.Upsert(s.l, cc, bson.M{"token": token, "updatedAt": time.Now().UTC()}, &UpsertParams{
+		Collection: s.collection,
+		Filter:     bson.M{"_id": key},
+		Generic:    true,
+	})
+	return err
+}
+
+// WatchParams describes a change stream subscription. Leave Collection
+// empty to watch the whole database. Pipeline holds optional filter stages
+// (e.g. a $match on operationType). When Checkpoints is set every handled
+// event's resume token is saved under CheckpointKey
+type WatchParams struct {
+	Collection    string
+	Pipeline      interface{}
+	FullDocument  bool
+	Checkpoints   CheckpointStore
+	CheckpointKey string
+	MaxBackoff    time.Duration
+}
+
+func (wp *WatchParams) valid() bool {
+	return wp.Checkpoints == nil || wp.CheckpointKey != ""
+}
+
+// Watch subscribes to changes and hands each event to handler, in order. It
+// blocks until cc is done or handler returns an error, reconnecting with
+// exponential backoff whenever the stream breaks and resuming after the last
+// handled event. Events are delivered at least once: the checkpoint is only
+// saved after handler succeeds. When the resume token is no longer in the
+// oplog Watch gives up with a ResumeTokenLostError rather than silently
+// skipping the events in between
+func (mc *mongoClient) Watch(l log.Logger, cc context.Context, params *WatchParams, handler ChangeHandler) error {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return MissingRequiredParameterError{}
+	}
+	pipeline := params.Pipeline
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+	open := func(cc context.Context, token bson.Raw) (changeStream, error) {
+		opts := options.ChangeStream()
+		if params.FullDocument {
+			opts.SetFullDocument(options.UpdateLookup)
+		}
+		if token != nil {
+			opts.SetStartAfter(token)
+		}
+		if params.Collection == "" {
+			return mc.database.Watch(cc, pipeline, opts)
+		}
+		return mc.Collection(params.Collection).Watch(cc, pipeline, opts)
+	}
+	return watch(l, cc, params, handler, open, defaultWatchMinBackoff)
+}
+
+// changeStream is the part of *mongo.ChangeStream that watch reads from
+type changeStream interface {
+	Next(ctx context.Context) bool
+	Decode(v interface{}) error
+	ResumeToken() bson.Raw
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// watch runs the reconnect loop of Watch over the streams returned by open
+func watch(l log.Logger, cc context.Context, params *WatchParams, handler ChangeHandler, open func(cc context.Context, token bson.Raw) (changeStream, error), minBackoff time.Duration) error {
+	maxBackoff := params.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultWatchMaxBackoff
+	}
+	var token bson.Raw
+	if params.Checkpoints != nil {
+		t, err := params.Checkpoints.Load(cc, params.CheckpointKey)
+		if err != nil {
+			l.Error("unable to load checkpoint %v: %v", params.CheckpointKey, err)
+			return err
+		}
+		token = t
+	}
+
+	backoff := minBackoff
+	for {
+		stream, err := open(cc, token)
+		if err == nil {
+			var delivered, handled bool
+			token, delivered, handled, err = consume(l, cc, stream, params, handler, token)
+			if handled {
+				return err
+			}
+			// only a stream that actually delivered something counts as
+			// healthy, one that breaks right after opening keeps backing off
+			if delivered {
+				backoff = minBackoff
+			}
+		}
+		if cc.Err() != nil {
+			return cc.Err()
+		}
+		if isHistoryLost(err) {
+			l.Error("resume token for %v is no longer usable: %v", params.CheckpointKey, err)
+			return ResumeTokenLostError{CheckpointKey: params.CheckpointKey, Err: err}
+		}
+		l.Error("change stream on %v broke, reconnecting in %v: %v", params.Collection, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-cc.Done():
+			return cc.Err()
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// consume reads events until the stream breaks. delivered is true when at
+// least one event reached handler. handled is true when Watch must return
+// err as is, i.e. the handler or the checkpoint store failed
+func consume(l log.Logger, cc context.Context, stream changeStream, params *WatchParams, handler ChangeHandler, token bson.Raw) (bson.Raw, bool, bool, error) {
+	defer stream.Close(context.Background())
+	delivered := false
+	for stream.Next(cc) {
+		var event ChangeEvent
+		if err := stream.Decode(&event); err != nil {
+			l.Error("unable to decode change event: %v", err)
+			return token, delivered, true, err
+		}
+		if err := handler(cc, &event); err != nil {
+			return token, delivered, true, err
+		}
+		delivered = true
+		token = stream.ResumeToken()
+		if params.Checkpoints != nil {
+			if err := params.Checkpoints.Save(cc, params.CheckpointKey, token); err != nil {
+				l.Error("unable to save checkpoint %v: %v", params.CheckpointKey, err)
+				return token, delivered, true, err
+			}
+		}
+	}
+	err := stream.Err()
+	if err == nil {
+		// the stream was invalidated, e.g. the collection was dropped
+		err = errors.New("change stream closed")
+	}
+	return token, delivered, false, err
+}
+
+func isHistoryLost(err error) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && (se.HasErrorCode(changeStreamHistoryLostCode) || se.HasErrorCode(changeStreamFatalErrorCode))
+}
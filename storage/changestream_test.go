@@ -0,0 +1,158 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestMemoryCheckpointStore(t *testing.T) {
+	store := storage.NewMemoryCheckpointStore()
+	token, err := store.Load(context.Background(), "guests")
+	require.Nil(t, err)
+	require.Nil(t, token)
+
+	raw, err := bson.Marshal(bson.M{"_data": "826A"})
+	require.Nil(t, err)
+	require.Nil(t, store.Save(context.Background(), "guests", raw))
+	token, err = store.Load(context.Background(), "guests")
+	require.Nil(t, err)
+	require.Equal(t, bson.Raw(raw), token)
+}
+
+func TestChangeEventDecode(t *testing.T) {
+	type guest struct {
+		ID   string `bson:"_id"`
+		Name string `bson:"name"`
+	}
+	raw, err := bson.Marshal(bson.M{
+		"_id":           bson.M{"_data": "826A"},
+		"operationType": "insert",
+		"ns":            bson.M{"db": "kickback", "coll": "guests"},
+		"documentKey":   bson.M{"_id": "g1"},
+		"fullDocument":  bson.M{"_id": "g1", "name": "Ada"},
+	})
+	require.Nil(t, err)
+	var event storage.ChangeEvent
+	require.Nil(t, bson.Unmarshal(raw, &event))
+	require.Equal(t, "insert", event.OperationType)
+	require.Equal(t, "guests", event.Namespace.Collection)
+
+	var g guest
+	require.Nil(t, event.DecodeFullDocument(&g))
+	require.Equal(t, guest{ID: "g1", Name: "Ada"}, g)
+
+	var key guest
+	require.Nil(t, event.DecodeDocumentKey(&key))
+	require.Equal(t, "g1", key.ID)
+
+	event.FullDocument = nil
+	require.True(t, storage.IsNotFoundErr(event.DecodeFullDocument(&g)))
+}
+
+// fakeStream yields events and then fails with err
+type fakeStream struct {
+	events []bson.M
+	err    error
+	curr   bson.M
+}
+
+func (s *fakeStream) Next(ctx context.Context) bool {
+	if len(s.events) == 0 {
+		return false
+	}
+	s.curr, s.events = s.events[0], s.events[1:]
+	return true
+}
+
+func (s *fakeStream) Decode(v interface{}) error {
+	raw, err := bson.Marshal(s.curr)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+func (s *fakeStream) ResumeToken() bson.Raw {
+	raw, _ := bson.Marshal(s.curr["_id"])
+	return raw
+}
+
+func (s *fakeStream) Err() error                      { return s.err }
+func (s *fakeStream) Close(ctx context.Context) error { return nil }
+
+func changeEvent(id string) bson.M {
+	return bson.M{"_id": bson.M{"_data": id}, "operationType": "insert", "documentKey": bson.M{"_id": id}}
+}
+
+func TestWatchResumesAfterLastHandledEvent(t *testing.T) {
+	streams := []*fakeStream{
+		{events: []bson.M{changeEvent("g1")}, err: errors.New("connection reset")},
+		{events: []bson.M{changeEvent("g2")}},
+	}
+	var tokens []bson.Raw
+	open := func(cc context.Context, token bson.Raw) (storage.ChangeStream, error) {
+		tokens = append(tokens, token)
+		s := streams[0]
+		streams = streams[1:]
+		return s, nil
+	}
+	checkpoints := storage.NewMemoryCheckpointStore()
+	stop := errors.New("stop")
+	var handled []string
+	err := storage.WatchLoop(log.StdOutLogger{}, context.Background(), &storage.WatchParams{Checkpoints: checkpoints, CheckpointKey: "guests"}, func(cc context.Context, event *storage.ChangeEvent) error {
+		var key struct {
+			ID string `bson:"_id"`
+		}
+		require.Nil(t, event.DecodeDocumentKey(&key))
+		handled = append(handled, key.ID)
+		if key.ID == "g2" {
+			return stop
+		}
+		return nil
+	}, open, time.Millisecond)
+	require.Equal(t, stop, err, "handler errors stop Watch")
+	require.Equal(t, []string{"g1", "g2"}, handled)
+	require.Equal(t, 2, len(tokens))
+	require.Nil(t, tokens[0])
+	require.Equal(t, "g1", tokens[1].Lookup("_data").StringValue(), "reconnect resumes after the handled event")
+
+	saved, err := checkpoints.Load(context.Background(), "guests")
+	require.Nil(t, err)
+	require.Equal(t, "g1", saved.Lookup("_data").StringValue(), "failed events are not checkpointed")
+}
+
+func TestWatchBacksOffStreamsThatBreakRightAway(t *testing.T) {
+	opens := 0
+	open := func(cc context.Context, token bson.Raw) (storage.ChangeStream, error) {
+		opens++
+		return &fakeStream{err: errors.New("connection reset")}, nil
+	}
+	cc, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	err := storage.WatchLoop(log.StdOutLogger{}, cc, &storage.WatchParams{}, func(cc context.Context, event *storage.ChangeEvent) error {
+		return nil
+	}, open, 10*time.Millisecond)
+	require.Equal(t, context.DeadlineExceeded, err)
+	// 10, 20, 40 and 80ms apart; resetting after every open would allow ~15
+	require.LessOrEqual(t, opens, 5)
+}
+
+func TestWatchReportsLostResumeToken(t *testing.T) {
+	open := func(cc context.Context, token bson.Raw) (storage.ChangeStream, error) {
+		return &fakeStream{err: mongo.CommandError{Code: 286, Message: "resume point may no longer be in the oplog"}}, nil
+	}
+	err := storage.WatchLoop(log.StdOutLogger{}, context.Background(), &storage.WatchParams{CheckpointKey: "guests"}, func(cc context.Context, event *storage.ChangeEvent) error {
+		return nil
+	}, open, time.Millisecond)
+	var lost storage.ResumeTokenLostError
+	require.True(t, errors.As(err, &lost))
+	require.Equal(t, "guests", lost.CheckpointKey)
+}
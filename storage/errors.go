@@ -48,5 +48,120 @@ func isCollisionErr(err error) bool {
 			}
 		}
 	}
-	return false
+	// findAndModify style commands report duplicates as command errors
+	return mongo.IsDuplicateKeyError(err)
+}
+
+type InvalidPageTokenError struct {
+	Reason string
+}
+
+func (e InvalidPageTokenError) Error() string {
+	return "invalid page token: " + e.Reason
+}
+
+func (e InvalidPageTokenError) Code() int {
+	return http.StatusBadRequest
+}
+
+// BulkWriteError is returned alongside the BulkWriteResult when at least one
+// operation of a bulk write failed, or when the server could not satisfy the
+// write concern. In the latter case WriteConcern is set and the operations
+// may have been applied without being replicated as requested
+type BulkWriteError struct {
+	CollectionName string
+	Failed         int
+	Collisions     int
+	WriteConcern   error
+}
+
+func (e BulkWriteError) Error() string {
+	msg := fmt.Sprintf("%d operation(s) failed bulk writing into %s (%d collision(s))", e.Failed, e.CollectionName, e.Collisions)
+	if e.WriteConcern != nil {
+		msg += fmt.Sprintf(": write concern error: %v", e.WriteConcern)
+	}
+	return msg
+}
+
+func (e BulkWriteError) Code() int {
+	return http.StatusInternalServerError
+}
+
+// MigrationLockedError is returned by Migrate when another instance holds
+// the migration lock
+type MigrationLockedError struct{}
+
+func (e MigrationLockedError) Error() string {
+	return "migrations are locked by another instance"
+}
+
+func (e MigrationLockedError) Code() int {
+	return http.StatusConflict
+}
+
+// MigrationError wraps the error returned by a failed migration
+type MigrationError struct {
+	Version int
+	Err     error
+}
+
+func (e MigrationError) Error() string {
+	return fmt.Sprintf("migration %04d failed: %v", e.Version, e.Err)
+}
+
+func (e MigrationError) Unwrap() error {
+	return e.Err
+}
+
+func (e MigrationError) Code() int {
+	return http.StatusInternalServerError
+}
+
+// ConflictError is returned by a versioned update when the document no
+// longer is at ExpectedVersion
+type ConflictError struct {
+	CollectionName  string
+	ExpectedVersion int64
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("version conflict updating %s: expected version %d", e.CollectionName, e.ExpectedVersion)
+}
+
+func (e ConflictError) Code() int {
+	return http.StatusConflict
+}
+
+type InvalidIDError struct {
+	ID     string
+	Reason string
+}
+
+func (e InvalidIDError) Error() string {
+	return fmt.Sprintf("invalid id %q: %s", e.ID, e.Reason)
+}
+
+func (e InvalidIDError) Code() int {
+	return http.StatusBadRequest
+}
+
+// ResumeTokenLostError is returned by Watch when the stream can't be resumed
+// from the saved token, typically because the oplog rolled past it. Events
+// between the token and now are lost; save a nil token under CheckpointKey
+// to acknowledge that and watch from now on
+type ResumeTokenLostError struct {
+	CheckpointKey string
+	Err           error
+}
+
+func (e ResumeTokenLostError) Error() string {
+	return fmt.Sprintf("resume token of %s lost: %v", e.CheckpointKey, e.Err)
+}
+
+func (e ResumeTokenLostError) Unwrap() error {
+	return e.Err
+}
+
+func (e ResumeTokenLostError) Code() int {
+	return http.StatusInternalServerError
 }
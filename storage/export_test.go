@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// internals exercised by the storage_test package
+
+var RunTransaction = runTransaction
+
+func NewCursorDecoder(cc context.Context, cursor *mongo.Cursor) Decoder {
+	return cursorDecoder{ctx: cc, cursor: cursor}
+}
+
+var SingleResultDecoder = singleResultDecoder
+
+var NewBulkWriteResult = newBulkWriteResult
+
+var NewUpsertResult = newUpsertResult
+
+var BulkWriteFailure = bulkWriteFailure
+
+type ChangeStream = changeStream
+
+var WatchLoop = watch
+
+type ExistingIndex = existingIndex
+
+var DiffIndexes = diffIndexes
+
+var SameIndex = sameIndex
+
+var KeepLockAlive = keepLockAlive
+
+var WithVersionInc = withVersionInc
+
+var VersionedUpdate = versionedUpdate
+
+func (mc *mongoClient) LivePipeline(collection string, pipeline interface{}, includeDeleted bool) (interface{}, error) {
+	return mc.livePipeline(collection, pipeline, includeDeleted)
+}
+
+func (mc *mongoClient) LiveModel(m WriteModel, params *BulkWriteParams) WriteModel {
+	return mc.liveModel(m, params)
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	idAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	// sortableAlphabet is Crockford's base32, which keeps the lexical order
+	// of encoded IDs the same as the order of their bytes
+	sortableAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+	// SortableIDLength is the length of a sortable ID without its prefix:
+	// 10 characters of millisecond timestamp and 16 of randomness
+	SortableIDLength = 26
+	sortableTimeLen  = 10
+	maxSortableTime  = 1<<48 - 1
+)
+
+// GenerateID allows us to easily generate a new ID. If we want to
+// make a new userId, we can call storage.GenerateID("USR_", 15) or something of the like.
+// The random part is read from crypto/rand, so IDs are unpredictable and
+// safe to generate from any goroutine
+func GenerateID(prefix string, length int) string {
+	return prefix + randomString(length)
+}
+
+// randomString draws n characters of idAlphabet. Bytes past the largest
+// multiple of the alphabet size are rejected so every character is equally
+// likely
+func randomString(n int) string {
+	const limit = 256 - 256%len(idAlphabet)
+	out := make([]byte, 0, n)
+	buf := make([]byte, n+n/4+1)
+	for len(out) < n {
+		readRandom(buf)
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			out = append(out, idAlphabet[int(b)%len(idAlphabet)])
+			if len(out) == n {
+				break
+			}
+		}
+	}
+	return string(out)
+}
+
+// readRandom panics when the system's secure random source is unavailable:
+// falling back to anything weaker would silently hand out guessable IDs
+func readRandom(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("storage: unable to read random bytes: %v", err))
+	}
+}
+
+// sortableSource hands out strictly increasing IDs within the process, even
+// for IDs made in the same millisecond or while the clock steps back
+type sortableSource struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	lastRnd [10]byte
+}
+
+var sortableIDs sortableSource
+
+func (s *sortableSource) next(now time.Time) (uint64, [10]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := uint64(now.UnixMilli())
+	if ms > s.lastMs {
+		s.lastMs = ms
+		readRandom(s.lastRnd[:])
+		return s.lastMs, s.lastRnd
+	}
+	// same millisecond (or an earlier one): increment the random part so
+	// the new ID still sorts after the previous one
+	for i := len(s.lastRnd) - 1; i >= 0; i-- {
+		s.lastRnd[i]++
+		if s.lastRnd[i] != 0 {
+			return s.lastMs, s.lastRnd
+		}
+	}
+	s.lastMs++
+	readRandom(s.lastRnd[:])
+	return s.lastMs, s.lastRnd
+}
+
+// NewSortableID generates a ULID style ID: prefix followed by 26 characters
+// encoding the current time in milliseconds and 80 random bits. IDs sharing
+// a prefix sort by creation time, both as strings and as mongo _ids
+func NewSortableID(prefix string) string {
+	ms, rnd := sortableIDs.next(time.Now())
+	return prefix + encodeSortable(ms, rnd)
+}
+
+func encodeSortable(ms uint64, rnd [10]byte) string {
+	var b [16]byte
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	copy(b[6:], rnd[:])
+
+	// 128 bits make 26 characters of 5 bits, the first one only holding 3
+	out := make([]byte, SortableIDLength)
+	for i := SortableIDLength - 1; i >= 0; i-- {
+		out[i] = sortableAlphabet[b[15]&31]
+		shiftRight5(&b)
+	}
+	return string(out)
+}
+
+func shiftRight5(b *[16]byte) {
+	for i := len(b) - 1; i > 0; i-- {
+		b[i] = b[i]>>5 | b[i-1]<<3
+	}
+	b[0] >>= 5
+}
+
+// ParsedID is an ID split into its parts. Time is only set for sortable IDs
+type ParsedID struct {
+	Prefix string
+	Body   string
+	Time   time.Time
+}
+
+// ParseSortableID splits an ID made by NewSortableID into its prefix and
+// body and decodes the time it was generated at. It returns an
+// InvalidIDError when the last 26 characters are not a valid sortable ID
+func ParseSortableID(id string) (*ParsedID, error) {
+	if len(id) < SortableIDLength {
+		return nil, InvalidIDError{ID: id, Reason: fmt.Sprintf("shorter than %d characters", SortableIDLength)}
+	}
+	split := len(id) - SortableIDLength
+	body := id[split:]
+	var ms uint64
+	for i := 0; i < len(body); i++ {
+		v := strings.IndexByte(sortableAlphabet, body[i])
+		if v < 0 {
+			return nil, InvalidIDError{ID: id, Reason: fmt.Sprintf("unexpected character %q", body[i])}
+		}
+		if i < sortableTimeLen {
+			ms = ms<<5 | uint64(v)
+		}
+	}
+	if ms > maxSortableTime {
+		return nil, InvalidIDError{ID: id, Reason: "timestamp out of range"}
+	}
+	return &ParsedID{Prefix: id[:split], Body: body, Time: time.UnixMilli(int64(ms)).UTC()}, nil
+}
+
+// ParseID splits an ID made by GenerateID into prefix and body, checking
+// that the body has the given length and only uses ID characters. The
+// returned Time is always zero: these IDs don't carry one
+func ParseID(id, prefix string, length int) (*ParsedID, error) {
+	if !strings.HasPrefix(id, prefix) {
+		return nil, InvalidIDError{ID: id, Reason: fmt.Sprintf("missing %q prefix", prefix)}
+	}
+	body := id[len(prefix):]
+	if len(body) != length {
+		return nil, InvalidIDError{ID: id, Reason: fmt.Sprintf("expected %d characters after the prefix, got %d", length, len(body))}
+	}
+	for i := 0; i < len(body); i++ {
+		if strings.IndexByte(idAlphabet, body[i]) < 0 {
+			return nil, InvalidIDError{ID: id, Reason: fmt.Sprintf("unexpected character %q", body[i])}
+		}
+	}
+	return &ParsedID{Prefix: prefix, Body: body}, nil
+}
+
+// ValidID reports whether id was made by GenerateID(prefix, length)
+func ValidID(id, prefix string, length int) bool {
+	_, err := ParseID(id, prefix, length)
+	return err == nil
+}
+
+// ValidSortableID reports whether id was made by NewSortableID(prefix)
+func ValidSortableID(id, prefix string) bool {
+	parsed, err := ParseSortableID(id)
+	return err == nil && parsed.Prefix == prefix
+}
@@ -0,0 +1,87 @@
+package storage_test
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateID(t *testing.T) {
+	seen := map[string]bool{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				id := storage.GenerateID("USR_", 15)
+				mu.Lock()
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, seen, 4000, "ids generated concurrently are unique")
+
+	for id := range seen {
+		require.True(t, storage.ValidID(id, "USR_", 15), id)
+		break
+	}
+}
+
+func TestParseID(t *testing.T) {
+	parsed, err := storage.ParseID("EVT_abc123XYZ", "EVT_", 9)
+	require.Nil(t, err)
+	require.Equal(t, "EVT_", parsed.Prefix)
+	require.Equal(t, "abc123XYZ", parsed.Body)
+	require.True(t, parsed.Time.IsZero())
+
+	for _, id := range []string{"USR_abc123XYZ", "EVT_abc123XY", "EVT_abc-23XYZ"} {
+		_, err := storage.ParseID(id, "EVT_", 9)
+		require.IsType(t, storage.InvalidIDError{}, err, id)
+	}
+}
+
+func TestSortableID(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	ids := make([]string, 1000)
+	for i := range ids {
+		ids[i] = storage.NewSortableID("EVT_")
+	}
+	require.True(t, sort.StringsAreSorted(ids), "ids made in the same millisecond still sort in order")
+	for i := 1; i < len(ids); i++ {
+		require.NotEqual(t, ids[i-1], ids[i])
+	}
+
+	parsed, err := storage.ParseSortableID(ids[0])
+	require.Nil(t, err)
+	require.Equal(t, "EVT_", parsed.Prefix)
+	require.Len(t, parsed.Body, storage.SortableIDLength)
+	require.False(t, parsed.Time.Before(before))
+	require.False(t, parsed.Time.After(time.Now()))
+	require.True(t, storage.ValidSortableID(ids[0], "EVT_"))
+	require.False(t, storage.ValidSortableID(ids[0], "USR_"))
+
+	later := storage.NewSortableID("EVT_")
+	time.Sleep(2 * time.Millisecond)
+	require.Less(t, later, storage.NewSortableID("EVT_"))
+}
+
+func TestParseSortableIDRejectsInvalid(t *testing.T) {
+	valid := storage.NewSortableID("")
+	for _, id := range []string{
+		"short",
+		strings.Replace(valid, valid[12:13], "U", 1), // U is not in Crockford's alphabet
+		"8" + valid[1:], // past the 48 bit timestamp
+	} {
+		_, err := storage.ParseSortableID(id)
+		require.IsType(t, storage.InvalidIDError{}, err, id)
+	}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Iterator streams the documents of a query one at a time instead of
+// loading all of them into memory. It must be closed once the caller is done
+// with it; Each does so automatically
+//
+//	it, err := mc.Iterate(l, cc, &storage.FindManyParams{...})
+//	if err != nil {...}
+//	defer it.Close()
+//	for it.Next() {
+//		var e Event
+//		if err := it.Decode(&e); err != nil {...}
+//	}
+//	if err := it.Err(); err != nil {...}
+type Iterator interface {
+	Next() bool
+	Decode(v interface{}) error
+	Err() error
+	Close() error
+}
+
+type cursorIterator struct {
+	ctx    context.Context
+	cursor *mongo.Cursor
+	err    error
+}
+
+// Next advances the cursor, fetching the next batch when the current one is
+// exhausted. It stops as soon as the call context is done, even if the
+// current batch still holds documents
+func (ci *cursorIterator) Next() bool {
+	if ci.err != nil {
+		return false
+	}
+	if err := ci.ctx.Err(); err != nil {
+		ci.err = err
+		return false
+	}
+	return ci.cursor.Next(ci.ctx)
+}
+
+func (ci *cursorIterator) Decode(v interface{}) error {
+	return ci.cursor.Decode(v)
+}
+
+func (ci *cursorIterator) Err() error {
+	if ci.err != nil {
+		return ci.err
+	}
+	return ci.cursor.Err()
+}
+
+// Close kills the server side cursor. It uses its own context so that the
+// cursor is released even when the call context has been cancelled
+func (ci *cursorIterator) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	return ci.cursor.Close(ctx)
+}
+
+// Iterate runs the same query as FindMany but returns an Iterator over the
+// results. Set BatchSize on the params to control how many documents are
+// fetched per round trip
+func (mc *mongoClient) Iterate(l log.Logger, cc context.Context, params *FindManyParams) (Iterator, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+	cursor, err := collection.Find(mc.context(cc), filter, params.findOptions()...)
+	if err != nil {
+		l.Error("unable to find docs in %v: %v", params.Collection, err)
+		return nil, err
+	}
+	return &cursorIterator{
+		ctx:    mc.context(cc),
+		cursor: cursor,
+	}, nil
+}
+
+func (fmp *FindManyParams) findOptions() []*options.FindOptions {
+	if fmp.BatchSize <= 0 {
+		return fmp.AdditionalOpts
+	}
+	return append([]*options.FindOptions{options.Find().SetBatchSize(fmp.BatchSize)}, fmp.AdditionalOpts...)
+}
+
+// Each decodes every document of it into a T and hands it to fn. It stops
+// at the first error, either from decoding or returned by fn, and always
+// closes the iterator
+func Each[T any](it Iterator, fn func(T) error) error {
+	defer it.Close()
+	for it.Next() {
+		var v T
+		if err := it.Decode(&v); err != nil {
+			return err
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
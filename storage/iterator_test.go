@@ -0,0 +1,62 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+)
+
+type guest struct {
+	Name string `json:"name"`
+}
+
+func TestEach(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		Responses: []interface{}{`[{"name": "a"}, {"name": "b"}, {"name": "c"}]`},
+	}
+	it, err := mm.Iterate(log.StdOutLogger{}, context.Background(), &storage.FindManyParams{Collection: "guests", Filter: map[string]interface{}{}})
+	require.Nil(t, err, "iterate err should be nil")
+	names := []string{}
+	err = storage.Each(it, func(g guest) error {
+		names = append(names, g.Name)
+		return nil
+	})
+	require.Nil(t, err, "each err should be nil")
+	require.Equal(t, []string{"a", "b", "c"}, names)
+}
+
+func TestEachStopsOnCallbackError(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		Responses: []interface{}{[]guest{{Name: "a"}, {Name: "b"}}},
+	}
+	it, _ := mm.Iterate(log.StdOutLogger{}, context.Background(), &storage.FindManyParams{Collection: "guests", Filter: map[string]interface{}{}})
+	stop := errors.New("stop")
+	calls := 0
+	err := storage.Each(it, func(g guest) error {
+		calls++
+		return stop
+	})
+	require.Equal(t, stop, err, "err check")
+	require.Equal(t, 1, calls, "call count")
+}
+
+func TestEachStopsOnCancel(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		Responses: []interface{}{[]guest{{Name: "a"}, {Name: "b"}}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	it, _ := mm.Iterate(log.StdOutLogger{}, ctx, &storage.FindManyParams{Collection: "guests", Filter: map[string]interface{}{}})
+	calls := 0
+	err := storage.Each(it, func(g guest) error {
+		calls++
+		cancel()
+		return nil
+	})
+	require.Equal(t, context.Canceled, err, "err check")
+	require.Equal(t, 1, calls, "call count")
+}
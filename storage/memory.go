@@ -0,0 +1,1011 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type memoryState struct {
+	mu          sync.Mutex
+	txMu        sync.Mutex
+	collections map[string][]bson.M
+	indexes     map[string][]IndexSpec
+	softDelete  map[string]bool
+}
+
+type memoryManager struct {
+	state   *memoryState
+	journal *txJournal
+}
+
+// txJournal keeps the original of every document a transaction touched so
+// that a rollback undoes its writes and nothing else. It is guarded by mu
+type txJournal struct {
+	touched []touchedDoc
+	seen    map[string]bool
+}
+
+type touchedDoc struct {
+	collection string
+	id         interface{}
+	// original is nil for a document the transaction inserted
+	original bson.M
+	pos      int
+}
+
+// touch records doc, stored at position pos, before its first change. The
+// caller must hold mu
+func (m *memoryManager) touch(collection string, doc bson.M, pos int, inserted bool) {
+	if m.journal == nil {
+		return
+	}
+	key := collection + "|" + fmt.Sprint(doc["_id"])
+	if m.journal.seen[key] {
+		return
+	}
+	m.journal.seen[key] = true
+	td := touchedDoc{collection: collection, id: doc["_id"], pos: pos}
+	if !inserted {
+		// stored documents are only ever changed at the top level
+		td.original = bson.M{}
+		for k, v := range doc {
+			td.original[k] = v
+		}
+	}
+	m.journal.touched = append(m.journal.touched, td)
+}
+
+// rollback puts back the originals of the touched documents. The caller
+// must hold mu
+func (m *memoryManager) rollback() {
+	var missing []touchedDoc
+	for _, td := range m.journal.touched {
+		i := m.position(td.collection, td.id)
+		switch {
+		case td.original == nil && i >= 0:
+			m.removeAt(td.collection, []int{i})
+		case td.original != nil && i >= 0:
+			m.state.collections[td.collection][i] = td.original
+		case td.original != nil:
+			missing = append(missing, td)
+		}
+	}
+	// deleted documents go back where they were, as far as possible
+	sort.SliceStable(missing, func(i, j int) bool { return missing[i].pos < missing[j].pos })
+	for _, td := range missing {
+		docs := m.state.collections[td.collection]
+		pos := td.pos
+		if pos > len(docs) {
+			pos = len(docs)
+		}
+		docs = append(docs, nil)
+		copy(docs[pos+1:], docs[pos:])
+		docs[pos] = td.original
+		m.state.collections[td.collection] = docs
+	}
+}
+
+// position returns where the document with the given _id is stored, or -1.
+// The caller must hold mu
+func (m *memoryManager) position(collection string, id interface{}) int {
+	for i, doc := range m.state.collections[collection] {
+		if compareValues(doc["_id"], id) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// NewMemoryManager returns a Manager that keeps documents in memory and
+// evaluates filters, updates, sorts and limits the way mongo does, for use
+// in tests. Unique indexes passed in (and the _id of every collection) are
+// enforced with a CollisionError. Projections, Watch and most aggregation
+// stages are not supported
+func NewMemoryManager(indexes ...IndexSpec) *memoryManager {
+	state := &memoryState{
+		collections: map[string][]bson.M{},
+		indexes:     map[string][]IndexSpec{},
+		softDelete:  map[string]bool{},
+	}
+	for _, is := range indexes {
+		if is.Unique {
+			state.indexes[is.Collection] = append(state.indexes[is.Collection], is)
+		}
+	}
+	return &memoryManager{state: state}
+}
+
+// EnableSoftDelete behaves like the one of the mongo client
+func (m *memoryManager) EnableSoftDelete(collections ...string) *memoryManager {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	for _, c := range collections {
+		m.state.softDelete[c] = true
+	}
+	return m
+}
+
+type memoryDecoder struct {
+	docs   []bson.M
+	single bool
+}
+
+func (md memoryDecoder) Decode(v interface{}) error {
+	if !md.single {
+		return decodeDocs(md.docs, v)
+	}
+	raw, err := bson.Marshal(md.docs[0])
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+type memoryIterator struct {
+	ctx  context.Context
+	docs []bson.M
+	curr bson.M
+	err  error
+}
+
+func (mi *memoryIterator) Next() bool {
+	if mi.err != nil {
+		return false
+	}
+	if err := mi.ctx.Err(); err != nil {
+		mi.err = err
+		return false
+	}
+	if len(mi.docs) == 0 {
+		return false
+	}
+	mi.curr, mi.docs = mi.docs[0], mi.docs[1:]
+	return true
+}
+
+func (mi *memoryIterator) Decode(v interface{}) error {
+	raw, err := bson.Marshal(mi.curr)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+func (mi *memoryIterator) Err() error   { return mi.err }
+func (mi *memoryIterator) Close() error { return nil }
+
+// query describes a read: which documents, in which order, how many
+type query struct {
+	collection     string
+	filter         interface{}
+	includeDeleted bool
+	sort           interface{}
+	skip           int64
+	limit          int64
+}
+
+// find returns copies of the matching documents. The caller must hold mu
+func (m *memoryManager) find(q query) ([]bson.M, error) {
+	idxs, err := m.matching(q.collection, q.filter, q.includeDeleted, q.sort)
+	if err != nil {
+		return nil, err
+	}
+	if q.skip > 0 {
+		if q.skip >= int64(len(idxs)) {
+			idxs = nil
+		} else {
+			idxs = idxs[q.skip:]
+		}
+	}
+	if q.limit > 0 && int64(len(idxs)) > q.limit {
+		idxs = idxs[:q.limit]
+	}
+	docs := make([]bson.M, 0, len(idxs))
+	for _, i := range idxs {
+		doc, err := normalizeDoc(m.state.collections[q.collection][i])
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// matching returns the positions of the documents matching filter, in sort
+// order. The caller must hold mu
+func (m *memoryManager) matching(collection string, filter interface{}, includeDeleted bool, sortSpec interface{}) ([]int, error) {
+	f, err := normalizeDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := normalizeSort(sortSpec)
+	if err != nil {
+		return nil, err
+	}
+	hideDeleted := m.state.softDelete[collection] && !includeDeleted
+	docs := m.state.collections[collection]
+	idxs := []int{}
+	for i, doc := range docs {
+		if _, deleted := doc[DeletedAtField]; hideDeleted && deleted {
+			continue
+		}
+		ok, err := matches(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			idxs = append(idxs, i)
+		}
+	}
+	if len(spec) > 0 {
+		sort.SliceStable(idxs, func(i, j int) bool {
+			return lessBySpec(docs[idxs[i]], docs[idxs[j]], spec)
+		})
+	}
+	return idxs, nil
+}
+
+// checkUnique returns a CollisionError when doc, about to be stored at
+// position skip (-1 for a new document), clashes with another document on
+// _id or on a unique index. The caller must hold mu
+func (m *memoryManager) checkUnique(collection string, doc bson.M, skip int) error {
+	for i, other := range m.state.collections[collection] {
+		if i == skip {
+			continue
+		}
+		if compareValues(doc["_id"], other["_id"]) == 0 {
+			return CollisionError{CollectionName: collection}
+		}
+		for _, spec := range m.state.indexes[collection] {
+			if collides(spec, doc, other) {
+				return CollisionError{CollectionName: collection}
+			}
+		}
+	}
+	return nil
+}
+
+func collides(spec IndexSpec, a, b bson.M) bool {
+	if spec.PartialFilter != nil {
+		pf, err := normalizeDoc(spec.PartialFilter)
+		if err != nil {
+			return false
+		}
+		okA, _ := matches(a, pf)
+		okB, _ := matches(b, pf)
+		if !okA || !okB {
+			return false
+		}
+	}
+	ka, okA := indexKey(a, spec)
+	kb, okB := indexKey(b, spec)
+	return okA && okB && compareValues(ka, kb) == 0
+}
+
+// insert stores a new document. The caller must hold mu
+func (m *memoryManager) insert(collection string, document interface{}) (interface{}, error) {
+	doc, err := normalizeDoc(document)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	if err := m.checkUnique(collection, doc, -1); err != nil {
+		return nil, err
+	}
+	m.touch(collection, doc, len(m.state.collections[collection]), true)
+	m.state.collections[collection] = append(m.state.collections[collection], doc)
+	return doc["_id"], nil
+}
+
+// replaceAt swaps the document at position i for doc once it passed the
+// unique checks. The caller must hold mu
+func (m *memoryManager) replaceAt(collection string, i int, doc bson.M) error {
+	if err := m.checkUnique(collection, doc, i); err != nil {
+		return err
+	}
+	m.touch(collection, m.state.collections[collection][i], i, false)
+	m.state.collections[collection][i] = doc
+	return nil
+}
+
+func (m *memoryManager) removeAt(collection string, idxs []int) {
+	drop := map[int]bool{}
+	for _, i := range idxs {
+		m.touch(collection, m.state.collections[collection][i], i, false)
+		drop[i] = true
+	}
+	kept := []bson.M{}
+	for i, doc := range m.state.collections[collection] {
+		if !drop[i] {
+			kept = append(kept, doc)
+		}
+	}
+	m.state.collections[collection] = kept
+}
+
+// update applies update to the documents matching filter and
+// inserts a new one when nothing matched and upsert is set. The caller must
+// hold mu
+func (m *memoryManager) update(collection string, filter interface{}, update interface{}, multiple, upsert, includeDeleted bool, sortSpec interface{}) (*UpsertResult, []bson.M, []bson.M, error) {
+	u, err := normalizeDoc(update)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	idxs, err := m.matching(collection, filter, includeDeleted, sortSpec)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !multiple && len(idxs) > 1 {
+		idxs = idxs[:1]
+	}
+	res := &UpsertResult{}
+	var before, after []bson.M
+	for _, i := range idxs {
+		curr := m.state.collections[collection][i]
+		updated, err := normalizeDoc(curr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := applyUpdate(updated, u, false); err != nil {
+			return nil, nil, nil, err
+		}
+		res.MatchedCount++
+		if compareValues(curr, updated) != 0 {
+			if err := m.replaceAt(collection, i, updated); err != nil {
+				return nil, nil, nil, err
+			}
+			res.ModifiedCount++
+		}
+		before, after = append(before, curr), append(after, updated)
+	}
+	if len(idxs) > 0 || !upsert {
+		return res, before, after, nil
+	}
+	f, err := normalizeDoc(filter)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	doc, err := seedFromFilter(f)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := applyUpdate(doc, u, true); err != nil {
+		return nil, nil, nil, err
+	}
+	id, err := m.insert(collection, doc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	res.UpsertedCount, res.UpsertedID = 1, id
+	return res, nil, []bson.M{m.state.collections[collection][len(m.state.collections[collection])-1]}, nil
+}
+
+// replace swaps the first document matching filter for replacement,
+// keeping its _id. The caller must hold mu
+func (m *memoryManager) replace(collection string, filter, replacement interface{}, upsert, includeDeleted bool, sortSpec interface{}) (before, after bson.M, err error) {
+	doc, err := normalizeDoc(replacement)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := isOperatorDoc(doc); ok {
+		return nil, nil, errors.New("replacement document must not contain update operators")
+	}
+	idxs, err := m.matching(collection, filter, includeDeleted, sortSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(idxs) == 0 {
+		if !upsert {
+			return nil, nil, nil
+		}
+		if _, ok := doc["_id"]; !ok {
+			f, err := normalizeDoc(filter)
+			if err != nil {
+				return nil, nil, err
+			}
+			if id, ok := f["_id"]; ok {
+				if _, isOps := isOperatorDoc(id); !isOps {
+					doc["_id"] = id
+				}
+			}
+		}
+		if _, err := m.insert(collection, doc); err != nil {
+			return nil, nil, err
+		}
+		return nil, doc, nil
+	}
+	curr := m.state.collections[collection][idxs[0]]
+	if id, ok := doc["_id"]; ok && compareValues(id, curr["_id"]) != 0 {
+		return nil, nil, errors.New("the _id field is immutable")
+	}
+	doc["_id"] = curr["_id"]
+	if err := m.replaceAt(collection, idxs[0], doc); err != nil {
+		return nil, nil, err
+	}
+	return curr, doc, nil
+}
+
+// remove deletes, or soft deletes, the documents matching filter. The
+// caller must hold mu
+func (m *memoryManager) remove(collection string, filter interface{}, multiple, hard bool, deletedBy string) (int64, error) {
+	soft := m.state.softDelete[collection] && !hard
+	idxs, err := m.matching(collection, filter, !soft, nil)
+	if err != nil {
+		return 0, err
+	}
+	if !multiple && len(idxs) > 1 {
+		idxs = idxs[:1]
+	}
+	if !soft {
+		m.removeAt(collection, idxs)
+		return int64(len(idxs)), nil
+	}
+	now := time.Now().UTC()
+	for _, i := range idxs {
+		m.markDeleted(collection, i, deletedBy, now)
+	}
+	return int64(len(idxs)), nil
+}
+
+// markDeleted soft deletes the document at position i. The caller must
+// hold mu
+func (m *memoryManager) markDeleted(collection string, i int, deletedBy string, at time.Time) {
+	doc := m.state.collections[collection][i]
+	m.touch(collection, doc, i, false)
+	doc[DeletedAtField] = primitive.NewDateTimeFromTime(at)
+	doc[DeletedByField] = deletedBy
+}
+
+func (m *memoryManager) FindOne(l log.Logger, cc context.Context, params *FindOneParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	opts := options.MergeFindOneOptions(params.AdditionalOpts...)
+	q := query{collection: params.Collection, filter: params.Filter, includeDeleted: params.IncludeDeleted, sort: opts.Sort, limit: 1}
+	if opts.Skip != nil {
+		q.skip = *opts.Skip
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	docs, err := m.find(q)
+	if err != nil {
+		l.Error("error finding doc in %s: %v", params.Collection, err)
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, NotFoundError{}
+	}
+	return memoryDecoder{docs: docs, single: true}, nil
+}
+
+func (m *memoryManager) findMany(l log.Logger, params *FindManyParams) ([]bson.M, error) {
+	opts := options.MergeFindOptions(params.AdditionalOpts...)
+	q := query{collection: params.Collection, filter: params.Filter, includeDeleted: params.IncludeDeleted, sort: opts.Sort}
+	if opts.Skip != nil {
+		q.skip = *opts.Skip
+	}
+	if opts.Limit != nil {
+		q.limit = *opts.Limit
+		if q.limit < 0 {
+			q.limit = -q.limit
+		}
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	docs, err := m.find(q)
+	if err != nil {
+		l.Error("unable to find docs in %v: %v", params.Collection, err)
+	}
+	return docs, err
+}
+
+func (m *memoryManager) FindMany(l log.Logger, cc context.Context, params *FindManyParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	docs, err := m.findMany(l, params)
+	if err != nil {
+		return nil, err
+	}
+	return memoryDecoder{docs: docs}, nil
+}
+
+func (m *memoryManager) Iterate(l log.Logger, cc context.Context, params *FindManyParams) (Iterator, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	docs, err := m.findMany(l, params)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryIterator{ctx: cc, docs: docs}, nil
+}
+
+// Aggregate supports pipelines made of $match, $sort, $skip, $limit and
+// $count stages
+func (m *memoryManager) Aggregate(l log.Logger, cc context.Context, params *AggregateParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	var pipeline struct {
+		Stages []bson.M `bson:"stages"`
+	}
+	raw, err := bson.Marshal(bson.M{"stages": params.Pipeline})
+	if err == nil {
+		err = bson.Unmarshal(raw, &pipeline)
+	}
+	if err != nil {
+		l.Error("invalid pipeline: %v", err)
+		return nil, err
+	}
+	m.state.mu.Lock()
+	docs, err := m.find(query{collection: params.Collection, filter: bson.M{}, includeDeleted: params.IncludeDeleted})
+	m.state.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, stage := range pipeline.Stages {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage must have exactly one field")
+		}
+		for op, arg := range stage {
+			if docs, err = runStage(docs, op, arg); err != nil {
+				l.Error("unable to aggregate docs in %v: %v", params.Collection, err)
+				return nil, err
+			}
+		}
+	}
+	return memoryDecoder{docs: docs}, nil
+}
+
+func runStage(docs []bson.M, op string, arg interface{}) ([]bson.M, error) {
+	switch op {
+	case "$match":
+		f, ok := arg.(bson.M)
+		if !ok {
+			return nil, errors.New("$match needs a document")
+		}
+		kept := []bson.M{}
+		for _, doc := range docs {
+			ok, err := matches(doc, f)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				kept = append(kept, doc)
+			}
+		}
+		return kept, nil
+	case "$sort":
+		spec, err := normalizeSort(arg)
+		if err != nil {
+			return nil, err
+		}
+		sortDocs(docs, spec)
+		return docs, nil
+	case "$skip", "$limit":
+		n, ok := toFloat(arg)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("%s needs a positive number", op)
+		}
+		if op == "$skip" {
+			if int(n) >= len(docs) {
+				return []bson.M{}, nil
+			}
+			return docs[int(n):], nil
+		}
+		if int(n) < len(docs) {
+			return docs[:int(n)], nil
+		}
+		return docs, nil
+	case "$count":
+		field, ok := arg.(string)
+		if !ok {
+			return nil, errors.New("$count needs a field name")
+		}
+		if len(docs) == 0 {
+			return []bson.M{}, nil
+		}
+		return []bson.M{{field: int32(len(docs))}}, nil
+	}
+	return nil, fmt.Errorf("unsupported pipeline stage %s", op)
+}
+
+func (m *memoryManager) InsertOne(l log.Logger, cc context.Context, document interface{}, params *InsertOneParams) (interface{}, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	id, err := m.insert(params.Collection, document)
+	if err != nil {
+		l.Error("unable to insert document into %v: %v", params.Collection, err)
+		return nil, err
+	}
+	return id, nil
+}
+
+// InsertMany is ordered: it stops at the first failure, leaving the
+// documents before it inserted
+func (m *memoryManager) InsertMany(l log.Logger, cc context.Context, data []interface{}, params *InsertManyParams) (interface{}, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	ids := []interface{}{}
+	for _, document := range data {
+		id, err := m.insert(params.Collection, document)
+		if err != nil {
+			l.Error("unable to insert many into %v: %v", params.Collection, err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m *memoryManager) Upsert(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (int64, error) {
+	res, err := m.UpsertWithResult(l, cc, updates, params)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (m *memoryManager) UpsertWithResult(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (*UpsertResult, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	updateCmd := updates
+	if params.Generic {
+		updateCmd = bson.D{{Key: "$set", Value: updates}}
+	}
+	filter := params.Filter
+	upsert := true
+	if params.Upsert != nil {
+		upsert = *params.Upsert
+	}
+	if params.ExpectedVersion != nil {
+		field := params.VersionField
+		if field == "" {
+			field = DefaultVersionField
+		}
+		var err error
+		if updateCmd, err = withVersionInc(updateCmd, field); err != nil {
+			return nil, err
+		}
+		filter = bson.D{{Key: "$and", Value: bson.A{params.Filter, bson.D{{Key: field, Value: *params.ExpectedVersion}}}}}
+		upsert = false
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	res, _, _, err := m.update(params.Collection, filter, updateCmd, params.Multiple, upsert, params.IncludeDeleted, nil)
+	if err != nil {
+		l.Error("unable to update doc(s) in %v: %v", params.Collection, err)
+		return nil, err
+	}
+	if params.ExpectedVersion != nil && res.MatchedCount == 0 {
+		idxs, err := m.matching(params.Collection, params.Filter, params.IncludeDeleted, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(idxs) == 0 {
+			return nil, NotFoundError{}
+		}
+		return nil, ConflictError{CollectionName: params.Collection, ExpectedVersion: *params.ExpectedVersion}
+	}
+	return res, nil
+}
+
+func (m *memoryManager) Delete(l log.Logger, cc context.Context, params *DeleteParams) (int64, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return 0, MissingRequiredParameterError{}
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	n, err := m.remove(params.Collection, params.Filter, params.Multiple, params.Hard, params.DeletedBy)
+	if err != nil {
+		l.Error("unable to delete doc(s) in %v: %v", params.Collection, err)
+	}
+	return n, err
+}
+
+func (m *memoryManager) Restore(l log.Logger, cc context.Context, params *RestoreParams) (int64, error) {
+	if ok := params.valid(); !ok || !m.state.softDelete[params.Collection] {
+		l.Error("invalid parameters")
+		return 0, MissingRequiredParameterError{}
+	}
+	filter := bson.D{{Key: "$and", Value: bson.A{params.Filter, bson.D{{Key: DeletedAtField, Value: bson.D{{Key: "$exists", Value: true}}}}}}}
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: DeletedAtField, Value: ""}, {Key: DeletedByField, Value: ""}}}}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	res, _, _, err := m.update(params.Collection, filter, update, params.Multiple, false, true, nil)
+	if err != nil {
+		l.Error("unable to restore doc(s) in %v: %v", params.Collection, err)
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (m *memoryManager) PurgeDeleted(l log.Logger, cc context.Context, params *PurgeParams) (int64, error) {
+	if ok := params.valid(); !ok || !m.state.softDelete[params.Collection] {
+		l.Error("invalid parameters")
+		return 0, MissingRequiredParameterError{}
+	}
+	cutoff := time.Now().UTC().Add(-params.OlderThan)
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	return m.remove(params.Collection, bson.D{{Key: DeletedAtField, Value: bson.D{{Key: "$lt", Value: cutoff}}}}, true, true, "")
+}
+
+func (m *memoryManager) BulkWrite(l log.Logger, cc context.Context, models []WriteModel, params *BulkWriteParams) (*BulkWriteResult, error) {
+	if ok := params.valid(); !ok || len(models) == 0 {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	result := newBulkWriteResult(len(models), nil)
+	failed := 0
+	for i, model := range models {
+		op := &result.Operations[i]
+		if failed > 0 && !params.Unordered {
+			op.Status = BulkOpSkipped
+			continue
+		}
+		var err error
+		switch mdl := model.(type) {
+		case InsertModel:
+			if _, err = m.insert(params.Collection, mdl.Document); err == nil {
+				result.InsertedCount++
+			}
+		case UpdateModel:
+			update := mdl.Update
+			if mdl.Generic {
+				update = bson.D{{Key: "$set", Value: mdl.Update}}
+			}
+			var res *UpsertResult
+			if res, _, _, err = m.update(params.Collection, mdl.Filter, update, mdl.Multiple, mdl.Upsert, params.IncludeDeleted, nil); err == nil {
+				result.MatchedCount += res.MatchedCount
+				result.ModifiedCount += res.ModifiedCount
+				result.UpsertedCount += res.UpsertedCount
+				op.UpsertedID = res.UpsertedID
+			}
+		case ReplaceModel:
+			var before, after bson.M
+			if before, after, err = m.replace(params.Collection, mdl.Filter, mdl.Replacement, mdl.Upsert, params.IncludeDeleted, nil); err == nil {
+				switch {
+				case before != nil:
+					result.MatchedCount++
+					if compareValues(before, after) != 0 {
+						result.ModifiedCount++
+					}
+				case after != nil:
+					result.UpsertedCount++
+					op.UpsertedID = after["_id"]
+				}
+			}
+		case DeleteModel:
+			var n int64
+			if n, err = m.remove(params.Collection, mdl.Filter, mdl.Multiple, mdl.Hard, params.DeletedBy); err == nil {
+				if m.state.softDelete[params.Collection] && !mdl.Hard {
+					result.MatchedCount += n
+					result.ModifiedCount += n
+				} else {
+					result.DeletedCount += n
+				}
+			}
+		default:
+			err = fmt.Errorf("unsupported write model %T", model)
+		}
+		if err != nil {
+			failed++
+			op.Status, op.Err = BulkOpFailed, err
+		}
+	}
+	if failed == 0 {
+		return result, nil
+	}
+	l.Error("%d of %d operations failed bulk writing into %v", failed, len(models), params.Collection)
+	return result, BulkWriteError{CollectionName: params.Collection, Failed: failed, Collisions: len(result.Collisions())}
+}
+
+func (m *memoryManager) FindOneAndUpdate(l log.Logger, cc context.Context, updates interface{}, params *FindOneAndUpdateParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	updateCmd := updates
+	if params.Generic {
+		updateCmd = bson.D{{Key: "$set", Value: updates}}
+	}
+	opts := options.MergeFindOneAndUpdateOptions(params.AdditionalOpts...)
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	_, before, after, err := m.update(params.Collection, params.Filter, updateCmd, false, params.Upsert, params.IncludeDeleted, opts.Sort)
+	if err != nil {
+		l.Error("unable to find and update doc in %v: %v", params.Collection, err)
+		return nil, err
+	}
+	return oneOf(before, after, params.ReturnDocument)
+}
+
+func (m *memoryManager) FindOneAndReplace(l log.Logger, cc context.Context, replacement interface{}, params *FindOneAndReplaceParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	opts := options.MergeFindOneAndReplaceOptions(params.AdditionalOpts...)
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	before, after, err := m.replace(params.Collection, params.Filter, replacement, params.Upsert, params.IncludeDeleted, opts.Sort)
+	if err != nil {
+		l.Error("unable to find and replace doc in %v: %v", params.Collection, err)
+		return nil, err
+	}
+	var b, a []bson.M
+	if before != nil {
+		b = []bson.M{before}
+	}
+	if after != nil {
+		a = []bson.M{after}
+	}
+	return oneOf(b, a, params.ReturnDocument)
+}
+
+func oneOf(before, after []bson.M, rd ReturnDocument) (Decoder, error) {
+	docs := before
+	if rd == ReturnAfter {
+		docs = after
+	}
+	if len(docs) == 0 {
+		return nil, NotFoundError{}
+	}
+	// later writes must not show through the returned document
+	doc, err := normalizeDoc(docs[0])
+	if err != nil {
+		return nil, err
+	}
+	return memoryDecoder{docs: []bson.M{doc}, single: true}, nil
+}
+
+func (m *memoryManager) FindOneAndDelete(l log.Logger, cc context.Context, params *FindOneAndDeleteParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	opts := options.MergeFindOneAndDeleteOptions(params.AdditionalOpts...)
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	soft := m.state.softDelete[params.Collection] && !params.Hard
+	idxs, err := m.matching(params.Collection, params.Filter, params.IncludeDeleted && !soft, opts.Sort)
+	if err != nil {
+		l.Error("unable to find and delete doc in %v: %v", params.Collection, err)
+		return nil, err
+	}
+	if len(idxs) == 0 {
+		return nil, NotFoundError{}
+	}
+	doc := m.state.collections[params.Collection][idxs[0]]
+	if !soft {
+		m.removeAt(params.Collection, idxs[:1])
+		return memoryDecoder{docs: []bson.M{doc}, single: true}, nil
+	}
+	// the stored document is marked in place
+	before, err := normalizeDoc(doc)
+	if err != nil {
+		return nil, err
+	}
+	m.markDeleted(params.Collection, idxs[0], params.DeletedBy, time.Now().UTC())
+	return memoryDecoder{docs: []bson.M{before}, single: true}, nil
+}
+
+func (m *memoryManager) CountDocuments(l log.Logger, cc context.Context, params *CountParams) (int64, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return 0, MissingRequiredParameterError{}
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	if params.Estimated {
+		return int64(len(m.state.collections[params.Collection])), nil
+	}
+	opts := options.MergeCountOptions(params.AdditionalOpts...)
+	q := query{collection: params.Collection, filter: params.Filter, includeDeleted: params.IncludeDeleted}
+	if opts.Skip != nil {
+		q.skip = *opts.Skip
+	}
+	if opts.Limit != nil {
+		q.limit = *opts.Limit
+	}
+	docs, err := m.find(q)
+	if err != nil {
+		l.Error("unable to count docs in %v: %v", params.Collection, err)
+		return 0, err
+	}
+	return int64(len(docs)), nil
+}
+
+func (m *memoryManager) Distinct(l log.Logger, cc context.Context, params *DistinctParams) ([]interface{}, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	docs, err := m.find(query{collection: params.Collection, filter: params.Filter, includeDeleted: params.IncludeDeleted})
+	if err != nil {
+		l.Error("unable to find distinct values in %v: %v", params.Collection, err)
+		return nil, err
+	}
+	values := []interface{}{}
+	for _, doc := range docs {
+		found, _ := lookupPath(doc, strings.Split(params.FieldName, "."))
+		for _, v := range found {
+			candidates := []interface{}{v}
+			if arr, ok := v.(bson.A); ok {
+				candidates = arr
+			}
+			for _, c := range candidates {
+				if !containsValue(values, c) {
+					values = append(values, c)
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func (m *memoryManager) Exists(l log.Logger, cc context.Context, params *ExistsParams) (bool, error) {
+	n, err := m.CountDocuments(l, cc, &CountParams{Collection: params.Collection, Filter: params.Filter, IncludeDeleted: params.IncludeDeleted})
+	return n > 0, err
+}
+
+// Watch is not supported by the memory manager
+func (m *memoryManager) Watch(l log.Logger, cc context.Context, params *WatchParams, handler ChangeHandler) error {
+	return errors.New("change streams are not supported by the memory manager")
+}
+
+// WithTransaction runs fn and undoes the writes it made when it fails.
+// Transactions are serialized with each other but not with writes made
+// outside of them: those are visible to fn right away and survive a
+// rollback, unless they hit a document fn changed as well
+func (m *memoryManager) WithTransaction(l log.Logger, cc context.Context, fn func(tx Manager) error) error {
+	if m.journal != nil {
+		return fn(m)
+	}
+	m.state.txMu.Lock()
+	defer m.state.txMu.Unlock()
+
+	tx := &memoryManager{state: m.state, journal: &txJournal{seen: map[string]bool{}}}
+	if err := fn(tx); err != nil {
+		m.state.mu.Lock()
+		tx.rollback()
+		m.state.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (m *memoryManager) Close(l log.Logger) {}
@@ -0,0 +1,537 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// normalizeDoc round trips v through bson so that documents, filters and
+// updates all end up in the same shape: bson.M, bson.A and bson primitives
+func normalizeDoc(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(raw, &doc)
+	return doc, err
+}
+
+// normalizeSort keeps the order of the sort keys, which bson.M would lose
+func normalizeSort(v interface{}) (bson.D, error) {
+	if v == nil {
+		return nil, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var spec bson.D
+	err = bson.Unmarshal(raw, &spec)
+	return spec, err
+}
+
+// matches evaluates a normalized filter against a document
+func matches(doc bson.M, filter bson.M) (bool, error) {
+	for key, cond := range filter {
+		var ok bool
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, key, cond)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unsupported query operator %s", key)
+			}
+			values, found := lookupPath(doc, strings.Split(key, "."))
+			ok, err = matchCondition(values, found, cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.M, op string, cond interface{}) (bool, error) {
+	clauses, ok := cond.(bson.A)
+	if !ok || len(clauses) == 0 {
+		return false, fmt.Errorf("%s must be a non empty array", op)
+	}
+	for _, c := range clauses {
+		sub, ok := c.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("%s entries must be documents", op)
+		}
+		ok, err := matches(doc, sub)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !ok:
+			return false, nil
+		case op == "$or" && ok:
+			return true, nil
+		case op == "$nor" && ok:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+// lookupPath resolves a dotted path. Arrays met along the way without a
+// numeric index are traversed, so "guests.name" yields the name of every
+// guest
+func lookupPath(v interface{}, parts []string) ([]interface{}, bool) {
+	if len(parts) == 0 {
+		return []interface{}{v}, true
+	}
+	switch t := v.(type) {
+	case bson.M:
+		child, ok := t[parts[0]]
+		if !ok {
+			return nil, false
+		}
+		return lookupPath(child, parts[1:])
+	case bson.A:
+		if idx, err := strconv.Atoi(parts[0]); err == nil {
+			if idx < 0 || idx >= len(t) {
+				return nil, false
+			}
+			return lookupPath(t[idx], parts[1:])
+		}
+		var values []interface{}
+		found := false
+		for _, elem := range t {
+			if _, isDoc := elem.(bson.M); !isDoc {
+				continue
+			}
+			vs, ok := lookupPath(elem, parts)
+			values = append(values, vs...)
+			found = found || ok
+		}
+		return values, found
+	}
+	return nil, false
+}
+
+// expand adds the elements of array values to the candidates a condition
+// is checked against, like mongo does
+func expand(values []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		out = append(out, v)
+		if arr, ok := v.(bson.A); ok {
+			out = append(out, arr...)
+		}
+	}
+	return out
+}
+
+func isOperatorDoc(v interface{}) (bson.M, bool) {
+	m, ok := v.(bson.M)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func matchCondition(values []interface{}, found bool, cond interface{}) (bool, error) {
+	ops, ok := isOperatorDoc(cond)
+	if !ok {
+		return matchEq(values, found, cond)
+	}
+	for op, arg := range ops {
+		ok, err := matchOp(values, found, op, arg, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchEq(values []interface{}, found bool, x interface{}) (bool, error) {
+	if x == nil && !found {
+		return true, nil
+	}
+	if re, ok := x.(primitive.Regex); ok {
+		return matchRegex(values, re.Pattern, re.Options)
+	}
+	for _, v := range expand(values) {
+		if compareValues(v, x) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchOp(values []interface{}, found bool, op string, arg interface{}, ops bson.M) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchEq(values, found, arg)
+	case "$ne":
+		ok, err := matchEq(values, found, arg)
+		return !ok, err
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expand(values) {
+			if typeRank(v) != typeRank(arg) {
+				continue
+			}
+			c := compareValues(v, arg)
+			if (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		arr, ok := arg.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+		in := false
+		for _, x := range arr {
+			ok, err := matchEq(values, found, x)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				in = true
+				break
+			}
+		}
+		return in == (op == "$in"), nil
+	case "$all":
+		arr, ok := arg.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("$all needs an array")
+		}
+		for _, x := range arr {
+			if ok, err := matchEq(values, found, x); err != nil || !ok {
+				return false, err
+			}
+		}
+		return len(arr) > 0, nil
+	case "$exists":
+		return found == truthy(arg), nil
+	case "$size":
+		n, ok := toFloat(arg)
+		if !ok {
+			return false, fmt.Errorf("$size needs a number")
+		}
+		for _, v := range values {
+			if arr, isArr := v.(bson.A); isArr && float64(len(arr)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		return matchElem(values, arg)
+	case "$not":
+		if re, ok := arg.(primitive.Regex); ok {
+			ok, err := matchRegex(values, re.Pattern, re.Options)
+			return !ok, err
+		}
+		sub, ok := isOperatorDoc(arg)
+		if !ok {
+			return false, fmt.Errorf("$not needs an operator document")
+		}
+		ok, err := matchCondition(values, found, sub)
+		return !ok, err
+	case "$regex":
+		pattern, opts := "", ""
+		switch re := arg.(type) {
+		case string:
+			pattern = re
+		case primitive.Regex:
+			pattern, opts = re.Pattern, re.Options
+		default:
+			return false, fmt.Errorf("$regex needs a string")
+		}
+		if o, ok := ops["$options"].(string); ok {
+			opts = o
+		}
+		return matchRegex(values, pattern, opts)
+	case "$options":
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported query operator %s", op)
+}
+
+func matchElem(values []interface{}, arg interface{}) (bool, error) {
+	sub, ok := arg.(bson.M)
+	if !ok {
+		return false, fmt.Errorf("$elemMatch needs a document")
+	}
+	ops, isOps := isOperatorDoc(sub)
+	for _, v := range values {
+		arr, ok := v.(bson.A)
+		if !ok {
+			continue
+		}
+		for _, elem := range arr {
+			var ok bool
+			var err error
+			if isOps {
+				ok, err = matchCondition([]interface{}{elem}, true, ops)
+			} else if doc, isDoc := elem.(bson.M); isDoc {
+				ok, err = matches(doc, sub)
+			}
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func matchRegex(values []interface{}, pattern, opts string) (bool, error) {
+	flags := ""
+	for _, o := range opts {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range expand(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case nil:
+		return false
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// typeRank follows the order in which mongo sorts values of different
+// types
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 0
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int, int32, int64, float64:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.M:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime, time.Time:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.MaxKey:
+		return 13
+	}
+	return 12
+}
+
+// compareValues totally orders two normalized values
+func compareValues(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return sign(ra - rb)
+	}
+	switch ra {
+	case 0, 1, 13:
+		return 0
+	case 2:
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 3:
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	case 4:
+		return compareDocs(a.(bson.M), b.(bson.M))
+	case 5:
+		x, y := a.(bson.A), b.(bson.A)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return sign(len(x) - len(y))
+	case 6:
+		return bytes.Compare(a.(primitive.Binary).Data, b.(primitive.Binary).Data)
+	case 7:
+		x, y := a.(primitive.ObjectID), b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case 8:
+		x, y := a.(bool), b.(bool)
+		if x == y {
+			return 0
+		}
+		if !x {
+			return -1
+		}
+		return 1
+	case 9:
+		return sign64(toMillis(a) - toMillis(b))
+	case 10:
+		x, y := a.(primitive.Timestamp), b.(primitive.Timestamp)
+		if x.T != y.T {
+			return sign64(int64(x.T) - int64(y.T))
+		}
+		return sign64(int64(x.I) - int64(y.I))
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func compareDocs(a, b bson.M) int {
+	ka, kb := sortedDocKeys(a), sortedDocKeys(b)
+	for i := 0; i < len(ka) && i < len(kb); i++ {
+		if c := strings.Compare(ka[i], kb[i]); c != 0 {
+			return c
+		}
+		if c := compareValues(a[ka[i]], b[kb[i]]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(ka) - len(kb))
+}
+
+func sortedDocKeys(m bson.M) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func toMillis(v interface{}) int64 {
+	if t, ok := v.(time.Time); ok {
+		return t.UnixMilli()
+	}
+	return int64(v.(primitive.DateTime))
+}
+
+func sign(n int) int {
+	return sign64(int64(n))
+}
+
+func sign64(n int64) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// sortDocs orders docs by a normalized sort spec, keeping the natural order
+// of ties
+func sortDocs(docs []bson.M, spec bson.D) {
+	if len(spec) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return lessBySpec(docs[i], docs[j], spec)
+	})
+}
+
+func lessBySpec(a, b bson.M, spec bson.D) bool {
+	for _, e := range spec {
+		parts := strings.Split(e.Key, ".")
+		va, _ := lookupPath(a, parts)
+		vb, _ := lookupPath(b, parts)
+		c := compareValues(firstOrNil(va), firstOrNil(vb))
+		if dir, _ := toFloat(e.Value); dir < 0 {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+func firstOrNil(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// indexKey is the value a unique index sees for doc. ok is false when a
+// sparse index skips the document
+func indexKey(doc bson.M, spec IndexSpec) (bson.A, bool) {
+	key := make(bson.A, len(spec.Keys))
+	present := false
+	for i, k := range spec.Keys {
+		values, found := lookupPath(doc, strings.Split(k.Key, "."))
+		key[i] = firstOrNil(values)
+		present = present || found
+	}
+	if spec.Sparse && !present {
+		return nil, false
+	}
+	return key, true
+}
@@ -0,0 +1,407 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type party struct {
+	ID       string    `bson:"_id"`
+	Name     string    `bson:"name"`
+	Capacity int       `bson:"capacity"`
+	Tags     []string  `bson:"tags,omitempty"`
+	Guests   []invitee `bson:"guests,omitempty"`
+	StartsAt time.Time `bson:"startsAt"`
+}
+
+type invitee struct {
+	Name string `bson:"name"`
+	RSVP string `bson:"rsvp"`
+}
+
+func seedParties(t *testing.T, m storage.Manager) {
+	start := time.Date(2023, 6, 1, 18, 0, 0, 0, time.UTC)
+	_, err := m.InsertMany(log.StdOutLogger{}, context.Background(), []interface{}{
+		party{ID: "EVT_1", Name: "bbq", Capacity: 10, Tags: []string{"outdoor", "food"}, StartsAt: start,
+			Guests: []invitee{{Name: "ada", RSVP: "yes"}, {Name: "bob", RSVP: "no"}}},
+		party{ID: "EVT_2", Name: "picnic", Capacity: 25, Tags: []string{"outdoor"}, StartsAt: start.Add(24 * time.Hour)},
+		party{ID: "EVT_3", Name: "gala", Capacity: 200, StartsAt: start.Add(48 * time.Hour),
+			Guests: []invitee{{Name: "bob", RSVP: "yes"}}},
+	}, &storage.InsertManyParams{Collection: "events"})
+	require.Nil(t, err)
+}
+
+func findIDs(t *testing.T, m storage.Manager, filter interface{}, opts ...*options.FindOptions) []string {
+	decoder, err := m.FindMany(log.StdOutLogger{}, context.Background(), &storage.FindManyParams{Collection: "events", Filter: filter, AdditionalOpts: opts})
+	require.Nil(t, err)
+	var parties []party
+	require.Nil(t, decoder.Decode(&parties))
+	ids := []string{}
+	for _, p := range parties {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestMemoryQueryOperators(t *testing.T) {
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	start := time.Date(2023, 6, 1, 18, 0, 0, 0, time.UTC)
+	for name, tc := range map[string]struct {
+		filter interface{}
+		ids    []string
+	}{
+		"eq":              {bson.M{"name": "bbq"}, []string{"EVT_1"}},
+		"eq array":        {bson.M{"tags": "outdoor"}, []string{"EVT_1", "EVT_2"}},
+		"in":              {bson.M{"_id": bson.M{"$in": bson.A{"EVT_1", "EVT_3"}}}, []string{"EVT_1", "EVT_3"}},
+		"gt":              {bson.M{"capacity": bson.M{"$gt": 10}}, []string{"EVT_2", "EVT_3"}},
+		"gte lt":          {bson.M{"capacity": bson.M{"$gte": 10, "$lt": 100}}, []string{"EVT_1", "EVT_2"}},
+		"dates":           {bson.M{"startsAt": bson.M{"$gt": start}}, []string{"EVT_2", "EVT_3"}},
+		"and":             {bson.M{"$and": bson.A{bson.M{"tags": "outdoor"}, bson.M{"capacity": 25}}}, []string{"EVT_2"}},
+		"or":              {bson.M{"$or": bson.A{bson.M{"name": "gala"}, bson.M{"capacity": 10}}}, []string{"EVT_1", "EVT_3"}},
+		"exists":          {bson.M{"tags": bson.M{"$exists": false}}, []string{"EVT_3"}},
+		"nested path":     {bson.M{"guests.name": "bob"}, []string{"EVT_1", "EVT_3"}},
+		"elemMatch":       {bson.M{"guests": bson.M{"$elemMatch": bson.M{"name": "bob", "rsvp": "yes"}}}, []string{"EVT_3"}},
+		"typed filter":    {storage.And(storage.Gte("capacity", 25), storage.Ne("name", "gala")), []string{"EVT_2"}},
+		"number coercion": {bson.M{"capacity": 25.0}, []string{"EVT_2"}},
+	} {
+		require.Equal(t, tc.ids, findIDs(t, m, tc.filter), name)
+	}
+	_, err := m.FindMany(log.StdOutLogger{}, context.Background(), &storage.FindManyParams{Collection: "events", Filter: bson.M{"$where": "true"}})
+	require.NotNil(t, err, "unsupported operators are reported")
+}
+
+func TestMemorySortSkipLimit(t *testing.T) {
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	opts := options.Find().SetSort(bson.D{{Key: "capacity", Value: -1}}).SetSkip(1).SetLimit(1)
+	require.Equal(t, []string{"EVT_2"}, findIDs(t, m, bson.M{}, opts))
+
+	decoder, err := m.FindOne(log.StdOutLogger{}, context.Background(), &storage.FindOneParams{
+		Collection:     "events",
+		Filter:         bson.M{"tags": "outdoor"},
+		AdditionalOpts: []*options.FindOneOptions{options.FindOne().SetSort(bson.M{"name": -1})},
+	})
+	require.Nil(t, err)
+	var p party
+	require.Nil(t, decoder.Decode(&p))
+	require.Equal(t, "picnic", p.Name)
+
+	_, err = m.FindOne(log.StdOutLogger{}, context.Background(), &storage.FindOneParams{Collection: "events", Filter: bson.M{"name": "rave"}})
+	require.True(t, storage.IsNotFoundErr(err))
+}
+
+func TestMemoryUpdateOperators(t *testing.T) {
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	res, err := m.UpsertWithResult(log.StdOutLogger{}, context.Background(), bson.M{
+		"$set":      bson.M{"name": "big bbq"},
+		"$inc":      bson.M{"capacity": 5},
+		"$push":     bson.M{"guests": bson.M{"name": "cy", "rsvp": "maybe"}},
+		"$addToSet": bson.M{"tags": bson.M{"$each": bson.A{"food", "music"}}},
+		"$unset":    bson.M{"startsAt": ""},
+	}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}})
+	require.Nil(t, err)
+	require.Equal(t, &storage.UpsertResult{MatchedCount: 1, ModifiedCount: 1}, res)
+
+	decoder, err := m.FindOne(log.StdOutLogger{}, context.Background(), &storage.FindOneParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}})
+	require.Nil(t, err)
+	var doc bson.M
+	require.Nil(t, decoder.Decode(&doc))
+	require.Equal(t, "big bbq", doc["name"])
+	require.EqualValues(t, 15, doc["capacity"])
+	require.Equal(t, bson.A{"outdoor", "food", "music"}, doc["tags"])
+	require.Len(t, doc["guests"], 3)
+	require.NotContains(t, doc, "startsAt")
+
+	// matched but unchanged
+	res, err = m.UpsertWithResult(log.StdOutLogger{}, context.Background(), bson.M{"name": "big bbq"}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true})
+	require.Nil(t, err)
+	require.Equal(t, &storage.UpsertResult{MatchedCount: 1}, res)
+
+	n, err := m.Upsert(log.StdOutLogger{}, context.Background(), bson.M{"$inc": bson.M{"capacity": 1}}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"tags": "outdoor"}, Multiple: true})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+}
+
+func TestMemoryUpsertInserts(t *testing.T) {
+	m := storage.NewMemoryManager()
+	res, err := m.UpsertWithResult(log.StdOutLogger{}, context.Background(), bson.M{
+		"$set":         bson.M{"capacity": 5},
+		"$setOnInsert": bson.M{"tags": bson.A{"new"}},
+	}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_9", "name": "rave"}})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.UpsertedCount)
+	require.Equal(t, "EVT_9", res.UpsertedID)
+
+	decoder, err := m.FindOne(log.StdOutLogger{}, context.Background(), &storage.FindOneParams{Collection: "events", Filter: bson.M{"_id": "EVT_9"}})
+	require.Nil(t, err)
+	var p party
+	require.Nil(t, decoder.Decode(&p))
+	require.Equal(t, party{ID: "EVT_9", Name: "rave", Capacity: 5, Tags: []string{"new"}}, p)
+}
+
+func TestMemoryUniqueIndexes(t *testing.T) {
+	m := storage.NewMemoryManager(storage.IndexSpec{Collection: "events", Keys: bson.D{{Key: "name", Value: 1}}, Unique: true})
+	seedParties(t, m)
+	_, err := m.InsertOne(log.StdOutLogger{}, context.Background(), party{ID: "EVT_1", Name: "other"}, &storage.InsertOneParams{Collection: "events"})
+	require.Equal(t, storage.CollisionError{CollectionName: "events"}, err, "duplicate _id")
+	_, err = m.InsertOne(log.StdOutLogger{}, context.Background(), party{ID: "EVT_4", Name: "gala"}, &storage.InsertOneParams{Collection: "events"})
+	require.Equal(t, storage.CollisionError{CollectionName: "events"}, err, "duplicate name")
+	_, err = m.Upsert(log.StdOutLogger{}, context.Background(), bson.M{"name": "gala"}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true})
+	require.Equal(t, storage.CollisionError{CollectionName: "events"}, err, "update into a duplicate")
+
+	count, err := m.CountDocuments(log.StdOutLogger{}, context.Background(), &storage.CountParams{Collection: "events", Filter: bson.M{}})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), count)
+}
+
+func TestMemoryFindOneAndUpdate(t *testing.T) {
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	decoder, err := m.FindOneAndUpdate(log.StdOutLogger{}, context.Background(), bson.M{"$inc": bson.M{"capacity": 1}}, &storage.FindOneAndUpdateParams{
+		Collection:     "events",
+		Filter:         bson.M{"_id": "EVT_2"},
+		ReturnDocument: storage.ReturnAfter,
+	})
+	require.Nil(t, err)
+	var p party
+	require.Nil(t, decoder.Decode(&p))
+	require.Equal(t, 26, p.Capacity)
+
+	decoder, err = m.FindOneAndDelete(log.StdOutLogger{}, context.Background(), &storage.FindOneAndDeleteParams{Collection: "events", Filter: bson.M{"_id": "EVT_2"}})
+	require.Nil(t, err)
+	require.Nil(t, decoder.Decode(&p))
+	require.Equal(t, "picnic", p.Name)
+	exists, err := m.Exists(log.StdOutLogger{}, context.Background(), &storage.ExistsParams{Collection: "events", Filter: bson.M{"_id": "EVT_2"}})
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestMemoryVersionConflict(t *testing.T) {
+	m := storage.NewMemoryManager()
+	_, err := m.InsertOne(log.StdOutLogger{}, context.Background(), bson.M{"_id": "EVT_1", "name": "bbq", "version": 1}, &storage.InsertOneParams{Collection: "events"})
+	require.Nil(t, err)
+	params := &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true, ExpectedVersion: storage.Version(1)}
+	_, err = m.UpsertWithResult(log.StdOutLogger{}, context.Background(), bson.M{"name": "big bbq"}, params)
+	require.Nil(t, err)
+	_, err = m.UpsertWithResult(log.StdOutLogger{}, context.Background(), bson.M{"name": "huge bbq"}, params)
+	require.True(t, storage.IsConflictErr(err))
+}
+
+func TestMemorySoftDelete(t *testing.T) {
+	m := storage.NewMemoryManager().EnableSoftDelete("events")
+	seedParties(t, m)
+	n, err := m.Delete(log.StdOutLogger{}, context.Background(), &storage.DeleteParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, DeletedBy: "USR_1"})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	require.Equal(t, []string{"EVT_2", "EVT_3"}, findIDs(t, m, bson.M{}))
+
+	n, err = m.Restore(log.StdOutLogger{}, context.Background(), &storage.RestoreParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	require.Equal(t, []string{"EVT_1", "EVT_2", "EVT_3"}, findIDs(t, m, bson.M{}))
+}
+
+func TestMemorySoftDeletedDocsAreHidden(t *testing.T) {
+	l := log.StdOutLogger{}
+	cc := context.Background()
+	m := storage.NewMemoryManager().EnableSoftDelete("events")
+	seedParties(t, m)
+	_, err := m.Delete(l, cc, &storage.DeleteParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, DeletedBy: "USR_1"})
+	require.Nil(t, err)
+
+	n, err := m.CountDocuments(l, cc, &storage.CountParams{Collection: "events", Filter: bson.M{}})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+	n, err = m.CountDocuments(l, cc, &storage.CountParams{Collection: "events", Filter: bson.M{}, IncludeDeleted: true})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	exists, err := m.Exists(l, cc, &storage.ExistsParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}})
+	require.Nil(t, err)
+	require.False(t, exists)
+	exists, err = m.Exists(l, cc, &storage.ExistsParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, IncludeDeleted: true})
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	values, err := m.Distinct(l, cc, &storage.DistinctParams{Collection: "events", FieldName: "tags", Filter: bson.M{}})
+	require.Nil(t, err)
+	require.Equal(t, []interface{}{"outdoor"}, values)
+
+	upsert := false
+	res, err := m.UpsertWithResult(l, cc, bson.M{"name": "revived"}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true, Upsert: &upsert})
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.MatchedCount, "deleted docs aren't updated")
+	_, err = m.FindOneAndUpdate(l, cc, bson.M{"name": "revived"}, &storage.FindOneAndUpdateParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true})
+	require.True(t, storage.IsNotFoundErr(err))
+
+	decoder, err := m.FindOne(l, cc, &storage.FindOneParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, IncludeDeleted: true})
+	require.Nil(t, err)
+	var p party
+	require.Nil(t, decoder.Decode(&p))
+	require.Equal(t, "bbq", p.Name)
+}
+
+func TestMemorySoftFindOneAndDelete(t *testing.T) {
+	l := log.StdOutLogger{}
+	cc := context.Background()
+	m := storage.NewMemoryManager().EnableSoftDelete("events")
+	seedParties(t, m)
+	decoder, err := m.FindOneAndDelete(l, cc, &storage.FindOneAndDeleteParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, DeletedBy: "USR_1"})
+	require.Nil(t, err)
+	var doc bson.M
+	require.Nil(t, decoder.Decode(&doc))
+	require.Nil(t, doc["deletedAt"], "the document as it was before")
+	require.Equal(t, []string{"EVT_2", "EVT_3"}, findIDs(t, m, bson.M{}))
+
+	decoder, err = m.FindOne(l, cc, &storage.FindOneParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, IncludeDeleted: true})
+	require.Nil(t, err)
+	require.Nil(t, decoder.Decode(&doc))
+	require.Equal(t, "USR_1", doc["deletedBy"])
+	_, err = m.FindOneAndDelete(l, cc, &storage.FindOneAndDeleteParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}})
+	require.True(t, storage.IsNotFoundErr(err), "already deleted")
+
+	_, err = m.FindOneAndDelete(l, cc, &storage.FindOneAndDeleteParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, IncludeDeleted: true, Hard: true})
+	require.Nil(t, err)
+	n, err := m.CountDocuments(l, cc, &storage.CountParams{Collection: "events", Filter: bson.M{}, IncludeDeleted: true})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n, "removed for good")
+}
+
+func TestMemorySoftBulkWrite(t *testing.T) {
+	l := log.StdOutLogger{}
+	cc := context.Background()
+	m := storage.NewMemoryManager().EnableSoftDelete("events")
+	seedParties(t, m)
+	_, err := m.Delete(l, cc, &storage.DeleteParams{Collection: "events", Filter: bson.M{"_id": "EVT_3"}})
+	require.Nil(t, err)
+	res, err := m.BulkWrite(l, cc, []storage.WriteModel{
+		storage.DeleteModel{Filter: bson.M{"_id": "EVT_1"}},
+		storage.UpdateModel{Filter: bson.M{}, Update: bson.M{"capacity": 1}, Generic: true, Multiple: true},
+	}, &storage.BulkWriteParams{Collection: "events", DeletedBy: "USR_1"})
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.DeletedCount)
+	require.Equal(t, int64(2), res.ModifiedCount, "the soft delete and the update of the one live document left")
+	require.Equal(t, []string{"EVT_2"}, findIDs(t, m, bson.M{}))
+
+	n, err := m.CountDocuments(l, cc, &storage.CountParams{Collection: "events", Filter: bson.M{"deletedBy": "USR_1"}, IncludeDeleted: true})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	n, err = m.CountDocuments(l, cc, &storage.CountParams{Collection: "events", Filter: bson.M{"capacity": 1}, IncludeDeleted: true})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n, "soft deleted documents weren't updated")
+
+	res, err = m.BulkWrite(l, cc, []storage.WriteModel{storage.DeleteModel{Filter: bson.M{}, Multiple: true, Hard: true}}, &storage.BulkWriteParams{Collection: "events"})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), res.DeletedCount)
+}
+
+func TestMemoryTransactionRollback(t *testing.T) {
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	boom := errors.New("boom")
+	err := m.WithTransaction(log.StdOutLogger{}, context.Background(), func(tx storage.Manager) error {
+		if _, err := tx.Delete(log.StdOutLogger{}, context.Background(), &storage.DeleteParams{Collection: "events", Filter: bson.M{}, Multiple: true}); err != nil {
+			return err
+		}
+		return boom
+	})
+	require.Equal(t, boom, err)
+	require.Equal(t, []string{"EVT_1", "EVT_2", "EVT_3"}, findIDs(t, m, bson.M{}))
+}
+
+func TestMemoryRollbackKeepsOtherWrites(t *testing.T) {
+	l := log.StdOutLogger{}
+	cc := context.Background()
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	boom := errors.New("boom")
+	err := m.WithTransaction(l, cc, func(tx storage.Manager) error {
+		if _, err := tx.Delete(l, cc, &storage.DeleteParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}}); err != nil {
+			return err
+		}
+		if _, err := tx.Upsert(l, cc, bson.M{"capacity": 0}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_3"}, Generic: true}); err != nil {
+			return err
+		}
+		if _, err := tx.InsertOne(l, cc, bson.M{"_id": "EVT_5", "name": "rave"}, &storage.InsertOneParams{Collection: "events"}); err != nil {
+			return err
+		}
+		// somebody else writes while the transaction is running
+		done := make(chan error)
+		go func() {
+			_, err := m.InsertOne(l, cc, bson.M{"_id": "EVT_4", "name": "brunch"}, &storage.InsertOneParams{Collection: "events"})
+			if err == nil {
+				_, err = m.Upsert(l, cc, bson.M{"capacity": 30}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_2"}, Generic: true})
+			}
+			done <- err
+		}()
+		if err := <-done; err != nil {
+			return err
+		}
+		return boom
+	})
+	require.Equal(t, boom, err)
+	require.Equal(t, []string{"EVT_1", "EVT_2", "EVT_3", "EVT_4"}, findIDs(t, m, bson.M{}))
+	require.Equal(t, []string{"EVT_2"}, findIDs(t, m, bson.M{"capacity": 30}), "the other write survived the rollback")
+	require.Equal(t, []string{"EVT_3"}, findIDs(t, m, bson.M{"capacity": 200}), "the transaction's update was undone")
+}
+
+func TestMemoryBulkWrite(t *testing.T) {
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	res, err := m.BulkWrite(log.StdOutLogger{}, context.Background(), []storage.WriteModel{
+		storage.InsertModel{Document: bson.M{"_id": "EVT_4", "name": "rave"}},
+		storage.InsertModel{Document: bson.M{"_id": "EVT_1", "name": "dupe"}},
+		storage.DeleteModel{Filter: bson.M{"_id": "EVT_2"}},
+	}, &storage.BulkWriteParams{Collection: "events"})
+	require.Equal(t, storage.BulkWriteError{CollectionName: "events", Failed: 1, Collisions: 1}, err)
+	require.Equal(t, int64(1), res.InsertedCount)
+	require.Equal(t, storage.BulkOpSkipped, res.Operations[2].Status)
+	require.Equal(t, []string{"EVT_1", "EVT_2", "EVT_3", "EVT_4"}, findIDs(t, m, bson.M{}))
+}
+
+func TestMemoryAggregateAndDistinct(t *testing.T) {
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	decoder, err := m.Aggregate(log.StdOutLogger{}, context.Background(), &storage.AggregateParams{
+		Collection: "events",
+		Pipeline:   bson.A{bson.M{"$match": bson.M{"tags": "outdoor"}}, bson.M{"$count": "n"}},
+	})
+	require.Nil(t, err)
+	var counts []struct {
+		N int `bson:"n"`
+	}
+	require.Nil(t, decoder.Decode(&counts))
+	require.Equal(t, 2, counts[0].N)
+
+	values, err := m.Distinct(log.StdOutLogger{}, context.Background(), &storage.DistinctParams{Collection: "events", FieldName: "tags", Filter: bson.M{}})
+	require.Nil(t, err)
+	require.Equal(t, []interface{}{"outdoor", "food"}, values)
+}
+
+func TestMemoryUpsertWithResultCounts(t *testing.T) {
+	m := storage.NewMemoryManager()
+	seedParties(t, m)
+	l, cc := log.StdOutLogger{}, context.Background()
+
+	res, err := m.UpsertWithResult(l, cc, bson.M{"name": "bbq"}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_1"}, Generic: true})
+	require.Nil(t, err)
+	require.Equal(t, &storage.UpsertResult{MatchedCount: 1}, res, "matched without changes")
+
+	res, err = m.UpsertWithResult(l, cc, bson.M{"capacity": 0}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"tags": "outdoor"}, Generic: true, Multiple: true})
+	require.Nil(t, err)
+	require.Equal(t, &storage.UpsertResult{MatchedCount: 2, ModifiedCount: 2}, res)
+
+	res, err = m.UpsertWithResult(l, cc, bson.M{"name": "brunch"}, &storage.UpsertParams{Collection: "events", Filter: bson.M{"_id": "EVT_4"}, Generic: true})
+	require.Nil(t, err)
+	require.Equal(t, &storage.UpsertResult{UpsertedCount: 1, UpsertedID: "EVT_4"}, res)
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// applyUpdate runs the update operators of a normalized update document on
+// doc. inserting is set when doc is being created by an upsert, which is
+// when $setOnInsert applies
+func applyUpdate(doc bson.M, update bson.M, inserting bool) error {
+	if _, ok := isOperatorDoc(update); !ok {
+		return fmt.Errorf("update document must only contain update operators")
+	}
+	id, hadID := doc["_id"]
+	for _, op := range sortedDocKeys(update) {
+		fields, ok := update[op].(bson.M)
+		if !ok {
+			return fmt.Errorf("%s needs a document", op)
+		}
+		for _, path := range sortedDocKeys(fields) {
+			if err := applyOp(doc, op, path, fields[path], inserting); err != nil {
+				return err
+			}
+		}
+	}
+	if hadID && compareValues(doc["_id"], id) != 0 {
+		return fmt.Errorf("the _id field is immutable")
+	}
+	return nil
+}
+
+func applyOp(doc bson.M, op, path string, arg interface{}, inserting bool) error {
+	parts := strings.Split(path, ".")
+	switch op {
+	case "$set":
+		return setPath(doc, parts, arg)
+	case "$setOnInsert":
+		if !inserting {
+			return nil
+		}
+		return setPath(doc, parts, arg)
+	case "$unset":
+		unsetPath(doc, parts)
+		return nil
+	case "$inc":
+		curr, found := getPath(doc, parts)
+		if !found {
+			return setPath(doc, parts, arg)
+		}
+		sum, err := addNumbers(curr, arg)
+		if err != nil {
+			return fmt.Errorf("cannot $inc %s: %v", path, err)
+		}
+		return setPath(doc, parts, sum)
+	case "$min", "$max":
+		curr, found := getPath(doc, parts)
+		c := compareValues(arg, curr)
+		if !found || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+			return setPath(doc, parts, arg)
+		}
+		return nil
+	case "$push", "$addToSet":
+		curr, found := getPath(doc, parts)
+		arr, ok := curr.(bson.A)
+		if found && !ok {
+			return fmt.Errorf("cannot %s to non array field %s", op, path)
+		}
+		items := bson.A{arg}
+		if m, ok := arg.(bson.M); ok {
+			if each, ok := m["$each"].(bson.A); ok {
+				items = each
+			}
+		}
+		arr = append(bson.A{}, arr...)
+		for _, item := range items {
+			if op == "$addToSet" && containsValue(arr, item) {
+				continue
+			}
+			arr = append(arr, item)
+		}
+		return setPath(doc, parts, arr)
+	case "$pull":
+		curr, found := getPath(doc, parts)
+		arr, ok := curr.(bson.A)
+		if !found {
+			return nil
+		}
+		if !ok {
+			return fmt.Errorf("cannot $pull from non array field %s", path)
+		}
+		kept := bson.A{}
+		for _, elem := range arr {
+			pull, err := pullMatches(elem, arg)
+			if err != nil {
+				return err
+			}
+			if !pull {
+				kept = append(kept, elem)
+			}
+		}
+		return setPath(doc, parts, kept)
+	}
+	return fmt.Errorf("unsupported update operator %s", op)
+}
+
+func pullMatches(elem, cond interface{}) (bool, error) {
+	if ops, ok := isOperatorDoc(cond); ok {
+		return matchCondition([]interface{}{elem}, true, ops)
+	}
+	if sub, ok := cond.(bson.M); ok {
+		doc, isDoc := elem.(bson.M)
+		if !isDoc {
+			return false, nil
+		}
+		return matches(doc, sub)
+	}
+	return compareValues(elem, cond) == 0, nil
+}
+
+func containsValue(arr bson.A, v interface{}) bool {
+	for _, elem := range arr {
+		if compareValues(elem, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// addNumbers keeps the result an int32 or int64 when both sides are
+// integers, like the server does
+func addNumbers(a, b interface{}) (interface{}, error) {
+	x, okA := toFloat(a)
+	y, okB := toFloat(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("non numeric value")
+	}
+	_, aFloat := a.(float64)
+	_, bFloat := b.(float64)
+	if aFloat || bFloat {
+		return x + y, nil
+	}
+	sum := int64(x) + int64(y)
+	_, a32 := a.(int32)
+	_, b32 := b.(int32)
+	if a32 && b32 && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+		return int32(sum), nil
+	}
+	return sum, nil
+}
+
+func getPath(doc bson.M, parts []string) (interface{}, bool) {
+	var curr interface{} = doc
+	for _, part := range parts {
+		switch c := curr.(type) {
+		case bson.M:
+			v, ok := c[part]
+			if !ok {
+				return nil, false
+			}
+			curr = v
+		case bson.A:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(c) {
+				return nil, false
+			}
+			curr = c[idx]
+		default:
+			return nil, false
+		}
+	}
+	return curr, true
+}
+
+func setPath(doc bson.M, parts []string, v interface{}) error {
+	_, err := setIn(doc, parts, v)
+	return err
+}
+
+// setIn returns curr with v set at parts, creating missing documents along
+// the way. Arrays grow as needed when indexed past their end
+func setIn(curr interface{}, parts []string, v interface{}) (interface{}, error) {
+	if len(parts) == 0 {
+		return v, nil
+	}
+	switch c := curr.(type) {
+	case nil:
+		child, err := setIn(nil, parts[1:], v)
+		return bson.M{parts[0]: child}, err
+	case bson.M:
+		child, err := setIn(c[parts[0]], parts[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		c[parts[0]] = child
+		return c, nil
+	case bson.A:
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("cannot create field %s in an array", parts[0])
+		}
+		for len(c) <= idx {
+			c = append(c, nil)
+		}
+		child, err := setIn(c[idx], parts[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		c[idx] = child
+		return c, nil
+	}
+	return nil, fmt.Errorf("cannot create field %s in a %T", parts[0], curr)
+}
+
+func unsetPath(doc bson.M, parts []string) {
+	parent, ok := getPath(doc, parts[:len(parts)-1])
+	if !ok {
+		return
+	}
+	last := parts[len(parts)-1]
+	switch p := parent.(type) {
+	case bson.M:
+		delete(p, last)
+	case bson.A:
+		// like the server, unsetting an array element leaves a null behind
+		if idx, err := strconv.Atoi(last); err == nil && idx >= 0 && idx < len(p) {
+			p[idx] = nil
+		}
+	}
+}
+
+// seedFromFilter builds the document an upsert starts from out of the
+// equality conditions of its filter
+func seedFromFilter(filter bson.M) (bson.M, error) {
+	doc := bson.M{}
+	var seed func(f bson.M) error
+	seed = func(f bson.M) error {
+		for _, k := range sortedDocKeys(f) {
+			v := f[k]
+			if k == "$and" {
+				clauses, _ := v.(bson.A)
+				for _, c := range clauses {
+					if sub, ok := c.(bson.M); ok {
+						if err := seed(sub); err != nil {
+							return err
+						}
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(k, "$") {
+				continue
+			}
+			if ops, ok := isOperatorDoc(v); ok {
+				eq, hasEq := ops["$eq"]
+				if !hasEq {
+					continue
+				}
+				v = eq
+			}
+			if err := setPath(doc, strings.Split(k, "."), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return doc, seed(filter)
+}
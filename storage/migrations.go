@@ -0,0 +1,472 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultMigrationsCollection = "migrations"
+	defaultMigrationLockTTL     = 10 * time.Minute
+	migrationLockID             = "lock"
+)
+
+// Migrator applies migrations and syncs indexes. The Manager returned by
+// NewMongoClient is also a Migrator
+type Migrator interface {
+	Migrate(l log.Logger, cc context.Context, params *MigrateParams) (*MigrationPlan, error)
+	RunMigrateCommand(l log.Logger, cc context.Context, params *MigrateParams, args []string, out io.Writer) error
+}
+
+func NewMigrator(client *mongo.Client, database *mongo.Database) Migrator {
+	return NewMongoClient(client, database)
+}
+
+// Migration is a single versioned change to the database. Migrations run in
+// ascending Version order and each one runs at most once per database
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(l log.Logger, cc context.Context, db *mongo.Database) error
+}
+
+// IndexSpec declares an index that must exist on Collection. Name defaults
+// to the name mongo would generate from Keys (e.g. "email_1_createdAt_-1").
+// ExpireAfter turns the index into a TTL index
+type IndexSpec struct {
+	Collection    string
+	Name          string
+	Keys          bson.D
+	Unique        bool
+	Sparse        bool
+	ExpireAfter   time.Duration
+	PartialFilter interface{}
+}
+
+// IndexName returns the name the index is created with
+func (is IndexSpec) IndexName() string {
+	if is.Name != "" {
+		return is.Name
+	}
+	parts := make([]string, 0, len(is.Keys))
+	for _, k := range is.Keys {
+		parts = append(parts, fmt.Sprintf("%v_%v", k.Key, k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (is IndexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(is.IndexName())
+	if is.Unique {
+		opts.SetUnique(true)
+	}
+	if is.Sparse {
+		opts.SetSparse(true)
+	}
+	if is.ExpireAfter > 0 {
+		opts.SetExpireAfterSeconds(int32(is.ExpireAfter / time.Second))
+	}
+	if is.PartialFilter != nil {
+		opts.SetPartialFilterExpression(is.PartialFilter)
+	}
+	return mongo.IndexModel{Keys: is.Keys, Options: opts}
+}
+
+// MigrateParams describes the desired state of the database. Migrations run
+// before indexes are synced so that they can clean up data (e.g. duplicates)
+// that would prevent a unique index from being built. Indexes that exist on
+// a declared collection but are not declared are only dropped when
+// PruneIndexes is set. With DryRun nothing is changed and only the plan is
+// returned
+type MigrateParams struct {
+	Migrations   []Migration
+	Indexes      []IndexSpec
+	Collection   string
+	PruneIndexes bool
+	DryRun       bool
+	LockTTL      time.Duration
+}
+
+func (mp *MigrateParams) valid() bool {
+	seen := map[int]bool{}
+	for _, m := range mp.Migrations {
+		if m.Version <= 0 || m.Up == nil || seen[m.Version] {
+			return false
+		}
+		seen[m.Version] = true
+	}
+	for _, is := range mp.Indexes {
+		if is.Collection == "" || len(is.Keys) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type IndexAction string
+
+const (
+	IndexCreate   IndexAction = "create"
+	IndexRecreate IndexAction = "recreate"
+	IndexDrop     IndexAction = "drop"
+)
+
+type IndexChange struct {
+	Action     IndexAction
+	Collection string
+	Name       string
+	spec       IndexSpec
+}
+
+// MigrationPlan lists what Migrate did, or would do on a dry run
+type MigrationPlan struct {
+	Migrations []Migration
+	Indexes    []IndexChange
+}
+
+// Empty reports whether the database is already up to date
+func (mp *MigrationPlan) Empty() bool {
+	return len(mp.Migrations) == 0 && len(mp.Indexes) == 0
+}
+
+func (mp *MigrationPlan) String() string {
+	if mp.Empty() {
+		return "database is up to date\n"
+	}
+	var b strings.Builder
+	for _, m := range mp.Migrations {
+		fmt.Fprintf(&b, "migrate  %04d %s\n", m.Version, m.Description)
+	}
+	for _, ic := range mp.Indexes {
+		fmt.Fprintf(&b, "%-8s %s.%s\n", ic.Action, ic.Collection, ic.Name)
+	}
+	return b.String()
+}
+
+type migrationRecord struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+type existingIndex struct {
+	Name                    string   `bson:"name"`
+	Key                     bson.D   `bson:"key"`
+	Unique                  bool     `bson:"unique"`
+	Sparse                  bool     `bson:"sparse"`
+	ExpireAfterSeconds      *int32   `bson:"expireAfterSeconds"`
+	PartialFilterExpression bson.Raw `bson:"partialFilterExpression"`
+}
+
+// Migrate brings the database to the state described by params: pending
+// migrations are applied in order and recorded in the migrations collection,
+// then declared indexes are created or rebuilt when their definition
+// changed. A lock document in the migrations collection makes sure only one
+// instance migrates at a time; a concurrent call fails with a
+// MigrationLockedError. The lock is renewed every third of LockTTL while
+// Migrate runs. If it can't be renewed before it expires, the running
+// migration is cancelled and Migrate fails with a MigrationLockedError,
+// since another instance may have taken over. The returned plan lists the
+// changes that were made (or would be made on a dry run)
+func (mc *mongoClient) Migrate(l log.Logger, cc context.Context, params *MigrateParams) (*MigrationPlan, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collectionName := params.Collection
+	if collectionName == "" {
+		collectionName = DefaultMigrationsCollection
+	}
+	lockTTL := params.LockTTL
+	if lockTTL <= 0 {
+		lockTTL = defaultMigrationLockTTL
+	}
+	collection := mc.Collection(collectionName)
+
+	if !params.DryRun {
+		owner := GenerateID("MIG_", 16)
+		if err := acquireMigrationLock(cc, collection, owner, lockTTL); err != nil {
+			l.Error("unable to acquire migration lock: %v", err)
+			return nil, err
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+			defer cancel()
+			if _, err := collection.DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": owner}); err != nil {
+				l.Error("unable to release migration lock: %v", err)
+			}
+		}()
+		var cancel context.CancelFunc
+		cc, cancel = context.WithCancel(cc)
+		defer cancel()
+		renew := func(ctx context.Context) (bool, error) {
+			filter := bson.M{"_id": migrationLockID, "owner": owner}
+			res, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"expiresAt": time.Now().UTC().Add(lockTTL)}})
+			if err != nil {
+				return false, err
+			}
+			return res.MatchedCount == 1, nil
+		}
+		lost := make(chan struct{})
+		go func() {
+			if !keepLockAlive(l, cc, lockTTL, renew) {
+				close(lost)
+				cancel()
+			}
+		}()
+		plan, err := mc.migrate(l, cc, collection, params)
+		select {
+		case <-lost:
+			l.Error("lost the migration lock, stopped migrating")
+			return plan, MigrationLockedError{}
+		default:
+			return plan, err
+		}
+	}
+	return mc.migrate(l, cc, collection, params)
+}
+
+// keepLockAlive renews a lock taken for ttl every third of ttl until cc is
+// done, which is when it returns true. It returns false as soon as the lock
+// is known to be lost, or when renewing kept failing for so long that the
+// lock is about to expire
+func keepLockAlive(l log.Logger, cc context.Context, ttl time.Duration, renew func(ctx context.Context) (bool, error)) bool {
+	interval := ttl / 3
+	expiresAt := time.Now().Add(ttl)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cc.Done():
+			return true
+		case <-ticker.C:
+		}
+		renewedAt := time.Now()
+		held, err := renew(cc)
+		if cc.Err() != nil {
+			return true
+		}
+		if err == nil && !held {
+			return false
+		}
+		if err == nil {
+			expiresAt = renewedAt.Add(ttl)
+			continue
+		}
+		l.Warn("unable to renew migration lock: %v", err)
+		// the next attempt would come too late
+		if !time.Now().Add(interval).Before(expiresAt) {
+			return false
+		}
+	}
+}
+
+func (mc *mongoClient) migrate(l log.Logger, cc context.Context, collection *mongo.Collection, params *MigrateParams) (*MigrationPlan, error) {
+
+	pending, err := pendingMigrations(cc, collection, params.Migrations)
+	if err != nil {
+		l.Error("unable to load applied migrations: %v", err)
+		return nil, err
+	}
+	plan := &MigrationPlan{}
+	if params.DryRun {
+		plan.Migrations = pending
+		pending = nil
+	}
+	for _, m := range pending {
+		l.Info("applying migration %04d %s", m.Version, m.Description)
+		if err := m.Up(l, cc, mc.database); err != nil {
+			l.Error("migration %04d failed: %v", m.Version, err)
+			return plan, MigrationError{Version: m.Version, Err: err}
+		}
+		record := migrationRecord{Version: m.Version, Description: m.Description, AppliedAt: time.Now().UTC()}
+		if _, err := collection.InsertOne(cc, record); err != nil {
+			l.Error("unable to record migration %04d: %v", m.Version, err)
+			return plan, err
+		}
+		plan.Migrations = append(plan.Migrations, m)
+	}
+
+	changes, err := mc.planIndexes(cc, params.Indexes, params.PruneIndexes)
+	if err != nil {
+		l.Error("unable to list indexes: %v", err)
+		return plan, err
+	}
+	for _, ic := range changes {
+		if params.DryRun {
+			plan.Indexes = append(plan.Indexes, ic)
+			continue
+		}
+		l.Info("%s index %s.%s", ic.Action, ic.Collection, ic.Name)
+		indexes := mc.Collection(ic.Collection).Indexes()
+		if ic.Action == IndexDrop || ic.Action == IndexRecreate {
+			if _, err := indexes.DropOne(cc, ic.Name); err != nil {
+				l.Error("unable to drop index %s.%s: %v", ic.Collection, ic.Name, err)
+				return plan, err
+			}
+		}
+		if ic.Action == IndexCreate || ic.Action == IndexRecreate {
+			if _, err := indexes.CreateOne(cc, ic.spec.model()); err != nil {
+				l.Error("unable to create index %s.%s: %v", ic.Collection, ic.Name, err)
+				return plan, err
+			}
+		}
+		plan.Indexes = append(plan.Indexes, ic)
+	}
+	return plan, nil
+}
+
+// acquireMigrationLock takes the lock unless another owner holds an
+// unexpired one, in which case the upsert collides with the lock document
+func acquireMigrationLock(cc context.Context, collection *mongo.Collection, owner string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	filter := bson.M{"_id": migrationLockID, "expiresAt": bson.M{"$lt": now}}
+	update := bson.M{"$set": bson.M{"owner": owner, "expiresAt": now.Add(ttl)}}
+	_, err := collection.UpdateOne(cc, filter, update, options.Update().SetUpsert(true))
+	if isCollisionErr(err) {
+		return MigrationLockedError{}
+	}
+	return err
+}
+
+func pendingMigrations(cc context.Context, collection *mongo.Collection, migrations []Migration) ([]Migration, error) {
+	cursor, err := collection.Find(cc, bson.M{"_id": bson.M{"$type": "number"}})
+	if err != nil {
+		return nil, err
+	}
+	var records []migrationRecord
+	if err := cursor.All(cc, &records); err != nil {
+		return nil, err
+	}
+	applied := map[int]bool{}
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+	pending := []Migration{}
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+	return pending, nil
+}
+
+func (mc *mongoClient) planIndexes(cc context.Context, specs []IndexSpec, prune bool) ([]IndexChange, error) {
+	byCollection := map[string][]IndexSpec{}
+	collections := []string{}
+	for _, is := range specs {
+		if _, ok := byCollection[is.Collection]; !ok {
+			collections = append(collections, is.Collection)
+		}
+		byCollection[is.Collection] = append(byCollection[is.Collection], is)
+	}
+	changes := []IndexChange{}
+	for _, name := range collections {
+		cursor, err := mc.Collection(name).Indexes().List(cc)
+		if err != nil {
+			return nil, err
+		}
+		var existing []existingIndex
+		if err := cursor.All(cc, &existing); err != nil {
+			return nil, err
+		}
+		changes = append(changes, diffIndexes(name, byCollection[name], existing, prune)...)
+	}
+	return changes, nil
+}
+
+func diffIndexes(collection string, specs []IndexSpec, existing []existingIndex, prune bool) []IndexChange {
+	current := map[string]existingIndex{}
+	for _, ei := range existing {
+		current[ei.Name] = ei
+	}
+	changes := []IndexChange{}
+	declared := map[string]bool{}
+	for _, is := range specs {
+		name := is.IndexName()
+		declared[name] = true
+		ei, ok := current[name]
+		switch {
+		case !ok:
+			changes = append(changes, IndexChange{Action: IndexCreate, Collection: collection, Name: name, spec: is})
+		case !sameIndex(is, ei):
+			changes = append(changes, IndexChange{Action: IndexRecreate, Collection: collection, Name: name, spec: is})
+		}
+	}
+	if prune {
+		for _, ei := range existing {
+			if ei.Name != "_id_" && !declared[ei.Name] {
+				changes = append(changes, IndexChange{Action: IndexDrop, Collection: collection, Name: ei.Name})
+			}
+		}
+	}
+	return changes
+}
+
+func sameIndex(is IndexSpec, ei existingIndex) bool {
+	if is.Unique != ei.Unique || is.Sparse != ei.Sparse || len(is.Keys) != len(ei.Key) {
+		return false
+	}
+	for i, k := range is.Keys {
+		// the server hands numbers back as int32 or float64
+		if k.Key != ei.Key[i].Key || fmt.Sprint(k.Value) != fmt.Sprint(ei.Key[i].Value) {
+			return false
+		}
+	}
+	var ttl int32
+	if ei.ExpireAfterSeconds != nil {
+		ttl = *ei.ExpireAfterSeconds
+	}
+	if int32(is.ExpireAfter/time.Second) != ttl {
+		return false
+	}
+	if is.PartialFilter == nil {
+		return len(ei.PartialFilterExpression) == 0
+	}
+	raw, err := bson.Marshal(is.PartialFilter)
+	return err == nil && bson.Raw(raw).String() == ei.PartialFilterExpression.String()
+}
+
+// RunMigrateCommand is meant to back a "migrate" sub command of a service's
+// binary. It parses args (-dry-run, -prune), runs Migrate and writes the
+// plan to out
+func (mc *mongoClient) RunMigrateCommand(l log.Logger, cc context.Context, params *MigrateParams, args []string, out io.Writer) error {
+	if out == nil {
+		out = os.Stdout
+	}
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "print the pending changes without applying them")
+	prune := fs.Bool("prune", params.PruneIndexes, "drop indexes that are not declared")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p := *params
+	p.DryRun = *dryRun
+	p.PruneIndexes = *prune
+	plan, err := mc.Migrate(l, cc, &p)
+	if plan != nil {
+		if p.DryRun && !plan.Empty() {
+			fmt.Fprint(out, "dry run, the following changes would be applied:\n")
+		}
+		fmt.Fprint(out, plan.String())
+	}
+	var me MigrationError
+	if errors.As(err, &me) {
+		fmt.Fprintf(out, "migration %04d failed: %v\n", me.Version, me.Err)
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIndexName(t *testing.T) {
+	spec := storage.IndexSpec{Collection: "guests", Keys: bson.D{{Key: "email", Value: 1}, {Key: "createdAt", Value: -1}}}
+	require.Equal(t, "email_1_createdAt_-1", spec.IndexName())
+	spec.Name = "unique_email"
+	require.Equal(t, "unique_email", spec.IndexName())
+}
+
+func TestMigrationPlanString(t *testing.T) {
+	plan := &storage.MigrationPlan{}
+	require.True(t, plan.Empty())
+	require.Equal(t, "database is up to date\n", plan.String())
+
+	plan = &storage.MigrationPlan{
+		Migrations: []storage.Migration{{Version: 3, Description: "backfill rsvp status"}},
+		Indexes: []storage.IndexChange{
+			{Action: storage.IndexCreate, Collection: "guests", Name: "email_1"},
+			{Action: storage.IndexDrop, Collection: "events", Name: "legacy_1"},
+		},
+	}
+	require.False(t, plan.Empty())
+	require.Equal(t, "migrate  0003 backfill rsvp status\ncreate   guests.email_1\ndrop     events.legacy_1\n", plan.String())
+}
+
+func TestMigrateInvalidParams(t *testing.T) {
+	up := func(l log.Logger, cc context.Context, db *mongo.Database) error { return nil }
+	mc := storage.NewMongoClient(nil, nil)
+	for name, params := range map[string]*storage.MigrateParams{
+		"duplicate version":  {Migrations: []storage.Migration{{Version: 1, Up: up}, {Version: 1, Up: up}}},
+		"missing up":         {Migrations: []storage.Migration{{Version: 1}}},
+		"zero version":       {Migrations: []storage.Migration{{Version: 0, Up: up}}},
+		"index without keys": {Indexes: []storage.IndexSpec{{Collection: "guests", ExpireAfter: time.Hour}}},
+	} {
+		_, err := mc.Migrate(log.StdOutLogger{}, context.Background(), params)
+		require.Equal(t, storage.MissingRequiredParameterError{}, err, name)
+	}
+}
+
+func TestSameIndex(t *testing.T) {
+	ttl := int32(3600)
+	spec := storage.IndexSpec{Collection: "sessions", Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}, Unique: true, ExpireAfter: time.Hour}
+	existing := storage.ExistingIndex{Name: spec.IndexName(), Key: bson.D{{Key: "userId", Value: int32(1)}, {Key: "createdAt", Value: float64(-1)}}, Unique: true, ExpireAfterSeconds: &ttl}
+	require.True(t, storage.SameIndex(spec, existing), "number types returned by the server don't matter")
+
+	changed := existing
+	changed.Unique = false
+	require.False(t, storage.SameIndex(spec, changed))
+
+	changed = existing
+	changed.Key = bson.D{{Key: "createdAt", Value: -1}, {Key: "userId", Value: 1}}
+	require.False(t, storage.SameIndex(spec, changed), "key order matters")
+
+	changed = existing
+	changed.ExpireAfterSeconds = nil
+	require.False(t, storage.SameIndex(spec, changed))
+
+	partial := storage.IndexSpec{Collection: "users", Keys: bson.D{{Key: "email", Value: 1}}, PartialFilter: bson.D{{Key: "deletedAt", Value: nil}}}
+	raw, err := bson.Marshal(bson.D{{Key: "deletedAt", Value: nil}})
+	require.Nil(t, err)
+	require.True(t, storage.SameIndex(partial, storage.ExistingIndex{Key: bson.D{{Key: "email", Value: int32(1)}}, PartialFilterExpression: raw}))
+	require.False(t, storage.SameIndex(partial, storage.ExistingIndex{Key: bson.D{{Key: "email", Value: int32(1)}}}))
+}
+
+func TestDiffIndexes(t *testing.T) {
+	specs := []storage.IndexSpec{
+		{Collection: "users", Keys: bson.D{{Key: "email", Value: 1}}, Unique: true},
+		{Collection: "users", Keys: bson.D{{Key: "phone", Value: 1}}},
+		{Collection: "users", Keys: bson.D{{Key: "createdAt", Value: -1}}},
+	}
+	existing := []storage.ExistingIndex{
+		{Name: "_id_", Key: bson.D{{Key: "_id", Value: int32(1)}}},
+		{Name: "email_1", Key: bson.D{{Key: "email", Value: int32(1)}}},
+		{Name: "phone_1", Key: bson.D{{Key: "phone", Value: int32(1)}}},
+		{Name: "legacy_1", Key: bson.D{{Key: "legacy", Value: int32(1)}}},
+	}
+	summary := func(changes []storage.IndexChange) []string {
+		out := []string{}
+		for _, c := range changes {
+			out = append(out, string(c.Action)+" "+c.Collection+"."+c.Name)
+		}
+		return out
+	}
+	require.Equal(t, []string{"recreate users.email_1", "create users.createdAt_-1"}, summary(storage.DiffIndexes("users", specs, existing, false)))
+	require.Equal(t, []string{"recreate users.email_1", "create users.createdAt_-1", "drop users.legacy_1"}, summary(storage.DiffIndexes("users", specs, existing, true)), "_id_ is never dropped")
+}
+
+func TestKeepLockAlive(t *testing.T) {
+	l := log.StdOutLogger{}
+	renewals := 0
+	cc, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	held := storage.KeepLockAlive(l, cc, 15*time.Millisecond, func(ctx context.Context) (bool, error) {
+		renewals++
+		return true, nil
+	})
+	require.True(t, held)
+	require.GreaterOrEqual(t, renewals, 3, "renewed every third of the ttl")
+
+	held = storage.KeepLockAlive(l, context.Background(), 15*time.Millisecond, func(ctx context.Context) (bool, error) {
+		return false, nil
+	})
+	require.False(t, held, "another owner took the lock")
+
+	start := time.Now()
+	held = storage.KeepLockAlive(l, context.Background(), 30*time.Millisecond, func(ctx context.Context) (bool, error) {
+		return false, errors.New("connection reset")
+	})
+	require.False(t, held, "failing renewals give up")
+	require.Less(t, time.Since(start), 30*time.Millisecond, "before the lock expires")
+}
@@ -16,26 +16,24 @@ type cursorDecoder struct {
 }
 
 // Decode reads from the cursor and unmarshalls the data into the given
-// object pointer
+// object pointer. This loads every result into memory; use Iterate for
+// large result sets
 func (cd cursorDecoder) Decode(v interface{}) error {
-	return cd.cursor.All(cd.ctx, v)
+	err := cd.cursor.All(cd.ctx, v)
+	if err != nil {
+		// All only closes the cursor once it started iterating, so make sure
+		// it is released when v is rejected up front
+		_ = cd.cursor.Close(context.Background())
+	}
+	return err
 }
 
 type mongoClient struct {
 	client   *mongo.Client
 	database *mongo.Database
-}
-
-type CallContext struct {
-	ctx    context.Context
-	cancel context.CancelFunc
-}
-
-// NewCallContext is used when a client wants to make a call to the data store and provide a
-// context object
-func NewCallContext() *CallContext {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	return &CallContext{ctx: ctx, cancel: cancel}
+	session  mongo.Session // set while running inside WithTransaction
+	// collections where Delete only marks documents as deleted
+	softDelete map[string]bool
 }
 
 // NewMongoClient returns a new mongoDB client
@@ -52,7 +50,11 @@ func (mc *mongoClient) Collection(collection string) *mongo.Collection {
 }
 
 func (mc *mongoClient) Close(l log.Logger) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if mc.session != nil {
+		// the client is owned by whoever started the transaction
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
 	defer cancel()
 	defer func() {
 		if err := mc.client.Disconnect(ctx); err != nil {
@@ -67,6 +69,7 @@ func (mc *mongoClient) Close(l log.Logger) {
 type FindOneParams struct {
 	Collection     string
 	Filter         interface{}
+	IncludeDeleted bool
 	AdditionalOpts []*options.FindOneOptions
 }
 
@@ -74,13 +77,14 @@ func (fop *FindOneParams) valid() bool {
 	return fop.Collection != "" && fop.Filter != nil
 }
 
-func (mc *mongoClient) FindOne(l log.Logger, cc *CallContext, params *FindOneParams) (Decoder, error) {
+func (mc *mongoClient) FindOne(l log.Logger, cc context.Context, params *FindOneParams) (Decoder, error) {
 	if ok := params.valid(); !ok {
 		l.Error("invalid parameters")
 		return nil, MissingRequiredParameterError{}
 	}
 	collection := mc.Collection(params.Collection)
-	resp := collection.FindOne(cc.ctx, params.Filter, params.AdditionalOpts...)
+	filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+	resp := collection.FindOne(mc.context(cc), filter, params.AdditionalOpts...)
 	err := resp.Err()
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -102,6 +106,8 @@ func (mc *mongoClient) FindOne(l log.Logger, cc *CallContext, params *FindOnePar
 type FindManyParams struct {
 	Collection     string
 	Filter         interface{}
+	IncludeDeleted bool
+	BatchSize      int32
 	AdditionalOpts []*options.FindOptions
 }
 
@@ -109,20 +115,65 @@ func (fmp *FindManyParams) valid() bool {
 	return fmp.Collection != "" && fmp.Filter != nil
 }
 
-func (mc *mongoClient) FindMany(l log.Logger, cc *CallContext, params *FindManyParams) (Decoder, error) {
+func (mc *mongoClient) FindMany(l log.Logger, cc context.Context, params *FindManyParams) (Decoder, error) {
 	if ok := params.valid(); !ok {
 		l.Error("invalid parameters")
 		return nil, MissingRequiredParameterError{}
 	}
 	collection := mc.Collection(params.Collection)
-	cursor, err := collection.Find(cc.ctx, params.Filter, params.AdditionalOpts...)
+	filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+	cursor, err := collection.Find(mc.context(cc), filter, params.findOptions()...)
 	if err != nil {
 		l.Error("unable to find docs in %v: %v", params.Collection, err)
 		return nil, err
 	}
 	return cursorDecoder{
 		cursor: cursor,
-		ctx:    cc.ctx, // @todo should we generate a new context here?
+		ctx:    mc.context(cc),
+	}, nil
+}
+
+// AggregateParams describes an aggregation. Pipeline is typically a
+// mongo.Pipeline or []bson.D. MaxTime of zero means no server side limit
+type AggregateParams struct {
+	Collection     string
+	Pipeline       interface{}
+	IncludeDeleted bool
+	AllowDiskUse   bool
+	MaxTime        time.Duration
+	AdditionalOpts []*options.AggregateOptions
+}
+
+func (ap *AggregateParams) valid() bool {
+	return ap.Collection != "" && ap.Pipeline != nil
+}
+
+func (mc *mongoClient) Aggregate(l log.Logger, cc context.Context, params *AggregateParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	opts := options.Aggregate()
+	if params.AllowDiskUse {
+		opts.SetAllowDiskUse(true)
+	}
+	if params.MaxTime > 0 {
+		opts.SetMaxTime(params.MaxTime)
+	}
+	pipeline, err := mc.livePipeline(params.Collection, params.Pipeline, params.IncludeDeleted)
+	if err != nil {
+		l.Error("invalid pipeline: %v", err)
+		return nil, err
+	}
+	cursor, err := collection.Aggregate(mc.context(cc), pipeline, append([]*options.AggregateOptions{opts}, params.AdditionalOpts...)...)
+	if err != nil {
+		l.Error("unable to aggregate docs in %v: %v", params.Collection, err)
+		return nil, err
+	}
+	return cursorDecoder{
+		cursor: cursor,
+		ctx:    mc.context(cc),
 	}, nil
 }
 
@@ -135,13 +186,13 @@ func (iop *InsertOneParams) valid() bool {
 	return iop.Collection != ""
 }
 
-func (mc *mongoClient) InsertOne(l log.Logger, cc *CallContext, document interface{}, params *InsertOneParams) (interface{}, error) {
+func (mc *mongoClient) InsertOne(l log.Logger, cc context.Context, document interface{}, params *InsertOneParams) (interface{}, error) {
 	if ok := params.valid(); !ok {
 		l.Error("invalid parameters")
 		return nil, MissingRequiredParameterError{}
 	}
 	collection := mc.Collection(params.Collection)
-	result, err := collection.InsertOne(cc.ctx, document, params.AdditionalOpts...)
+	result, err := collection.InsertOne(mc.context(cc), document, params.AdditionalOpts...)
 	if err != nil {
 		if isCollisionErr(err) {
 			l.Error("collision found trying to insert into %v: %v", params.Collection, err)
@@ -162,13 +213,13 @@ func (imp *InsertManyParams) valid() bool {
 	return imp.Collection != ""
 }
 
-func (mc *mongoClient) InsertMany(l log.Logger, cc *CallContext, data []interface{}, params *InsertManyParams) (interface{}, error) {
+func (mc *mongoClient) InsertMany(l log.Logger, cc context.Context, data []interface{}, params *InsertManyParams) (interface{}, error) {
 	if ok := params.valid(); !ok {
 		l.Error("invalid parameters")
 		return nil, MissingRequiredParameterError{}
 	}
 	collection := mc.Collection(params.Collection)
-	result, err := collection.InsertMany(cc.ctx, data, params.AdditionalOpts...)
+	result, err := collection.InsertMany(mc.context(cc), data, params.AdditionalOpts...)
 	if err != nil {
 		if isCollisionErr(err) {
 			l.Error("collision found trying to insert many into %v: %v", params.Collection, err)
@@ -180,53 +231,108 @@ func (mc *mongoClient) InsertMany(l log.Logger, cc *CallContext, data []interfac
 	return result.InsertedIDs, nil
 }
 
+// UpsertParams describes an update. Setting ExpectedVersion turns on
+// optimistic locking: the update only applies to a document whose
+// VersionField (defaults to "version") still holds that value, the field is
+// incremented along the way and a ConflictError is returned when somebody
+// else updated the document first. Versioned updates never upsert and can't
+// be combined with Multiple
 type UpsertParams struct {
-	Collection     string
-	Filter         interface{}
-	Multiple       bool
-	Generic        bool
-	Upsert         *bool
-	AdditionalOpts []*options.UpdateOptions
+	Collection      string
+	Filter          interface{}
+	Multiple        bool
+	Generic         bool
+	Upsert          *bool
+	ExpectedVersion *int64
+	VersionField    string
+	IncludeDeleted  bool
+	AdditionalOpts  []*options.UpdateOptions
 }
 
 func (up *UpsertParams) valid() bool {
-	return up.Collection != "" && up.Filter != nil
+	return up.Collection != "" && up.Filter != nil && (up.ExpectedVersion == nil || !up.Multiple)
+}
+
+// UpsertResult tells apart the possible outcomes of an upsert: a new
+// document was inserted (UpsertedCount/UpsertedID), an existing one was
+// matched but left unchanged (MatchedCount without ModifiedCount), or it
+// was modified
+type UpsertResult struct {
+	MatchedCount  int64
+	ModifiedCount int64
+	UpsertedCount int64
+	UpsertedID    interface{}
+}
+
+// Upsert returns the number of modified documents. Use UpsertWithResult to
+// also learn about matched and inserted documents
+func (mc *mongoClient) Upsert(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (int64, error) {
+	res, err := mc.UpsertWithResult(l, cc, updates, params)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
 }
 
-func (mc *mongoClient) Upsert(l log.Logger, cc *CallContext, updates interface{}, params *UpsertParams) (int64, error) {
+func (mc *mongoClient) UpsertWithResult(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (*UpsertResult, error) {
 	if ok := params.valid(); !ok {
 		l.Error("invalid parameters")
-		return 0, MissingRequiredParameterError{}
+		return nil, MissingRequiredParameterError{}
 	}
 	collection := mc.Collection(params.Collection)
 	updateCmd := updates
 	if params.Generic {
 		updateCmd = bson.D{{Key: "$set", Value: updates}}
 	}
+	filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+	if params.ExpectedVersion != nil {
+		live := *params
+		live.Filter = filter
+		return versionedUpdate(l, mc.context(cc), collection, updateCmd, &live)
+	}
 	upsert := true
 	if params.Upsert != nil {
 		upsert = *params.Upsert
 	}
-	params.AdditionalOpts = append(params.AdditionalOpts, options.Update().SetUpsert(upsert))
+	// don't append to params.AdditionalOpts so the params can be reused
+	opts := append(append([]*options.UpdateOptions{}, params.AdditionalOpts...), options.Update().SetUpsert(upsert))
 	var err error
 	var res *mongo.UpdateResult
 	if !params.Multiple {
-		res, err = collection.UpdateOne(cc.ctx, params.Filter, updateCmd, params.AdditionalOpts...)
+		res, err = collection.UpdateOne(mc.context(cc), filter, updateCmd, opts...)
 	} else {
-		res, err = collection.UpdateMany(cc.ctx, params.Filter, updateCmd, params.AdditionalOpts...)
+		res, err = collection.UpdateMany(mc.context(cc), filter, updateCmd, opts...)
 	}
 	if err != nil {
+		if isCollisionErr(err) {
+			l.Error("collision found trying to upsert into %v: %v", params.Collection, err)
+			return nil, CollisionError{CollectionName: params.Collection}
+		}
 		l.Error("unable to update doc(s): %v", err)
-		return 0, err
+		return nil, err
 	}
-	return res.ModifiedCount, nil
+	return newUpsertResult(res), nil
 }
 
+func newUpsertResult(res *mongo.UpdateResult) *UpsertResult {
+	return &UpsertResult{
+		MatchedCount:  res.MatchedCount,
+		ModifiedCount: res.ModifiedCount,
+		UpsertedCount: res.UpsertedCount,
+		UpsertedID:    res.UpsertedID,
+	}
+}
+
+// DeleteParams describes a delete. On collections with soft delete enabled
+// the matching documents are only marked as deleted (by DeletedBy) unless
+// Hard is set
 type DeleteParams struct {
 	Collection     string
 	Filter         interface{}
 	Multiple       bool
 	Generic        bool
+	DeletedBy      string
+	Hard           bool
 	AdditionalOpts []*options.DeleteOptions
 }
 
@@ -234,20 +340,23 @@ func (dp *DeleteParams) valid() bool {
 	return dp.Collection != "" && dp.Filter != nil
 }
 
-func (mc *mongoClient) Delete(l log.Logger, cc *CallContext, params *DeleteParams) (int64, error) {
+func (mc *mongoClient) Delete(l log.Logger, cc context.Context, params *DeleteParams) (int64, error) {
 	if ok := params.valid(); !ok {
 		l.Error("invalid parameters")
 		return 0, MissingRequiredParameterError{}
 	}
+	if mc.softDelete[params.Collection] && !params.Hard {
+		return mc.softDeleteDocs(l, cc, params)
+	}
 
 	collection := mc.Collection(params.Collection)
 
 	var err error
 	var res *mongo.DeleteResult
 	if !params.Multiple {
-		res, err = collection.DeleteOne(cc.ctx, params.Filter, params.AdditionalOpts...)
+		res, err = collection.DeleteOne(mc.context(cc), params.Filter, params.AdditionalOpts...)
 	} else {
-		res, err = collection.DeleteMany(cc.ctx, params.Filter, params.AdditionalOpts...)
+		res, err = collection.DeleteMany(mc.context(cc), params.Filter, params.AdditionalOpts...)
 	}
 	if err != nil {
 		l.Error("unable to update doc(s): %v", err)
@@ -255,3 +364,232 @@ func (mc *mongoClient) Delete(l log.Logger, cc *CallContext, params *DeleteParam
 	}
 	return res.DeletedCount, nil
 }
+
+// CountParams describes a count. When Estimated is set the count comes from
+// the collection metadata, which is much cheaper but ignores Filter and
+// IncludeDeleted
+type CountParams struct {
+	Collection     string
+	Filter         interface{}
+	IncludeDeleted bool
+	Estimated      bool
+	AdditionalOpts []*options.CountOptions
+}
+
+func (cp *CountParams) valid() bool {
+	return cp.Collection != "" && (cp.Filter != nil || cp.Estimated)
+}
+
+func (mc *mongoClient) CountDocuments(l log.Logger, cc context.Context, params *CountParams) (int64, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return 0, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	var count int64
+	var err error
+	if params.Estimated {
+		count, err = collection.EstimatedDocumentCount(mc.context(cc))
+	} else {
+		filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+		count, err = collection.CountDocuments(mc.context(cc), filter, params.AdditionalOpts...)
+	}
+	if err != nil {
+		l.Error("unable to count docs in %v: %v", params.Collection, err)
+		return 0, err
+	}
+	return count, nil
+}
+
+type DistinctParams struct {
+	Collection     string
+	FieldName      string
+	Filter         interface{}
+	IncludeDeleted bool
+	AdditionalOpts []*options.DistinctOptions
+}
+
+func (dp *DistinctParams) valid() bool {
+	return dp.Collection != "" && dp.FieldName != "" && dp.Filter != nil
+}
+
+func (mc *mongoClient) Distinct(l log.Logger, cc context.Context, params *DistinctParams) ([]interface{}, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+	values, err := collection.Distinct(mc.context(cc), params.FieldName, filter, params.AdditionalOpts...)
+	if err != nil {
+		l.Error("unable to find distinct %v in %v: %v", params.FieldName, params.Collection, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+type ExistsParams struct {
+	Collection     string
+	Filter         interface{}
+	IncludeDeleted bool
+}
+
+func (ep *ExistsParams) valid() bool {
+	return ep.Collection != "" && ep.Filter != nil
+}
+
+// Exists reports whether at least one document matches the filter. It
+// stops counting at the first match
+func (mc *mongoClient) Exists(l log.Logger, cc context.Context, params *ExistsParams) (bool, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return false, MissingRequiredParameterError{}
+	}
+	count, err := mc.CountDocuments(l, cc, &CountParams{
+		Collection:     params.Collection,
+		Filter:         params.Filter,
+		IncludeDeleted: params.IncludeDeleted,
+		AdditionalOpts: []*options.CountOptions{options.Count().SetLimit(1)},
+	})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ReturnDocument selects which version of the document the FindOneAnd*
+// calls hand back
+type ReturnDocument int
+
+const (
+	// ReturnBefore returns the document as it was before the write
+	ReturnBefore ReturnDocument = iota
+	// ReturnAfter returns the document as it is after the write
+	ReturnAfter
+)
+
+func (rd ReturnDocument) option() options.ReturnDocument {
+	if rd == ReturnAfter {
+		return options.After
+	}
+	return options.Before
+}
+
+type FindOneAndUpdateParams struct {
+	Collection     string
+	Filter         interface{}
+	Generic        bool
+	Upsert         bool
+	ReturnDocument ReturnDocument
+	IncludeDeleted bool
+	AdditionalOpts []*options.FindOneAndUpdateOptions
+}
+
+func (fup *FindOneAndUpdateParams) valid() bool {
+	return fup.Collection != "" && fup.Filter != nil
+}
+
+// FindOneAndUpdate atomically updates the first document matching the
+// filter and returns it, which makes it suitable for claiming a resource.
+// A NotFoundError is returned when nothing matched (and nothing was upserted)
+func (mc *mongoClient) FindOneAndUpdate(l log.Logger, cc context.Context, updates interface{}, params *FindOneAndUpdateParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	updateCmd := updates
+	if params.Generic {
+		updateCmd = bson.D{{Key: "$set", Value: updates}}
+	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(params.Upsert).
+		SetReturnDocument(params.ReturnDocument.option())
+	filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+	resp := collection.FindOneAndUpdate(mc.context(cc), filter, updateCmd, append([]*options.FindOneAndUpdateOptions{opts}, params.AdditionalOpts...)...)
+	return singleResultDecoder(l, resp, params.Collection)
+}
+
+type FindOneAndReplaceParams struct {
+	Collection     string
+	Filter         interface{}
+	Upsert         bool
+	ReturnDocument ReturnDocument
+	IncludeDeleted bool
+	AdditionalOpts []*options.FindOneAndReplaceOptions
+}
+
+func (frp *FindOneAndReplaceParams) valid() bool {
+	return frp.Collection != "" && frp.Filter != nil
+}
+
+func (mc *mongoClient) FindOneAndReplace(l log.Logger, cc context.Context, replacement interface{}, params *FindOneAndReplaceParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	opts := options.FindOneAndReplace().
+		SetUpsert(params.Upsert).
+		SetReturnDocument(params.ReturnDocument.option())
+	filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+	resp := collection.FindOneAndReplace(mc.context(cc), filter, replacement, append([]*options.FindOneAndReplaceOptions{opts}, params.AdditionalOpts...)...)
+	return singleResultDecoder(l, resp, params.Collection)
+}
+
+// FindOneAndDeleteParams describes a FindOneAndDelete. Like Delete, on
+// collections with soft delete enabled the document is only marked as
+// deleted (by DeletedBy) unless Hard is set
+type FindOneAndDeleteParams struct {
+	Collection     string
+	Filter         interface{}
+	IncludeDeleted bool
+	DeletedBy      string
+	Hard           bool
+	AdditionalOpts []*options.FindOneAndDeleteOptions
+}
+
+func (fdp *FindOneAndDeleteParams) valid() bool {
+	return fdp.Collection != "" && fdp.Filter != nil
+}
+
+// FindOneAndDelete atomically removes, or soft deletes, the first document
+// matching the filter and returns it, e.g. to pop a job off a queue
+// collection
+func (mc *mongoClient) FindOneAndDelete(l log.Logger, cc context.Context, params *FindOneAndDeleteParams) (Decoder, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	if mc.softDelete[params.Collection] && !params.Hard {
+		del := options.MergeFindOneAndDeleteOptions(params.AdditionalOpts...)
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+		opts.Collation, opts.Comment, opts.MaxTime, opts.Projection, opts.Sort, opts.Hint, opts.Let =
+			del.Collation, del.Comment, del.MaxTime, del.Projection, del.Sort, del.Hint, del.Let
+		filter := bson.D{{Key: "$and", Value: bson.A{params.Filter, notDeleted()}}}
+		resp := collection.FindOneAndUpdate(mc.context(cc), filter, softDeleteUpdate(params.DeletedBy), opts)
+		return singleResultDecoder(l, resp, params.Collection)
+	}
+	filter := mc.liveFilter(params.Collection, params.Filter, params.IncludeDeleted)
+	resp := collection.FindOneAndDelete(mc.context(cc), filter, params.AdditionalOpts...)
+	return singleResultDecoder(l, resp, params.Collection)
+}
+
+// singleResultDecoder maps the outcome of a single document call the same
+// way FindOne does
+func singleResultDecoder(l log.Logger, resp *mongo.SingleResult, collection string) (Decoder, error) {
+	err := resp.Err()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, NotFoundError{}
+		}
+		if isCollisionErr(err) {
+			l.Error("collision found writing to %v: %v", collection, err)
+			return nil, CollisionError{CollectionName: collection}
+		}
+		l.Error("error finding doc in %s: %v", collection, err)
+		return nil, err
+	}
+	return resp, nil
+}
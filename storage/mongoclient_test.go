@@ -0,0 +1,97 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// invalid params are rejected before the database is touched, so a client
+// without a connection is enough
+var unconnected = storage.NewMongoClient(nil, nil)
+
+func TestAggregateRequiresParams(t *testing.T) {
+	for _, params := range []*storage.AggregateParams{
+		{Pipeline: mongo.Pipeline{}},
+		{Collection: "events"},
+	} {
+		_, err := unconnected.Aggregate(log.StdOutLogger{}, context.Background(), params)
+		require.Equal(t, storage.MissingRequiredParameterError{}, err)
+	}
+}
+
+func TestCursorDecoder(t *testing.T) {
+	cursor, err := mongo.NewCursorFromDocuments([]interface{}{
+		bson.D{{Key: "_id", Value: "outdoor"}, {Key: "count", Value: int32(2)}},
+		bson.D{{Key: "_id", Value: "food"}, {Key: "count", Value: int32(1)}},
+	}, nil, nil)
+	require.Nil(t, err)
+	var groups []struct {
+		Tag   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	require.Nil(t, storage.NewCursorDecoder(context.Background(), cursor).Decode(&groups))
+	require.Equal(t, 2, len(groups))
+	require.Equal(t, "outdoor", groups[0].Tag)
+	require.Equal(t, 2, groups[0].Count)
+}
+
+func TestCountDistinctExistsRequireParams(t *testing.T) {
+	l, cc := log.StdOutLogger{}, context.Background()
+	_, err := unconnected.CountDocuments(l, cc, &storage.CountParams{Collection: "events"})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err, "count needs a filter unless estimated")
+	_, err = unconnected.CountDocuments(l, cc, &storage.CountParams{Filter: bson.M{}})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+
+	_, err = unconnected.Distinct(l, cc, &storage.DistinctParams{Collection: "events", Filter: bson.M{}})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err, "distinct needs a field")
+
+	_, err = unconnected.Exists(l, cc, &storage.ExistsParams{Collection: "events"})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+}
+
+func TestFindOneAndRequireParams(t *testing.T) {
+	l, cc := log.StdOutLogger{}, context.Background()
+	_, err := unconnected.FindOneAndUpdate(l, cc, bson.M{"claimed": true}, &storage.FindOneAndUpdateParams{Collection: "jobs"})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+	_, err = unconnected.FindOneAndReplace(l, cc, bson.M{}, &storage.FindOneAndReplaceParams{Filter: bson.M{}})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+	_, err = unconnected.FindOneAndDelete(l, cc, &storage.FindOneAndDeleteParams{Collection: "jobs"})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+}
+
+func TestSingleResultDecoder(t *testing.T) {
+	l := log.StdOutLogger{}
+	decoder, err := storage.SingleResultDecoder(l, mongo.NewSingleResultFromDocument(bson.D{{Key: "_id", Value: "JOB_1"}}, nil, nil), "jobs")
+	require.Nil(t, err)
+	var job struct {
+		ID string `bson:"_id"`
+	}
+	require.Nil(t, decoder.Decode(&job))
+	require.Equal(t, "JOB_1", job.ID)
+
+	_, err = storage.SingleResultDecoder(l, mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil), "jobs")
+	require.Equal(t, storage.NotFoundError{}, err)
+
+	duplicate := mongo.CommandError{Code: 11000, Message: "E11000 duplicate key error"}
+	_, err = storage.SingleResultDecoder(l, mongo.NewSingleResultFromDocument(bson.D{}, duplicate, nil), "jobs")
+	require.Equal(t, storage.CollisionError{CollectionName: "jobs"}, err)
+}
+
+func TestUpsertWithResultRequiresParams(t *testing.T) {
+	_, err := unconnected.UpsertWithResult(log.StdOutLogger{}, context.Background(), bson.M{"name": "bbq"}, &storage.UpsertParams{Collection: "events", Generic: true})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+}
+
+func TestUpsertWithResultCounts(t *testing.T) {
+	res := storage.NewUpsertResult(&mongo.UpdateResult{MatchedCount: 2, ModifiedCount: 1})
+	require.Equal(t, &storage.UpsertResult{MatchedCount: 2, ModifiedCount: 1}, res)
+
+	res = storage.NewUpsertResult(&mongo.UpdateResult{UpsertedCount: 1, UpsertedID: "EVT_4"})
+	require.Equal(t, &storage.UpsertResult{UpsertedCount: 1, UpsertedID: "EVT_4"}, res)
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultPageSize = 20
+
+// FindPageParams describes one page of a keyset paginated query. Results
+// are ordered by SortField and then by Tiebreaker (defaults to _id), which
+// must be unique so that the order is stable. Token is the NextToken or
+// PrevToken of a previous page; leave it empty for the first page. Tokens
+// are signed with TokenKey so clients can't forge or alter them
+type FindPageParams struct {
+	Collection string
+	Filter     interface{}
+	SortField  string
+	Tiebreaker string
+	Descending bool
+	Limit      int64
+	Token      string
+	TokenKey   []byte
+}
+
+func (fpp *FindPageParams) valid() bool {
+	return fpp.Collection != "" && fpp.Filter != nil && fpp.SortField != "" && len(fpp.TokenKey) > 0
+}
+
+// Page is a single page of results. NextToken is empty on the last page and
+// PrevToken is empty on the first one
+type Page struct {
+	NextToken string
+	PrevToken string
+	docs      []bson.M
+}
+
+// Len returns the number of documents on the page
+func (p *Page) Len() int {
+	return len(p.docs)
+}
+
+// Decode unmarshalls the documents of the page into v, which must be a
+// pointer to a slice
+func (p *Page) Decode(v interface{}) error {
+	return decodeDocs(p.docs, v)
+}
+
+// decodeDocs unmarshalls docs into v, a pointer to a slice
+func decodeDocs(docs []bson.M, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errors.New("results argument must be a pointer to a slice")
+	}
+	slice := reflect.MakeSlice(rv.Elem().Type(), 0, len(docs))
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		elem := reflect.New(slice.Type().Elem())
+		if err := bson.Unmarshal(raw, elem.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	rv.Elem().Set(slice)
+	return nil
+}
+
+type pageToken struct {
+	Backward   bool        `bson:"b"`
+	SortField  string      `bson:"f"`
+	Tiebreaker string      `bson:"t"`
+	Descending bool        `bson:"d"`
+	SortValue  interface{} `bson:"sv"`
+	TieValue   interface{} `bson:"tv"`
+	Query      []byte      `bson:"q"`
+}
+
+// FindPage fetches a page of results using keyset pagination: instead of
+// skipping over previous results it filters on the sort key of the last
+// document seen, which stays fast and stable as the collection grows
+func FindPage(l log.Logger, m Manager, cc context.Context, params *FindPageParams) (*Page, error) {
+	if ok := params.valid(); !ok {
+		l.Error("invalid parameters")
+		return nil, MissingRequiredParameterError{}
+	}
+	tiebreaker := params.Tiebreaker
+	if tiebreaker == "" {
+		tiebreaker = "_id"
+	}
+	limit := params.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+
+	query, err := queryHash(params.Collection, params.Filter, params.SortField, tiebreaker, params.Descending)
+	if err != nil {
+		l.Error("unable to hash page query: %v", err)
+		return nil, err
+	}
+	filter := params.Filter
+	var token *pageToken
+	if params.Token != "" {
+		t, err := decodePageToken(params.Token, params.TokenKey)
+		if err != nil {
+			l.Error("invalid page token: %v", err)
+			return nil, err
+		}
+		if t.SortField != params.SortField || t.Tiebreaker != tiebreaker || t.Descending != params.Descending {
+			return nil, InvalidPageTokenError{Reason: "token was issued for a different sort order"}
+		}
+		if !hmac.Equal(t.Query, query) {
+			return nil, InvalidPageTokenError{Reason: "token was issued for a different query"}
+		}
+		token = t
+		filter = bson.D{{Key: "$and", Value: bson.A{params.Filter, keysetFilter(t)}}}
+	}
+
+	backward := token != nil && token.Backward
+	order := 1
+	if params.Descending != backward {
+		order = -1
+	}
+	decoder, err := m.FindMany(l, cc, &FindManyParams{
+		Collection: params.Collection,
+		Filter:     filter,
+		AdditionalOpts: []*options.FindOptions{
+			options.Find().
+				SetSort(bson.D{{Key: params.SortField, Value: order}, {Key: tiebreaker, Value: order}}).
+				SetLimit(limit + 1),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	if err := decoder.Decode(&docs); err != nil {
+		l.Error("unable to decode page: %v", err)
+		return nil, err
+	}
+	hasMore := int64(len(docs)) > limit
+	if hasMore {
+		docs = docs[:limit]
+	}
+	if backward {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
+		}
+	}
+
+	page := &Page{docs: docs}
+	if len(docs) == 0 {
+		return page, nil
+	}
+	// going forward there is a previous page as soon as we came from a token,
+	// going backward there always is a next page: the one we came from
+	hasNext, hasPrev := hasMore, token != nil
+	if backward {
+		hasNext, hasPrev = true, hasMore
+	}
+	newToken := func(doc bson.M, backward bool) (string, error) {
+		return encodePageToken(&pageToken{
+			Backward:   backward,
+			SortField:  params.SortField,
+			Tiebreaker: tiebreaker,
+			Descending: params.Descending,
+			SortValue:  lookupField(doc, params.SortField),
+			TieValue:   lookupField(doc, tiebreaker),
+			Query:      query,
+		}, params.TokenKey)
+	}
+	if hasNext {
+		if page.NextToken, err = newToken(docs[len(docs)-1], false); err != nil {
+			return nil, err
+		}
+	}
+	if hasPrev {
+		if page.PrevToken, err = newToken(docs[0], true); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// queryHash ties a token to the query it was issued for, so that it can't
+// be replayed against another collection or filter to page through
+// documents that filter would have excluded
+func queryHash(collection string, filter interface{}, sortField, tiebreaker string, descending bool) ([]byte, error) {
+	raw, err := bson.Marshal(bson.D{
+		{Key: "c", Value: collection},
+		{Key: "f", Value: canonical(filter)},
+		{Key: "s", Value: bson.D{{Key: sortField, Value: descending}, {Key: tiebreaker, Value: descending}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return sum[:], nil
+}
+
+// keysetFilter matches every document strictly after (or before, when
+// paging backward) the one the token was created from
+func keysetFilter(t *pageToken) bson.D {
+	op := "$gt"
+	if t.Descending != t.Backward {
+		op = "$lt"
+	}
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: t.SortField, Value: bson.D{{Key: op, Value: t.SortValue}}}},
+		bson.D{
+			{Key: t.SortField, Value: t.SortValue},
+			{Key: t.Tiebreaker, Value: bson.D{{Key: op, Value: t.TieValue}}},
+		},
+	}}}
+}
+
+func lookupField(doc bson.M, path string) interface{} {
+	var curr interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := curr.(bson.M)
+		if !ok {
+			if mm, isMap := curr.(map[string]interface{}); isMap {
+				m = mm
+			} else {
+				return nil
+			}
+		}
+		curr = m[part]
+	}
+	return curr
+}
+
+// tokens are the bson encoded cursor followed by its HMAC, both base64url
+// encoded. bson keeps the type of the sort values (dates, object ids...)
+// intact across the round trip
+func encodePageToken(t *pageToken, key []byte) (string, error) {
+	raw, err := bson.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode page token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw) + "." + base64.RawURLEncoding.EncodeToString(signToken(raw, key)), nil
+}
+
+func decodePageToken(token string, key []byte) (*pageToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, InvalidPageTokenError{Reason: "malformed token"}
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, InvalidPageTokenError{Reason: "malformed token"}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signToken(raw, key)) {
+		return nil, InvalidPageTokenError{Reason: "signature mismatch"}
+	}
+	var t pageToken
+	if err := bson.Unmarshal(raw, &t); err != nil {
+		return nil, InvalidPageTokenError{Reason: "malformed token"}
+	}
+	return &t, nil
+}
+
+func signToken(raw, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,130 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type rsvp struct {
+	ID   string `bson:"_id"`
+	Rank int    `bson:"rank"`
+}
+
+var tokenKey = []byte("page-secret")
+
+func TestFindPageForward(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		Responses: []interface{}{
+			[]bson.M{{"_id": "a", "rank": 1}, {"_id": "b", "rank": 2}, {"_id": "c", "rank": 2}},
+			[]bson.M{{"_id": "c", "rank": 2}},
+		},
+	}
+	params := &storage.FindPageParams{
+		Collection: "rsvps",
+		Filter:     bson.M{"eventId": "evt"},
+		SortField:  "rank",
+		Limit:      2,
+		TokenKey:   tokenKey,
+	}
+	page, err := storage.FindPage(log.StdOutLogger{}, mm, context.Background(), params)
+	require.Nil(t, err, "find page err should be nil")
+	var rsvps []rsvp
+	require.Nil(t, page.Decode(&rsvps))
+	require.Equal(t, []rsvp{{ID: "a", Rank: 1}, {ID: "b", Rank: 2}}, rsvps)
+	require.NotEmpty(t, page.NextToken, "there should be a next page")
+	require.Empty(t, page.PrevToken, "first page has no previous page")
+
+	mm.FilterChecks = []interface{}{nil, bson.D{{Key: "$and", Value: bson.A{
+		bson.M{"eventId": "evt"},
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "rank", Value: bson.D{{Key: "$gt", Value: float64(2)}}}},
+			bson.D{{Key: "rank", Value: float64(2)}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: "b"}}}},
+		}}},
+	}}}}
+	params.Token = page.NextToken
+	page, err = storage.FindPage(log.StdOutLogger{}, mm, context.Background(), params)
+	require.Nil(t, err, "find page err should be nil")
+	require.Equal(t, 1, page.Len())
+	require.Empty(t, page.NextToken, "last page has no next page")
+	require.NotEmpty(t, page.PrevToken, "there should be a previous page")
+}
+
+func TestFindPageBackward(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		// results of a backward query come in reverse order
+		Responses: []interface{}{[]bson.M{{"_id": "b", "rank": 2}, {"_id": "a", "rank": 1}}},
+	}
+	params := &storage.FindPageParams{
+		Collection: "rsvps",
+		Filter:     bson.M{},
+		SortField:  "rank",
+		Limit:      2,
+		TokenKey:   tokenKey,
+	}
+	token := prevToken(t, params)
+	params.Token = token
+	page, err := storage.FindPage(log.StdOutLogger{}, mm, context.Background(), params)
+	require.Nil(t, err, "find page err should be nil")
+	var rsvps []rsvp
+	require.Nil(t, page.Decode(&rsvps))
+	require.Equal(t, []rsvp{{ID: "a", Rank: 1}, {ID: "b", Rank: 2}}, rsvps)
+	require.NotEmpty(t, page.NextToken, "the page we came from should be reachable")
+	require.Empty(t, page.PrevToken, "no more results before this page")
+}
+
+func TestFindPageRejectsTamperedToken(t *testing.T) {
+	params := &storage.FindPageParams{
+		Collection: "rsvps",
+		Filter:     bson.M{},
+		SortField:  "rank",
+		TokenKey:   tokenKey,
+	}
+	params.Token = prevToken(t, params)
+	params.TokenKey = []byte("another-secret")
+	_, err := storage.FindPage(log.StdOutLogger{}, &mocks.MockDBManager{}, context.Background(), params)
+	require.IsType(t, storage.InvalidPageTokenError{}, err, "expected error type")
+}
+
+func TestFindPageRejectsTokenOfAnotherQuery(t *testing.T) {
+	params := &storage.FindPageParams{
+		Collection: "rsvps",
+		Filter:     bson.M{"status": "yes"},
+		SortField:  "rank",
+		TokenKey:   tokenKey,
+	}
+	token := prevToken(t, params)
+	for _, p := range []storage.FindPageParams{
+		{Collection: "rsvps", Filter: bson.M{}, SortField: "rank", TokenKey: tokenKey, Token: token},
+		{Collection: "events", Filter: bson.M{"status": "yes"}, SortField: "rank", TokenKey: tokenKey, Token: token},
+	} {
+		_, err := storage.FindPage(log.StdOutLogger{}, &mocks.MockDBManager{}, context.Background(), &p)
+		require.Equal(t, storage.InvalidPageTokenError{Reason: "token was issued for a different query"}, err)
+	}
+	params.Token = token
+	_, err := storage.FindPage(log.StdOutLogger{}, &mocks.MockDBManager{Responses: []interface{}{`[]`}}, context.Background(), params)
+	require.Nil(t, err, "the same query should accept its own token")
+}
+
+// prevToken builds a PrevToken by fetching the second page of a query
+func prevToken(t *testing.T, params *storage.FindPageParams) string {
+	p := *params
+	p.Limit = 1
+	mm := &mocks.MockDBManager{
+		Responses: []interface{}{
+			[]bson.M{{"_id": "b", "rank": 2}, {"_id": "c", "rank": 3}},
+			[]bson.M{{"_id": "c", "rank": 3}},
+		},
+	}
+	first, err := storage.FindPage(log.StdOutLogger{}, mm, context.Background(), &p)
+	require.Nil(t, err, "find page err should be nil")
+	p.Token = first.NextToken
+	second, err := storage.FindPage(log.StdOutLogger{}, mm, context.Background(), &p)
+	require.Nil(t, err, "find page err should be nil")
+	return second.PrevToken
+}
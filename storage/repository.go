@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultIDLength = 15
+
+// Identifiable documents get an ID generated by Repository.Create
+type Identifiable interface {
+	GetID() string
+	SetID(id string)
+}
+
+// Timestamped documents get their timestamps maintained by Repository
+type Timestamped interface {
+	SetCreatedAt(t time.Time)
+	SetUpdatedAt(t time.Time)
+}
+
+// Model implements Identifiable and Timestamped. Embed it inline:
+//
+//	type Event struct {
+//		storage.Model `bson:",inline"`
+//		Name          string `bson:"name" json:"name"`
+//	}
+type Model struct {
+	ID        string    `bson:"_id" json:"_id"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+func (m *Model) GetID() string            { return m.ID }
+func (m *Model) SetID(id string)          { m.ID = id }
+func (m *Model) SetCreatedAt(t time.Time) { m.CreatedAt = t }
+func (m *Model) SetUpdatedAt(t time.Time) { m.UpdatedAt = t }
+
+// Filter is a query filter built with Eq, In, And... It is a bson.D so it
+// can also be passed anywhere a plain filter is expected
+type Filter bson.D
+
+// All matches every document
+func All() Filter { return Filter{} }
+
+func Eq(field string, value interface{}) Filter  { return Filter{{Key: field, Value: value}} }
+func Ne(field string, value interface{}) Filter  { return op(field, "$ne", value) }
+func Gt(field string, value interface{}) Filter  { return op(field, "$gt", value) }
+func Gte(field string, value interface{}) Filter { return op(field, "$gte", value) }
+func Lt(field string, value interface{}) Filter  { return op(field, "$lt", value) }
+func Lte(field string, value interface{}) Filter { return op(field, "$lte", value) }
+
+func In[V any](field string, values ...V) Filter {
+	a := make(bson.A, len(values))
+	for i, v := range values {
+		a[i] = v
+	}
+	return op(field, "$in", a)
+}
+
+func Exists(field string, exists bool) Filter { return op(field, "$exists", exists) }
+
+func And(filters ...Filter) Filter { return combine("$and", filters) }
+func Or(filters ...Filter) Filter  { return combine("$or", filters) }
+
+func op(field, operator string, value interface{}) Filter {
+	return Filter{{Key: field, Value: bson.D{{Key: operator, Value: value}}}}
+}
+
+func combine(operator string, filters []Filter) Filter {
+	a := make(bson.A, len(filters))
+	for i, f := range filters {
+		a[i] = f
+	}
+	return Filter{{Key: operator, Value: a}}
+}
+
+// RepositoryParams configures a Repository. Generated IDs are IDPrefix
+// followed by IDLength (defaults to 15) random characters
+type RepositoryParams struct {
+	Collection string
+	IDPrefix   string
+	IDLength   int
+}
+
+// ListOpts sorts and limits a List. The zero value lists everything in
+// natural order
+type ListOpts struct {
+	SortField  string
+	Descending bool
+	Limit      int64
+	Skip       int64
+}
+
+// Repository gives typed access to the documents of one collection. T is
+// the document type; when *T implements Identifiable and Timestamped (e.g.
+// by embedding Model) IDs and timestamps are filled in automatically
+type Repository[T any] struct {
+	m              Manager
+	params         RepositoryParams
+	createdAtField string
+	updatedAtField string
+}
+
+func NewRepository[T any](m Manager, params RepositoryParams) *Repository[T] {
+	if params.IDLength <= 0 {
+		params.IDLength = defaultIDLength
+	}
+	created, updated := timestampFields[T]()
+	return &Repository[T]{m: m, params: params, createdAtField: created, updatedAtField: updated}
+}
+
+// timestampFields returns the top level fields SetCreatedAt and SetUpdatedAt
+// of a Timestamped T write to, whatever their bson tags, or "" when there
+// are none
+func timestampFields[T any]() (created, updated string) {
+	doc := new(T)
+	ts, ok := any(doc).(Timestamped)
+	if !ok {
+		return "", ""
+	}
+	createdMarker, updatedMarker := time.Unix(1234567890, 0).UTC(), time.Unix(1234567891, 0).UTC()
+	ts.SetCreatedAt(createdMarker)
+	ts.SetUpdatedAt(updatedMarker)
+	fields, err := toDoc(doc)
+	if err != nil {
+		return "", ""
+	}
+	for k, v := range fields {
+		dt, ok := v.(primitive.DateTime)
+		switch {
+		case !ok:
+		case dt.Time().Equal(createdMarker):
+			created = k
+		case dt.Time().Equal(updatedMarker):
+			updated = k
+		}
+	}
+	return created, updated
+}
+
+// Get returns the document with the given ID or a NotFoundError
+func (r *Repository[T]) Get(l log.Logger, cc context.Context, id string) (*T, error) {
+	return r.FindOne(l, cc, Eq("_id", id))
+}
+
+// FindOne returns the first document matching filter or a NotFoundError
+func (r *Repository[T]) FindOne(l log.Logger, cc context.Context, filter Filter) (*T, error) {
+	decoder, err := r.m.FindOne(l, cc, &FindOneParams{Collection: r.params.Collection, Filter: filter})
+	if err != nil {
+		return nil, err
+	}
+	var doc T
+	if err := decoder.Decode(&doc); err != nil {
+		l.Error("unable to decode %v document: %v", r.params.Collection, err)
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// List returns every document matching filter. opts may be nil
+func (r *Repository[T]) List(l log.Logger, cc context.Context, filter Filter, opts *ListOpts) ([]T, error) {
+	params := &FindManyParams{Collection: r.params.Collection, Filter: filter}
+	if opts != nil {
+		findOpts := options.Find()
+		if opts.SortField != "" {
+			order := 1
+			if opts.Descending {
+				order = -1
+			}
+			findOpts.SetSort(bson.D{{Key: opts.SortField, Value: order}})
+		}
+		if opts.Limit > 0 {
+			findOpts.SetLimit(opts.Limit)
+		}
+		if opts.Skip > 0 {
+			findOpts.SetSkip(opts.Skip)
+		}
+		params.AdditionalOpts = []*options.FindOptions{findOpts}
+	}
+	decoder, err := r.m.FindMany(l, cc, params)
+	if err != nil {
+		return nil, err
+	}
+	docs := []T{}
+	if err := decoder.Decode(&docs); err != nil {
+		l.Error("unable to decode %v documents: %v", r.params.Collection, err)
+		return nil, err
+	}
+	return docs, nil
+}
+
+// Create inserts doc, generating its ID when it doesn't have one yet and
+// setting both timestamps
+func (r *Repository[T]) Create(l log.Logger, cc context.Context, doc *T) error {
+	if ident, ok := any(doc).(Identifiable); ok && ident.GetID() == "" {
+		ident.SetID(GenerateID(r.params.IDPrefix, r.params.IDLength))
+	}
+	if ts, ok := any(doc).(Timestamped); ok {
+		now := time.Now().UTC()
+		ts.SetCreatedAt(now)
+		ts.SetUpdatedAt(now)
+	}
+	_, err := r.m.InsertOne(l, cc, doc, &InsertOneParams{Collection: r.params.Collection})
+	return err
+}
+
+// Update sets the given fields (a map or a struct holding only the fields
+// to change) on the document with the given ID and, when T is Timestamped,
+// bumps the field SetUpdatedAt sets. _id and the field SetCreatedAt sets are
+// never changed, so a T can be passed as well. It returns a NotFoundError
+// when there is no such document
+func (r *Repository[T]) Update(l log.Logger, cc context.Context, id string, fields interface{}) error {
+	set, err := toDoc(fields)
+	if err != nil {
+		l.Error("unable to encode update for %v: %v", r.params.Collection, err)
+		return err
+	}
+	delete(set, "_id")
+	if r.createdAtField != "" {
+		delete(set, r.createdAtField)
+	}
+	if r.updatedAtField != "" {
+		set[r.updatedAtField] = time.Now().UTC()
+	}
+	upsert := false
+	res, err := r.m.UpsertWithResult(l, cc, set, &UpsertParams{
+		Collection: r.params.Collection,
+		Filter:     Eq("_id", id),
+		Generic:    true,
+		Upsert:     &upsert,
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return NotFoundError{}
+	}
+	return nil
+}
+
+// Delete removes the document with the given ID, or soft deletes it when
+// the collection has soft delete enabled. It returns a NotFoundError when
+// there is no such document
+func (r *Repository[T]) Delete(l log.Logger, cc context.Context, id string) error {
+	n, err := r.m.Delete(l, cc, &DeleteParams{
+		Collection: r.params.Collection,
+		Filter:     Eq("_id", id),
+		DeletedBy:  ActorFromContext(cc),
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return NotFoundError{}
+	}
+	return nil
+}
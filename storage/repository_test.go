@@ -0,0 +1,132 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type event struct {
+	storage.Model `bson:",inline"`
+	Name          string `bson:"name" json:"name"`
+	Capacity      int    `bson:"capacity" json:"capacity"`
+}
+
+func TestRepositoryCreate(t *testing.T) {
+	mm := &mocks.MockDBManager{Responses: []interface{}{"EVT_1"}}
+	repo := storage.NewRepository[event](mm, storage.RepositoryParams{Collection: "events", IDPrefix: "EVT_"})
+	e := &event{Name: "bbq"}
+	require.Nil(t, repo.Create(log.StdOutLogger{}, context.Background(), e))
+	require.Len(t, e.ID, len("EVT_")+15)
+	require.Equal(t, "EVT_", e.ID[:4])
+	require.False(t, e.CreatedAt.IsZero())
+	require.Equal(t, e.CreatedAt, e.UpdatedAt)
+
+	raw, err := bson.Marshal(e)
+	require.Nil(t, err)
+	var doc bson.M
+	require.Nil(t, bson.Unmarshal(raw, &doc))
+	require.Equal(t, e.ID, doc["_id"], "model fields are inlined")
+}
+
+func TestRepositoryGet(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		Responses:    []interface{}{`{"_id": "EVT_1", "name": "bbq", "capacity": 10}`, nil},
+		Errors:       []interface{}{nil, storage.NotFoundError{}},
+		FilterChecks: []interface{}{storage.Eq("_id", "EVT_1")},
+	}
+	repo := storage.NewRepository[event](mm, storage.RepositoryParams{Collection: "events"})
+	e, err := repo.Get(log.StdOutLogger{}, context.Background(), "EVT_1")
+	require.Nil(t, err)
+	require.Equal(t, "EVT_1", e.ID)
+	require.Equal(t, 10, e.Capacity)
+
+	_, err = repo.Get(log.StdOutLogger{}, context.Background(), "EVT_2")
+	require.True(t, storage.IsNotFoundErr(err))
+}
+
+func TestRepositoryList(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		Responses: []interface{}{`[{"_id": "EVT_1", "name": "bbq"}, {"_id": "EVT_2", "name": "picnic"}]`},
+		FilterChecks: []interface{}{storage.And(
+			storage.In("_id", "EVT_1", "EVT_2"),
+			storage.Gte("capacity", 5),
+		)},
+	}
+	repo := storage.NewRepository[event](mm, storage.RepositoryParams{Collection: "events"})
+	events, err := repo.List(log.StdOutLogger{}, context.Background(), storage.And(
+		storage.In("_id", "EVT_1", "EVT_2"),
+		storage.Gte("capacity", 5),
+	), &storage.ListOpts{SortField: "name", Limit: 10})
+	require.Nil(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "picnic", events[1].Name)
+}
+
+func TestRepositoryUpdateAndDeleteNotFound(t *testing.T) {
+	mm := &mocks.MockDBManager{Responses: []interface{}{&storage.UpsertResult{}, int64(0)}}
+	repo := storage.NewRepository[event](mm, storage.RepositoryParams{Collection: "events"})
+	err := repo.Update(log.StdOutLogger{}, context.Background(), "EVT_1", bson.M{"capacity": 20})
+	require.True(t, storage.IsNotFoundErr(err))
+	err = repo.Delete(log.StdOutLogger{}, context.Background(), "EVT_1")
+	require.True(t, storage.IsNotFoundErr(err))
+}
+
+func TestRepositoryUpdateWithDocument(t *testing.T) {
+	l := log.StdOutLogger{}
+	m := storage.NewMemoryManager()
+	repo := storage.NewRepository[event](m, storage.RepositoryParams{Collection: "events"})
+	ev := &event{Name: "bbq", Capacity: 10}
+	require.Nil(t, repo.Create(l, context.Background(), ev))
+
+	require.Nil(t, repo.Update(l, context.Background(), ev.ID, &event{Name: "big bbq", Capacity: 20}))
+	got, err := repo.Get(l, context.Background(), ev.ID)
+	require.Nil(t, err)
+	require.Equal(t, "big bbq", got.Name)
+	require.Equal(t, ev.ID, got.ID, "the zero _id of the update is dropped")
+	require.True(t, ev.CreatedAt.Truncate(time.Millisecond).Equal(got.CreatedAt), "createdAt is left alone")
+}
+
+type reply struct {
+	ID        string    `bson:"_id"`
+	Status    string    `bson:"status"`
+	ChangedAt time.Time `bson:"changed_at"`
+}
+
+func (r *reply) SetCreatedAt(t time.Time) {}
+func (r *reply) SetUpdatedAt(t time.Time) { r.ChangedAt = t }
+
+func TestRepositoryUpdateTimestamp(t *testing.T) {
+	l := log.StdOutLogger{}
+	m := storage.NewMemoryManager()
+	_, err := m.InsertMany(l, context.Background(), []interface{}{
+		bson.M{"_id": "RPL_1", "status": "maybe"},
+		bson.M{"_id": "EVT_1", "name": "bbq"},
+	}, &storage.InsertManyParams{Collection: "docs"})
+	require.Nil(t, err)
+
+	replies := storage.NewRepository[reply](m, storage.RepositoryParams{Collection: "docs"})
+	require.Nil(t, replies.Update(l, context.Background(), "RPL_1", bson.M{"status": "yes"}))
+	r, err := replies.Get(l, context.Background(), "RPL_1")
+	require.Nil(t, err)
+	require.False(t, r.ChangedAt.IsZero(), "follows the bson tag of the timestamp")
+
+	parties := storage.NewRepository[party](m, storage.RepositoryParams{Collection: "docs"})
+	require.Nil(t, parties.Update(l, context.Background(), "EVT_1", bson.M{"name": "big bbq"}))
+	exists, err := m.Exists(l, context.Background(), &storage.ExistsParams{Collection: "docs", Filter: bson.M{"updatedAt": bson.M{"$exists": true}}})
+	require.Nil(t, err)
+	require.False(t, exists, "types that aren't Timestamped don't get an updatedAt")
+}
+
+func TestFilters(t *testing.T) {
+	f := storage.Or(storage.Eq("status", "open"), storage.Exists("deletedAt", false))
+	raw, err := bson.MarshalExtJSON(f, false, false)
+	require.Nil(t, err)
+	require.Equal(t, `{"$or":[{"status":"open"},{"deletedAt":{"$exists":false}}]}`, string(raw))
+}
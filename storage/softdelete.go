@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	DeletedAtField = "deletedAt"
+	DeletedByField = "deletedBy"
+)
+
+// EnableSoftDelete switches the given collections to soft delete: Delete,
+// FindOneAndDelete and the delete models of BulkWrite set
+// deletedAt/deletedBy instead of removing documents, and every other call
+// that reads or matches documents (finds, counts, aggregations, updates,
+// bulk writes and the FindOneAnd* calls) leaves soft deleted documents out
+// unless IncludeDeleted is set. Call it once while setting up the client,
+// before it is shared
+func (mc *mongoClient) EnableSoftDelete(collections ...string) *mongoClient {
+	if mc.softDelete == nil {
+		mc.softDelete = map[string]bool{}
+	}
+	for _, c := range collections {
+		mc.softDelete[c] = true
+	}
+	return mc
+}
+
+// liveFilter narrows filter down to documents that are not soft deleted
+func (mc *mongoClient) liveFilter(collection string, filter interface{}, includeDeleted bool) interface{} {
+	if includeDeleted || !mc.softDelete[collection] {
+		return filter
+	}
+	return bson.D{{Key: "$and", Value: bson.A{filter, notDeleted()}}}
+}
+
+// livePipeline leaves soft deleted documents out of an aggregation by
+// matching on them right after the stages that have to come first. Stages
+// reading other collections, like $lookup, aren't narrowed down
+func (mc *mongoClient) livePipeline(collection string, pipeline interface{}, includeDeleted bool) (interface{}, error) {
+	if includeDeleted || !mc.softDelete[collection] {
+		return pipeline, nil
+	}
+	var p struct {
+		Stages []bson.D `bson:"stages"`
+	}
+	raw, err := bson.Marshal(bson.M{"stages": pipeline})
+	if err != nil {
+		return nil, err
+	}
+	if err := bson.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	at := 0
+	if len(p.Stages) > 0 && len(p.Stages[0]) > 0 {
+		switch p.Stages[0][0].Key {
+		case "$geoNear", "$search":
+			at = 1
+		}
+	}
+	stages := append(append([]bson.D{}, p.Stages[:at]...), bson.D{{Key: "$match", Value: notDeleted()}})
+	return append(stages, p.Stages[at:]...), nil
+}
+
+func notDeleted() bson.D {
+	return bson.D{{Key: DeletedAtField, Value: bson.D{{Key: "$exists", Value: false}}}}
+}
+
+// softDeleteUpdate marks documents as deleted by deletedBy
+func softDeleteUpdate(deletedBy string) bson.D {
+	return bson.D{{Key: "$set", Value: bson.D{
+		{Key: DeletedAtField, Value: time.Now().UTC()},
+		{Key: DeletedByField, Value: deletedBy},
+	}}}
+}
+
+func (mc *mongoClient) softDeleteDocs(l log.Logger, cc context.Context, params *DeleteParams) (int64, error) {
+	collection := mc.Collection(params.Collection)
+	filter := bson.D{{Key: "$and", Value: bson.A{params.Filter, notDeleted()}}}
+	update := softDeleteUpdate(params.DeletedBy)
+	var err error
+	var res *mongo.UpdateResult
+	if !params.Multiple {
+		res, err = collection.UpdateOne(mc.context(cc), filter, update)
+	} else {
+		res, err = collection.UpdateMany(mc.context(cc), filter, update)
+	}
+	if err != nil {
+		l.Error("unable to soft delete doc(s) in %v: %v", params.Collection, err)
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+type RestoreParams struct {
+	Collection string
+	Filter     interface{}
+	Multiple   bool
+}
+
+func (rp *RestoreParams) valid() bool {
+	return rp.Collection != "" && rp.Filter != nil
+}
+
+// Restore brings soft deleted documents matching the filter back and
+// returns how many were restored
+func (mc *mongoClient) Restore(l log.Logger, cc context.Context, params *RestoreParams) (int64, error) {
+	if ok := params.valid(); !ok || !mc.softDelete[params.Collection] {
+		l.Error("invalid parameters")
+		return 0, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	filter := bson.D{{Key: "$and", Value: bson.A{
+		params.Filter,
+		bson.D{{Key: DeletedAtField, Value: bson.D{{Key: "$exists", Value: true}}}},
+	}}}
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: DeletedAtField, Value: ""}, {Key: DeletedByField, Value: ""}}}}
+	var err error
+	var res *mongo.UpdateResult
+	if !params.Multiple {
+		res, err = collection.UpdateOne(mc.context(cc), filter, update)
+	} else {
+		res, err = collection.UpdateMany(mc.context(cc), filter, update)
+	}
+	if err != nil {
+		l.Error("unable to restore doc(s) in %v: %v", params.Collection, err)
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// PurgeParams selects the soft deleted documents of Collection that were
+// deleted more than OlderThan ago
+type PurgeParams struct {
+	Collection string
+	OlderThan  time.Duration
+}
+
+func (pp *PurgeParams) valid() bool {
+	return pp.Collection != "" && pp.OlderThan > 0
+}
+
+// PurgeDeleted removes soft deleted documents for good once they are past
+// the retention period and returns how many were removed
+func (mc *mongoClient) PurgeDeleted(l log.Logger, cc context.Context, params *PurgeParams) (int64, error) {
+	if ok := params.valid(); !ok || !mc.softDelete[params.Collection] {
+		l.Error("invalid parameters")
+		return 0, MissingRequiredParameterError{}
+	}
+	collection := mc.Collection(params.Collection)
+	cutoff := time.Now().UTC().Add(-params.OlderThan)
+	res, err := collection.DeleteMany(mc.context(cc), bson.D{{Key: DeletedAtField, Value: bson.D{{Key: "$lt", Value: cutoff}}}})
+	if err != nil {
+		l.Error("unable to purge deleted docs in %v: %v", params.Collection, err)
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// RunPurgeJob purges every collection in params right away and then every
+// interval until cc is done. Failures are logged and retried on the next
+// run
+func RunPurgeJob(l log.Logger, cc context.Context, m Manager, interval time.Duration, params ...*PurgeParams) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, p := range params {
+			n, err := m.PurgeDeleted(l, cc, p)
+			if err != nil {
+				l.Error("purge of %v failed: %v", p.Collection, err)
+				continue
+			}
+			if n > 0 {
+				l.Info("purged %d deleted doc(s) from %v", n, p.Collection)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-cc.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRestoreRequiresSoftDelete(t *testing.T) {
+	mc := storage.NewMongoClient(nil, nil).EnableSoftDelete("events")
+	_, err := mc.Restore(log.StdOutLogger{}, context.Background(), &storage.RestoreParams{Collection: "guests", Filter: bson.M{}})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+	_, err = mc.PurgeDeleted(log.StdOutLogger{}, context.Background(), &storage.PurgeParams{Collection: "events"})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err, "retention period is required")
+}
+
+func TestRunPurgeJob(t *testing.T) {
+	mm := &mocks.MockDBManager{Responses: []interface{}{int64(3), int64(0)}}
+	cc, cancel := context.WithCancel(context.Background())
+	cancel()
+	storage.RunPurgeJob(log.StdOutLogger{}, cc, mm, time.Hour,
+		&storage.PurgeParams{Collection: "events", OlderThan: 30 * 24 * time.Hour},
+		&storage.PurgeParams{Collection: "guests", OlderThan: 30 * 24 * time.Hour},
+	)
+	require.Equal(t, 2, mm.CallCount, "every collection is purged once before waiting")
+}
+
+func TestLivePipeline(t *testing.T) {
+	mc := storage.NewMongoClient(nil, nil).EnableSoftDelete("events")
+	notDeleted := bson.D{{Key: "$match", Value: bson.D{{Key: "deletedAt", Value: bson.D{{Key: "$exists", Value: false}}}}}}
+	count := bson.D{{Key: "$count", Value: "n"}}
+
+	pipeline, err := mc.LivePipeline("events", []bson.D{count}, false)
+	require.Nil(t, err)
+	require.Equal(t, []bson.D{notDeleted, count}, pipeline)
+
+	geoNear := bson.D{{Key: "$geoNear", Value: bson.D{{Key: "near", Value: bson.A{0.0, 0.0}}, {Key: "distanceField", Value: "dist"}}}}
+	pipeline, err = mc.LivePipeline("events", []bson.D{geoNear, count}, false)
+	require.Nil(t, err)
+	require.Equal(t, []bson.D{geoNear, notDeleted, count}, pipeline, "$geoNear has to stay first")
+
+	pipeline, err = mc.LivePipeline("events", []bson.D{count}, true)
+	require.Nil(t, err)
+	require.Equal(t, []bson.D{count}, pipeline)
+	pipeline, err = mc.LivePipeline("guests", []bson.D{count}, false)
+	require.Nil(t, err)
+	require.Equal(t, []bson.D{count}, pipeline)
+}
@@ -1,43 +1,40 @@
 package storage
 
 import (
-	"math/rand"
-	"time"
+	"context"
 
 	"github.com/kickback-app/common/log"
 )
 
-var runes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-
 // Decoder represents an object that can be decoded (unmarshalled) into
 // an interface object
 type Decoder interface {
 	Decode(v interface{}) error
 }
 
-// Manager represents a struct that can interface with a backing data store
+// Manager represents a struct that can interface with a backing data store.
+// Every call takes a context.Context; either a *CallContext or any plain
+// context (e.g. the one of the inbound request) can be passed
 type Manager interface {
-	FindOne(l log.Logger, cc *CallContext, params *FindOneParams) (Decoder, error)
-	FindMany(l log.Logger, cc *CallContext, params *FindManyParams) (Decoder, error)
-	InsertOne(l log.Logger, cc *CallContext, document interface{}, params *InsertOneParams) (interface{}, error)
-	InsertMany(l log.Logger, cc *CallContext, data []interface{}, params *InsertManyParams) (interface{}, error)
-	Upsert(l log.Logger, cc *CallContext, updates interface{}, params *UpsertParams) (int64, error)
-	Delete(l log.Logger, cc *CallContext, params *DeleteParams) (int64, error)
+	FindOne(l log.Logger, cc context.Context, params *FindOneParams) (Decoder, error)
+	FindMany(l log.Logger, cc context.Context, params *FindManyParams) (Decoder, error)
+	Iterate(l log.Logger, cc context.Context, params *FindManyParams) (Iterator, error)
+	Aggregate(l log.Logger, cc context.Context, params *AggregateParams) (Decoder, error)
+	InsertOne(l log.Logger, cc context.Context, document interface{}, params *InsertOneParams) (interface{}, error)
+	InsertMany(l log.Logger, cc context.Context, data []interface{}, params *InsertManyParams) (interface{}, error)
+	Upsert(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (int64, error)
+	UpsertWithResult(l log.Logger, cc context.Context, updates interface{}, params *UpsertParams) (*UpsertResult, error)
+	Delete(l log.Logger, cc context.Context, params *DeleteParams) (int64, error)
+	Restore(l log.Logger, cc context.Context, params *RestoreParams) (int64, error)
+	PurgeDeleted(l log.Logger, cc context.Context, params *PurgeParams) (int64, error)
+	BulkWrite(l log.Logger, cc context.Context, models []WriteModel, params *BulkWriteParams) (*BulkWriteResult, error)
+	FindOneAndUpdate(l log.Logger, cc context.Context, updates interface{}, params *FindOneAndUpdateParams) (Decoder, error)
+	FindOneAndReplace(l log.Logger, cc context.Context, replacement interface{}, params *FindOneAndReplaceParams) (Decoder, error)
+	FindOneAndDelete(l log.Logger, cc context.Context, params *FindOneAndDeleteParams) (Decoder, error)
+	CountDocuments(l log.Logger, cc context.Context, params *CountParams) (int64, error)
+	Distinct(l log.Logger, cc context.Context, params *DistinctParams) ([]interface{}, error)
+	Exists(l log.Logger, cc context.Context, params *ExistsParams) (bool, error)
+	Watch(l log.Logger, cc context.Context, params *WatchParams, handler ChangeHandler) error
+	WithTransaction(l log.Logger, cc context.Context, fn func(tx Manager) error) error
 	Close(l log.Logger)
 }
-
-// GenerateID allows us to easily generate a new ID. If we want to
-// make a new userId, we can call storage.GenerateID("USR_", 15) or something of the like
-func GenerateID(prefix string, length int) string {
-	rand.Seed(time.Now().UnixNano())
-	base := randStringRunes(length)
-	return prefix + base
-}
-
-func randStringRunes(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = runes[rand.Intn(len(runes))]
-	}
-	return string(b)
-}
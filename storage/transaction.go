@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	transientTransactionErrorLabel      = "TransientTransactionError"
+	unknownTransactionCommitResultLabel = "UnknownTransactionCommitResult"
+
+	// maxTransactionRetryTime matches the limit the mongo drivers use for
+	// their own convenient transaction api
+	maxTransactionRetryTime = 120 * time.Second
+)
+
+// WithTransaction runs fn inside a multi-document transaction. Every call
+// made through tx is part of the transaction; returning an error from fn
+// aborts it. Transactions that fail with a TransientTransactionError label
+// are retried from the start and commits that fail with an
+// UnknownTransactionCommitResult label are retried, both for at most
+// two minutes. fn may therefore run more than once and must not have side
+// effects outside of tx. Calling WithTransaction on tx joins the running
+// transaction instead of starting a nested one
+func (mc *mongoClient) WithTransaction(l log.Logger, cc context.Context, fn func(tx Manager) error) error {
+	if mc.session != nil {
+		return fn(mc)
+	}
+	session, err := mc.client.StartSession()
+	if err != nil {
+		l.Error("unable to start session: %v", err)
+		return err
+	}
+	// ending the session must happen even if cc is already done
+	defer session.EndSession(context.Background())
+
+	tx := &mongoClient{
+		client:     mc.client,
+		database:   mc.database,
+		session:    session,
+		softDelete: mc.softDelete,
+	}
+	return runTransaction(l, cc, session, maxTransactionRetryTime, func() error {
+		return fn(tx)
+	})
+}
+
+// transactionSession is the part of mongo.Session the retry loop drives
+type transactionSession interface {
+	StartTransaction(opts ...*options.TransactionOptions) error
+	AbortTransaction(ctx context.Context) error
+	CommitTransaction(ctx context.Context) error
+}
+
+// runTransaction runs fn in a transaction of session, retrying as described
+// on WithTransaction for at most maxRetryTime
+func runTransaction(l log.Logger, cc context.Context, session transactionSession, maxRetryTime time.Duration, fn func() error) error {
+	deadline := time.Now().Add(maxRetryTime)
+	canRetry := func() bool {
+		return cc.Err() == nil && time.Now().Before(deadline)
+	}
+	for {
+		if err := session.StartTransaction(); err != nil {
+			l.Error("unable to start transaction: %v", err)
+			return err
+		}
+		if err := fn(); err != nil {
+			_ = session.AbortTransaction(context.Background())
+			if hasErrorLabel(err, transientTransactionErrorLabel) && canRetry() {
+				l.Warn("transient transaction error, retrying: %v", err)
+				continue
+			}
+			return err
+		}
+		err := session.CommitTransaction(cc)
+		for err != nil && hasErrorLabel(err, unknownTransactionCommitResultLabel) && !isMaxTimeMSExpired(err) && canRetry() {
+			l.Warn("unknown transaction commit result, retrying commit: %v", err)
+			err = session.CommitTransaction(cc)
+		}
+		if err == nil {
+			return nil
+		}
+		if hasErrorLabel(err, transientTransactionErrorLabel) && canRetry() {
+			l.Warn("transient transaction error on commit, retrying: %v", err)
+			continue
+		}
+		l.Error("unable to commit transaction: %v", err)
+		return err
+	}
+}
+
+// context binds cc to the running transaction, if there is one
+func (mc *mongoClient) context(cc context.Context) context.Context {
+	if mc.session == nil {
+		return cc
+	}
+	return mongo.NewSessionContext(cc, mc.session)
+}
+
+func hasErrorLabel(err error, label string) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorLabel(label)
+}
+
+func isMaxTimeMSExpired(err error) bool {
+	var ce mongo.CommandError
+	return errors.As(err, &ce) && ce.IsMaxTimeMSExpiredError()
+}
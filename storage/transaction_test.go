@@ -0,0 +1,136 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/mocks"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// scriptedSession fails commits with the scripted errors in order
+type scriptedSession struct {
+	commitErrs []error
+	starts     int
+	aborts     int
+	commits    int
+}
+
+func (s *scriptedSession) StartTransaction(opts ...*options.TransactionOptions) error {
+	s.starts++
+	return nil
+}
+
+func (s *scriptedSession) AbortTransaction(ctx context.Context) error {
+	s.aborts++
+	return nil
+}
+
+func (s *scriptedSession) CommitTransaction(ctx context.Context) error {
+	s.commits++
+	if len(s.commitErrs) == 0 {
+		return nil
+	}
+	err := s.commitErrs[0]
+	s.commitErrs = s.commitErrs[1:]
+	return err
+}
+
+func labelled(label string) error {
+	return mongo.CommandError{Code: 112, Message: "write conflict", Labels: []string{label}}
+}
+
+func TestTransactionRetriesTransientErrors(t *testing.T) {
+	session := &scriptedSession{}
+	runs := 0
+	err := storage.RunTransaction(log.StdOutLogger{}, context.Background(), session, time.Minute, func() error {
+		runs++
+		if runs < 3 {
+			return labelled("TransientTransactionError")
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, runs, "fn should run again after transient errors")
+	require.Equal(t, 2, session.aborts, "failed attempts should be aborted")
+	require.Equal(t, 1, session.commits)
+}
+
+func TestTransactionRetriesUnknownCommitResult(t *testing.T) {
+	session := &scriptedSession{commitErrs: []error{
+		labelled("UnknownTransactionCommitResult"),
+		labelled("UnknownTransactionCommitResult"),
+	}}
+	runs := 0
+	err := storage.RunTransaction(log.StdOutLogger{}, context.Background(), session, time.Minute, func() error {
+		runs++
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, runs, "only the commit is retried")
+	require.Equal(t, 3, session.commits)
+}
+
+func TestTransactionRestartsOnTransientCommitError(t *testing.T) {
+	session := &scriptedSession{commitErrs: []error{labelled("TransientTransactionError")}}
+	runs := 0
+	err := storage.RunTransaction(log.StdOutLogger{}, context.Background(), session, time.Minute, func() error {
+		runs++
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, runs, "the whole transaction runs again")
+	require.Equal(t, 2, session.starts)
+}
+
+func TestTransactionDoesNotRetryOtherErrors(t *testing.T) {
+	session := &scriptedSession{}
+	boom := errors.New("boom")
+	runs := 0
+	err := storage.RunTransaction(log.StdOutLogger{}, context.Background(), session, time.Minute, func() error {
+		runs++
+		return boom
+	})
+	require.Equal(t, boom, err)
+	require.Equal(t, 1, runs)
+	require.Equal(t, 1, session.aborts)
+	require.Equal(t, 0, session.commits)
+
+	unlabelled := &scriptedSession{commitErrs: []error{mongo.CommandError{Code: 50, Message: "exceeded time limit", Labels: []string{"UnknownTransactionCommitResult"}, Name: "MaxTimeMSExpired"}}}
+	err = storage.RunTransaction(log.StdOutLogger{}, context.Background(), unlabelled, time.Minute, func() error { return nil })
+	require.NotNil(t, err, "commits that ran out of time are not retried")
+	require.Equal(t, 1, unlabelled.commits)
+}
+
+func TestTransactionStopsRetryingAfterDeadline(t *testing.T) {
+	session := &scriptedSession{}
+	runs := 0
+	err := storage.RunTransaction(log.StdOutLogger{}, context.Background(), session, 0, func() error {
+		runs++
+		return labelled("TransientTransactionError")
+	})
+	require.NotNil(t, err)
+	require.Equal(t, 1, runs)
+}
+
+func TestMockWithTransaction(t *testing.T) {
+	mm := &mocks.MockDBManager{
+		Responses: []interface{}{"EVT_1", int64(1)},
+	}
+	err := mm.WithTransaction(log.StdOutLogger{}, context.Background(), func(tx storage.Manager) error {
+		if _, err := tx.InsertOne(log.StdOutLogger{}, context.Background(), bson.M{"name": "bbq"}, &storage.InsertOneParams{Collection: "events"}); err != nil {
+			return err
+		}
+		_, err := tx.Upsert(log.StdOutLogger{}, context.Background(), bson.M{"events": 1}, &storage.UpsertParams{Collection: "users", Filter: bson.M{"_id": "USR_1"}, Generic: true})
+		return err
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, mm.CallCount, "calls made through tx consume the scripted responses")
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/kickback-app/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultVersionField = "version"
+
+	conflictRetryBackoff = 10 * time.Millisecond
+)
+
+// Version returns a pointer to v, handy for UpsertParams.ExpectedVersion
+func Version(v int64) *int64 {
+	return &v
+}
+
+// versionedCollection is the part of a *mongo.Collection a versioned update
+// needs
+type versionedCollection interface {
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+}
+
+func versionedUpdate(l log.Logger, cc context.Context, collection versionedCollection, updateCmd interface{}, params *UpsertParams) (*UpsertResult, error) {
+	field := params.VersionField
+	if field == "" {
+		field = DefaultVersionField
+	}
+	update, err := withVersionInc(updateCmd, field)
+	if err != nil {
+		l.Error("unable to add version increment to update: %v", err)
+		return nil, err
+	}
+	filter := bson.D{{Key: "$and", Value: bson.A{params.Filter, bson.D{{Key: field, Value: *params.ExpectedVersion}}}}}
+	opts := append(append([]*options.UpdateOptions{}, params.AdditionalOpts...), options.Update().SetUpsert(false))
+	res, err := collection.UpdateOne(cc, filter, update, opts...)
+	if err != nil {
+		if isCollisionErr(err) {
+			l.Error("collision found trying to update %v: %v", params.Collection, err)
+			return nil, CollisionError{CollectionName: params.Collection}
+		}
+		l.Error("unable to update doc: %v", err)
+		return nil, err
+	}
+	if res.MatchedCount > 0 {
+		return &UpsertResult{MatchedCount: res.MatchedCount, ModifiedCount: res.ModifiedCount}, nil
+	}
+	// tell apart a document that moved on from one that doesn't exist
+	n, err := collection.CountDocuments(cc, params.Filter, options.Count().SetLimit(1))
+	if err != nil {
+		l.Error("unable to check for version conflict in %v: %v", params.Collection, err)
+		return nil, err
+	}
+	if n == 0 {
+		return nil, NotFoundError{}
+	}
+	l.Warn("version conflict updating %v at version %d", params.Collection, *params.ExpectedVersion)
+	return nil, ConflictError{CollectionName: params.Collection, ExpectedVersion: *params.ExpectedVersion}
+}
+
+// withVersionInc adds {$inc: {field: 1}} to an update document, merging it
+// into an $inc that is already there. field is dropped from every other
+// operator (a Generic update $sets the whole struct, version included)
+// since mongo rejects an update that touches the same path twice
+func withVersionInc(update interface{}, field string) (bson.D, error) {
+	var doc bson.D
+	switch u := update.(type) {
+	case bson.D:
+		doc = append(bson.D{}, u...)
+	default:
+		raw, err := bson.Marshal(update)
+		if err != nil {
+			return nil, err
+		}
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+	}
+	inc := bson.D{}
+	out := bson.D{}
+	for _, e := range doc {
+		var fields bson.D
+		raw, err := bson.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err := bson.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		kept := bson.D{}
+		for _, f := range fields {
+			if f.Key != field {
+				kept = append(kept, f)
+			}
+		}
+		switch {
+		case e.Key == "$inc":
+			inc = kept
+		case len(kept) == len(fields):
+			out = append(out, e)
+		case len(kept) > 0:
+			out = append(out, bson.E{Key: e.Key, Value: kept})
+		}
+	}
+	return append(out, bson.E{Key: "$inc", Value: append(inc, bson.E{Key: field, Value: 1})}), nil
+}
+
+// RetryOnConflict runs a read-modify-write fn until it no longer fails with
+// a ConflictError, at most attempts times. fn must re-read the document (and
+// its version) on every run. Any other error is returned straight away
+func RetryOnConflict(cc context.Context, attempts int, fn func(cc context.Context) error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(cc); !IsConflictErr(err) || i == attempts-1 {
+			return err
+		}
+		// a little jitter keeps two writers from colliding in lockstep
+		backoff := time.Duration(i+1)*conflictRetryBackoff + time.Duration(rand.Int63n(int64(conflictRetryBackoff)))
+		select {
+		case <-time.After(backoff):
+		case <-cc.Done():
+			return cc.Err()
+		}
+	}
+	return err
+}
+
+func IsConflictErr(err error) bool {
+	var e ConflictError
+	return errors.As(err, &e)
+}
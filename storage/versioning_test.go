@@ -0,0 +1,149 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kickback-app/common/log"
+	"github.com/kickback-app/common/storage"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestRetryOnConflict(t *testing.T) {
+	calls := 0
+	err := storage.RetryOnConflict(context.Background(), 5, func(cc context.Context) error {
+		calls++
+		if calls < 3 {
+			return storage.ConflictError{CollectionName: "events", ExpectedVersion: int64(calls)}
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, calls)
+}
+
+func TestRetryOnConflictGivesUp(t *testing.T) {
+	calls := 0
+	err := storage.RetryOnConflict(context.Background(), 3, func(cc context.Context) error {
+		calls++
+		return storage.ConflictError{CollectionName: "events"}
+	})
+	require.True(t, storage.IsConflictErr(err))
+	require.Equal(t, 3, calls)
+}
+
+func TestRetryOnConflictOtherError(t *testing.T) {
+	calls := 0
+	boom := errors.New("boom")
+	err := storage.RetryOnConflict(context.Background(), 3, func(cc context.Context) error {
+		calls++
+		return boom
+	})
+	require.Equal(t, boom, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestVersionedUpsertRejectsMultiple(t *testing.T) {
+	mc := storage.NewMongoClient(nil, nil)
+	_, err := mc.UpsertWithResult(log.StdOutLogger{}, context.Background(), bson.M{"name": "party"}, &storage.UpsertParams{
+		Collection:      "events",
+		Filter:          bson.M{},
+		Multiple:        true,
+		Generic:         true,
+		ExpectedVersion: storage.Version(2),
+	})
+	require.Equal(t, storage.MissingRequiredParameterError{}, err)
+}
+
+func TestWithVersionInc(t *testing.T) {
+	update, err := storage.WithVersionInc(bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "bbq"}}}}, "version")
+	require.Nil(t, err)
+	require.Equal(t, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "name", Value: "bbq"}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}, update)
+
+	update, err = storage.WithVersionInc(bson.M{"$inc": bson.M{"guests": 2}}, "rev")
+	require.Nil(t, err)
+	require.Equal(t, bson.D{{Key: "$inc", Value: bson.D{{Key: "guests", Value: int32(2)}, {Key: "rev", Value: 1}}}}, update, "merged into the existing $inc")
+
+	type versioned struct {
+		Name    string `bson:"name"`
+		Version int64  `bson:"version"`
+	}
+	update, err = storage.WithVersionInc(bson.D{{Key: "$set", Value: versioned{Name: "bbq", Version: 3}}}, "version")
+	require.Nil(t, err)
+	require.Equal(t, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "name", Value: "bbq"}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}, update, "the version should only be incremented, never $set as well")
+}
+
+type versionedCollection struct {
+	matched int64
+	count   int64
+	filter  interface{}
+	update  interface{}
+}
+
+func (c *versionedCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	c.filter, c.update = filter, update
+	return &mongo.UpdateResult{MatchedCount: c.matched, ModifiedCount: c.matched}, nil
+}
+
+func (c *versionedCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	return c.count, nil
+}
+
+func TestVersionedUpdate(t *testing.T) {
+	l := log.StdOutLogger{}
+	params := &storage.UpsertParams{Collection: "events", Filter: bson.M{"id": "EVT_1"}, ExpectedVersion: storage.Version(3)}
+	coll := &versionedCollection{matched: 1}
+	res, err := storage.VersionedUpdate(l, context.Background(), coll, bson.D{{Key: "$set", Value: bson.M{"name": "bbq"}}}, params)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.MatchedCount)
+	require.Equal(t, bson.D{{Key: "$and", Value: bson.A{params.Filter, bson.D{{Key: "version", Value: int64(3)}}}}}, coll.filter, "matches on the expected version")
+	require.Equal(t, bson.D{
+		{Key: "$set", Value: bson.M{"name": "bbq"}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}, coll.update)
+
+	_, err = storage.VersionedUpdate(l, context.Background(), &versionedCollection{count: 1}, bson.D{{Key: "$inc", Value: bson.M{"guests": 1}}}, params)
+	require.Equal(t, storage.ConflictError{CollectionName: "events", ExpectedVersion: 3}, err, "the document moved on")
+
+	_, err = storage.VersionedUpdate(l, context.Background(), &versionedCollection{}, bson.D{{Key: "$inc", Value: bson.M{"guests": 1}}}, params)
+	require.Equal(t, storage.NotFoundError{}, err)
+}
+
+func TestMemoryVersionedUpsert(t *testing.T) {
+	l := log.StdOutLogger{}
+	cc := context.Background()
+	m := storage.NewMemoryManager()
+	_, err := m.InsertOne(l, cc, bson.M{"id": "EVT_1", "guests": 1, "version": 1}, &storage.InsertOneParams{Collection: "events"})
+	require.Nil(t, err)
+
+	filter := bson.M{"id": "EVT_1"}
+	_, err = m.UpsertWithResult(l, cc, bson.M{"name": "bbq"}, &storage.UpsertParams{Collection: "events", Filter: filter, Generic: true, ExpectedVersion: storage.Version(1)})
+	require.Nil(t, err)
+	_, err = m.UpsertWithResult(l, cc, bson.M{"$inc": bson.M{"guests": 1}}, &storage.UpsertParams{Collection: "events", Filter: filter, ExpectedVersion: storage.Version(2)})
+	require.Nil(t, err)
+
+	var doc struct {
+		Name    string `bson:"name"`
+		Guests  int    `bson:"guests"`
+		Version int    `bson:"version"`
+	}
+	dec, err := m.FindOne(l, cc, &storage.FindOneParams{Collection: "events", Filter: filter})
+	require.Nil(t, err)
+	require.Nil(t, dec.Decode(&doc))
+	require.Equal(t, "bbq", doc.Name)
+	require.Equal(t, 2, doc.Guests)
+	require.Equal(t, 3, doc.Version, "bumped by both the $set and the $inc update")
+
+	_, err = m.UpsertWithResult(l, cc, bson.M{"name": "stale"}, &storage.UpsertParams{Collection: "events", Filter: filter, Generic: true, ExpectedVersion: storage.Version(2)})
+	require.Equal(t, storage.ConflictError{CollectionName: "events", ExpectedVersion: 2}, err)
+}
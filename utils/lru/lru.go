@@ -0,0 +1,79 @@
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is a size bounded, concurrency safe least recently used cache.
+// Once it holds maxEntries items, adding a new key evicts the entry that
+// was accessed the longest time ago
+type Cache[K comparable, V any] struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[K]*list.Element
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// New returns an empty cache. A maxEntries of zero or less means the cache
+// is unbounded
+func New[K comparable, V any](maxEntries int) *Cache[K, V] {
+	return &Cache[K, V]{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[K]*list.Element{},
+	}
+}
+
+// Get looks up a key and marks it as most recently used
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*entry[K, V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Add inserts or replaces the value stored under key
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*entry[K, V]).value = value
+		return
+	}
+	c.items[key] = c.ll.PushFront(&entry[K, V]{key: key, value: value})
+	if c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove drops key from the cache if it is present
+func (c *Cache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Len returns the number of items currently in the cache
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Cache[K, V]) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*entry[K, V]).key)
+}
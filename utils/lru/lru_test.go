@@ -0,0 +1,35 @@
+package lru
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[string, int](2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	_, _ = c.Get("a") // b is now the least recently used
+	c.Add("c", 3)
+
+	_, ok := c.Get("b")
+	assert.False(t, ok, "b should have been evicted")
+	v, ok := c.Get("a")
+	assert.True(t, ok, "a should still be cached")
+	assert.Equal(t, 1, v)
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestAddReplacesValue(t *testing.T) {
+	c := New[string, int](2)
+	c.Add("a", 1)
+	c.Add("a", 2)
+	v, _ := c.Get("a")
+	assert.Equal(t, 2, v)
+	assert.Equal(t, 1, c.Len())
+
+	c.Remove("a")
+	_, ok := c.Get("a")
+	assert.False(t, ok, "a should have been removed")
+}